@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -20,6 +21,7 @@ import (
 	"github.com/element-hq/chaos/restart"
 	"github.com/element-hq/chaos/snapshot"
 	"github.com/element-hq/chaos/ws"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
@@ -50,140 +52,206 @@ func RegisterRestarter(restartType string, restarterCreateFn CreateRestarter) {
 	restartTypes[restartType] = restarterCreateFn
 }
 
+// CSAPIConvergence is a client for a master user on one of the servers, which invariants can query.
+type CSAPIConvergence = internal.CSAPIConvergence
+
+// StateMachineConvergence is what the state machine expects the servers to agree on, which invariants can query.
+type StateMachineConvergence = internal.StateMachineConvergence
+
+// InvariantFn checks an invariant. It returns a non-empty violation if the invariant does not hold, or an error
+// if it could not be checked.
+type InvariantFn = internal.InvariantFn
+
+// Types used by CSAPIConvergence and StateMachineConvergence, so invariants can be written outside this module.
+type (
+	Event            = internal.Event
+	SyncReq          = internal.SyncReq
+	SyncResponse     = internal.SyncResponse
+	MessagesResponse = internal.MessagesResponse
+	State            = internal.State
+	StateKeyTuple    = internal.StateKeyTuple
+	SentMessage      = internal.SentMessage
+	Membership       = internal.Membership
+)
+
+// The states returned by StateMachineConvergence. These are variables rather than constants, as they are
+// variables in the state machine.
+var (
+	StateStart         = internal.StateStart
+	StateJoined        = internal.StateJoined
+	StateSend          = internal.StateSend
+	StateLeft          = internal.StateLeft
+	StateBanned        = internal.StateBanned
+	StateInvited       = internal.StateInvited
+	StateRejected      = internal.StateRejected
+	StateKnocking      = internal.StateKnocking
+	StateIndeterminate = internal.StateIndeterminate
+)
+
+// The memberships in m.room.member events returned by CSAPIConvergence.
+const (
+	MembershipJoin   = internal.MembershipJoin
+	MembershipLeave  = internal.MembershipLeave
+	MembershipInvite = internal.MembershipInvite
+	MembershipBan    = internal.MembershipBan
+	MembershipKnock  = internal.MembershipKnock
+)
+
+var invariants []internal.Invariant
+
+// RegisterInvariant registers a named invariant with Chaos.
+// The provided function will be invoked in every convergence check once the servers have
+// synchronised and agree with the state machine, and its result is sent to the web UI.
+func RegisterInvariant(name string, check InvariantFn) {
+	invariants = append(invariants, internal.Invariant{Name: name, Check: check})
+}
+
+// BootstrapOpt is a functional option which configures optional behaviour in Bootstrap.
+type BootstrapOpt func(opts *bootstrapOpts)
+
+type bootstrapOpts struct {
+	recordPath string
+	replayPath string
+}
+
+// WithRecording records every tick, fault and convergence check to a JSONL file at path.
+func WithRecording(path string) BootstrapOpt {
+	return func(opts *bootstrapOpts) {
+		opts.recordPath = path
+	}
+}
+
+// WithReplay replays the recording at path instead of generating ticks from the state machine.
+// Faults are injected from the recording, so callers should not send netsplit/restart requests.
+func WithReplay(path string) BootstrapOpt {
+	return func(opts *bootstrapOpts) {
+		opts.replayPath = path
+	}
+}
+
 // Bootstrap is the entry point for running Chaos.
-func Bootstrap(cfg *config.Chaos, wsServer *ws.Server) error {
-	var snapshotters []snapshot.Snapshotter
-	var restarters []restart.Restarter
-	for _, hs := range cfg.Homeservers {
-		if hs.Snapshot.Type != "" {
-			snapshotCreator := snapshotTypes[hs.Snapshot.Type]
-			if snapshotCreator == nil {
-				return fmt.Errorf("hs %s has an unsupported snapshot type: %s", hs.Domain, hs.Snapshot.Type)
-			}
-			snapshotter, err := snapshotCreator(hs)
-			if err != nil {
-				return fmt.Errorf("hs %s : failed to create snapshotter of type %s: %s", hs.Domain, hs.Snapshot.Type, err)
-			}
-			snapshotters = append(snapshotters, snapshotter)
-		}
-		if hs.Restart.Type != "" {
-			restartCreator := restartTypes[hs.Restart.Type]
-			if restartCreator == nil {
-				return fmt.Errorf("hs %s has an unsupported restart type: %s", hs.Domain, hs.Restart.Type)
-			}
-			restarter, err := restartCreator(hs)
-			if err != nil {
-				return fmt.Errorf("hs %s : failed to create restarter of type %s: %s", hs.Domain, hs.Restart.Type, err)
-			}
-			restarters = append(restarters, restarter)
+func Bootstrap(cfg *config.Chaos, wsServer *ws.Server, opts ...BootstrapOpt) error {
+	var bOpts bootstrapOpts
+	for _, o := range opts {
+		o(&bOpts)
+	}
+	if bOpts.recordPath != "" && bOpts.replayPath != "" {
+		return fmt.Errorf("cannot record and replay at the same time")
+	}
+	var recording *internal.Recording
+	if bOpts.replayPath != "" {
+		var err error
+		recording, err = internal.ReadRecording(bOpts.replayPath)
+		if err != nil {
+			return err
 		}
 	}
+	snapshotters, restarters, err := createSnapshottersAndRestarters(cfg)
+	if err != nil {
+		return err
+	}
 
 	sdb, err := snapshot.NewStorage(cfg.Test.SnapshotDB)
 	if err != nil {
 		log.Fatalf("snapshot.NewStorage: %s", err)
 	}
 	doSnapshot(snapshotters, sdb)
+	// convergence times from every run go into the same table, so tag them with this run
+	runID := uuid.NewString()
+	log.Printf("Run ID: %s", runID)
 
-	var shouldBlockFederation atomic.Bool
+	faults := &faultInjector{
+		wsServer:        wsServer,
+		restarters:      restarters,
+		partitionChecks: cfg.Test.Netsplits.PartitionChecks,
+	}
 	if err := setupFederationInterception(
 		wsServer, cfg.MITMProxy.ContainerURL, cfg.MITMProxy.HostDomain,
 		time.Duration(cfg.Test.FederationDelayMs)*time.Millisecond,
-		func() bool {
-			return shouldBlockFederation.Load()
-		}); err != nil {
+		faults.shouldBlockFederation.Load,
+	); err != nil {
 		log.Fatalf("setupFederationInterception: %s", err)
 	}
 
 	m := internal.NewMaster(wsServer)
+	m.SetInvariants(invariants)
+	m.SetFederationBlocked(faults.shouldBlockFederation.Load)
 	if err := m.Prepare(cfg); err != nil {
 		log.Fatalf("Prepare: %s", err)
 	}
-	workerUserIDs := m.StartWorkers(cfg.Test.NumUsers, cfg.Test.OpsPerTick)
+	workerUserIDs := m.StartWorkers(cfg.Test.NumWorkers, cfg.Test.OpsPerTick)
 	wsServer.SetWorkers(workerUserIDs) // let clients know the users we provisioned TODO find a nicer API shape e.g also include netsplits
 	go wsServer.Start(fmt.Sprintf("0.0.0.0:%d", cfg.WSPort))
 
-	// process requests to netsplit or restart servers, or check for convergence / start the tests.
-	// doesn't control _when_ this happens, that's the caller's responsibility.
-	started := atomic.Bool{}
-	convergenceRequested := atomic.Bool{}
-	go func() {
-		for req := range wsServer.ClientRequests() {
-			// we only want to process fault injection if we aren't asked to check for convergence
-			if !convergenceRequested.Load() {
-				if req.Netsplit != nil {
-					new := *req.Netsplit
-					old := shouldBlockFederation.Swap(new)
-					if old != new {
-						// broadcast a netsplit state change
-						wsServer.Send(&ws.PayloadNetsplit{
-							Started: new,
-						})
-					}
+	var recorder *internal.Recorder
+	if bOpts.recordPath != "" {
+		recorder, err = internal.NewRecorder(bOpts.recordPath, m.RecordingHeader())
+		if err != nil {
+			return err
+		}
+		m.SetRecorder(recorder)
+		log.Printf("Recording to %s", bOpts.recordPath)
+	}
+
+	faults.recorder = recorder
+	faults.currentTick = m.CurrentTick
+	postTickFn := func(tickIteration int) {
+		doSnapshot(snapshotters, sdb)
+		if faults.convergenceRequested.Load() {
+			if recorder != nil {
+				record := recorder.RecordConvergence
+				if partitionCheck, _ := faults.requestedCheck(); partitionCheck {
+					record = recorder.RecordPartitionCheck
 				}
-				for _, server := range req.RestartServers {
-					for _, r := range restarters {
-						domain := r.Config().Domain
-						if domain == server {
-							wsServer.Send(&ws.PayloadRestart{
-								Domain:   domain,
-								Finished: false,
-							})
-							r.Restart()
-							wsServer.Send(&ws.PayloadRestart{
-								Domain:   domain,
-								Finished: true,
-							})
-						}
-					}
+				if err := record(tickIteration); err != nil {
+					log.Fatalf("failed to record convergence check: %s", err)
 				}
 			}
-			// To check convergence we cannot be restarting servers or doing netsplits.
-			// If we're in the middle of a restart that's fine as we send sync messages to catch up
-			// which will fail until we are restarted. Netsplits however are a bigger problem as they
-			// are undetectable, so we block all requests to netsplit/restart until we have checked convergence,
-			// and un-netsplit things immediately.
-			if req.CheckConvergence {
-				shouldStartChecks := convergenceRequested.CompareAndSwap(false, true)
-				if shouldStartChecks { // multiple calls to check convergence no-op
-					// heal the netsplit
-					swapped := shouldBlockFederation.CompareAndSwap(true, false)
-					if swapped {
-						// tell the clients
-						wsServer.Send(&ws.PayloadNetsplit{
-							Started: false,
-						})
-					}
-					// we keep convergenceRequested set, so when the tick ends and the Start callback is called, we'll
-					// do a convergence check, and the callback will unset convergenceRequested.
-				}
+			wsServer.Send(&ws.PayloadConvergence{
+				State: "starting",
+			})
+			timeToConverge, err := checkConvergence(m, cfg, faults)
+			if err != nil {
+				wsServer.Send(&ws.PayloadConvergence{
+					State: "failure",
+					Error: err.Error(),
+				})
+				return
+			}
+			var times []snapshot.ConvergenceTime
+			for domain, duration := range timeToConverge {
+				times = append(times, snapshot.ConvergenceTime{
+					RunID:          runID,
+					Tick:           tickIteration,
+					Homeserver:     domain,
+					ConvergeMillis: duration.Milliseconds(),
+				})
 			}
+			if err := sdb.WriteConvergenceTimes(times); err != nil {
+				log.Fatalf("Failed to write convergence times: %s", err)
+			}
+			wsServer.Send(&ws.PayloadConvergence{
+				State: "success",
+			})
+			faults.finishConvergence()
+		}
+	}
+
+	started := atomic.Bool{}
+	go func() {
+		for req := range wsServer.ClientRequests() {
+			faults.handle(req)
 			if req.Begin && started.CompareAndSwap(false, true) {
 				go func() {
-					m.Start(func(tickIteration int) {
-						doSnapshot(snapshotters, sdb)
-						if convergenceRequested.Load() {
-							wsServer.Send(&ws.PayloadConvergence{
-								State: "starting",
-							})
-							err := m.CheckConverged(
-								time.Duration(cfg.Test.Convergence.SyncTimeoutDurationSecs)*time.Second,
-								time.Duration(cfg.Test.Convergence.BufferDurationSecs)*time.Second,
-							)
-
-							if err != nil {
-								wsServer.Send(&ws.PayloadConvergence{
-									State: "failure",
-									Error: err.Error(),
-								})
-								return
-							}
-							wsServer.Send(&ws.PayloadConvergence{
-								State: "success",
-							})
-							convergenceRequested.CompareAndSwap(true, false)
-						}
-					})
+					if recording == nil {
+						m.Start(postTickFn)
+						return
+					}
+					log.Printf("Replaying %d entries from %s", len(recording.Entries), bOpts.replayPath)
+					if err := m.Replay(recording, faults.handle, faults.requestConvergence, postTickFn); err != nil {
+						log.Fatalf("Replay: %s", err)
+					}
+					log.Printf("Finished replaying %s", bOpts.replayPath)
 				}()
 			}
 		}
@@ -191,6 +259,267 @@ func Bootstrap(cfg *config.Chaos, wsServer *ws.Server) error {
 	return nil
 }
 
+// Shrink replays the recording at recordingPath against fresh users and rooms, repeatedly removing ticks, faults,
+// convergence checks and the commands involving each user and room whilst the final convergence check still
+// fails. The smallest failing recording is written to outPath. Users and rooms are mapped in creation order
+// when replaying, so every attempt creates all of them even if they no longer do anything. Blocks until
+// shrinking has finished, which can take a long time as every attempt replays the recording.
+func Shrink(cfg *config.Chaos, wsServer *ws.Server, recordingPath, outPath string) error {
+	rec, err := internal.ReadRecording(recordingPath)
+	if err != nil {
+		return err
+	}
+	_, restarters, err := createSnapshottersAndRestarters(cfg)
+	if err != nil {
+		return err
+	}
+	faults := &faultInjector{
+		wsServer:        wsServer,
+		restarters:      restarters,
+		partitionChecks: cfg.Test.Netsplits.PartitionChecks,
+	}
+	if err := setupFederationInterception(
+		wsServer, cfg.MITMProxy.ContainerURL, cfg.MITMProxy.HostDomain,
+		time.Duration(cfg.Test.FederationDelayMs)*time.Millisecond,
+		faults.shouldBlockFederation.Load,
+	); err != nil {
+		return fmt.Errorf("setupFederationInterception: %s", err)
+	}
+	go wsServer.Start(fmt.Sprintf("0.0.0.0:%d", cfg.WSPort))
+
+	// we want to know if the convergence check fails, not whether the servers return errors.
+	attemptCfg := *cfg
+	attemptCfg.Test.ErrorBudget = math.MaxInt
+	stillFails := func(candidate *internal.Recording) (bool, error) {
+		faults.reset()
+		m := internal.NewMaster(wsServer)
+		m.SetInvariants(invariants)
+		defer m.Stop()
+		if err := m.Prepare(&attemptCfg); err != nil {
+			return false, fmt.Errorf("Prepare: %s", err)
+		}
+		m.StartWorkers(attemptCfg.Test.NumWorkers, attemptCfg.Test.OpsPerTick)
+		faults.currentTick = m.CurrentTick
+		failed := false
+		err := m.Replay(candidate, faults.handle, faults.requestConvergence, func(tickIteration int) {
+			if !faults.convergenceRequested.Load() {
+				return
+			}
+			_, err := checkConvergence(m, &attemptCfg, faults)
+			if err != nil {
+				log.Printf("tick %d: convergence check failed: %s", tickIteration, err)
+				failed = true
+			}
+			faults.finishConvergence()
+		})
+		if err != nil {
+			return false, fmt.Errorf("Replay: %s", err)
+		}
+		return failed, nil
+	}
+
+	failed, err := stillFails(rec)
+	if err != nil {
+		return err
+	}
+	if !failed {
+		return fmt.Errorf("recording %s does not fail a convergence check", recordingPath)
+	}
+	shrunk, err := internal.Shrink(rec, stillFails)
+	if err != nil {
+		return err
+	}
+	if err := shrunk.Write(outPath); err != nil {
+		return err
+	}
+	log.Printf("Wrote shrunk recording to %s: %s", outPath, shrunk.Summary())
+	return nil
+}
+
+// faultInjector processes requests to netsplit or restart servers, or check for convergence.
+// It doesn't control _when_ this happens, that's the caller's responsibility.
+type faultInjector struct {
+	wsServer              *ws.Server
+	restarters            []restart.Restarter
+	shouldBlockFederation atomic.Bool
+	convergenceRequested  atomic.Bool
+	// guards the requested convergence check, so it is never seen half requested or half finished
+	mu sync.Mutex
+	// whether the requested convergence check leaves the netsplit in place and checks each side of it.
+	// This is decided when the check is requested, as the netsplit can't change until the check finishes.
+	partitionCheck bool
+	healedAt       time.Time // when the netsplit was healed for the requested convergence check
+	// a heal was requested during a partition check, so the netsplit is healed once the check finishes
+	healPending bool
+	// if set, convergence checks requested during a netsplit check each side of it instead of healing it
+	partitionChecks bool
+	// if set, faults are recorded against the current tick
+	recorder    *internal.Recorder
+	currentTick func() int
+}
+
+func (f *faultInjector) handle(req ws.RequestPayload) {
+	// we only want to process fault injection if we aren't asked to check for convergence
+	if f.queueHeal(req) {
+		log.Printf("Healing the netsplit once the partition check has finished")
+	} else if !f.convergenceRequested.Load() {
+		if f.recorder != nil && (req.Netsplit != nil || len(req.RestartServers) > 0) {
+			if err := f.recorder.RecordFault(f.currentTick(), ws.RequestPayload{
+				Netsplit:       req.Netsplit,
+				RestartServers: req.RestartServers,
+			}); err != nil {
+				log.Fatalf("failed to record fault: %s", err)
+			}
+		}
+		if req.Netsplit != nil {
+			f.setNetsplit(*req.Netsplit)
+		}
+		for _, server := range req.RestartServers {
+			for _, r := range f.restarters {
+				domain := r.Config().Domain
+				if domain == server {
+					f.wsServer.Send(&ws.PayloadRestart{
+						Domain:   domain,
+						Finished: false,
+					})
+					r.Restart()
+					f.wsServer.Send(&ws.PayloadRestart{
+						Domain:   domain,
+						Finished: true,
+					})
+				}
+			}
+		}
+	}
+	if req.CheckConvergence {
+		// leave the netsplit in place so each side of it is checked by itself
+		f.requestConvergence(f.partitionChecks && f.shouldBlockFederation.Load())
+	}
+}
+
+// queueHeal returns true if the request heals the netsplit during a partition check, in which case the netsplit
+// is healed once the check has finished instead of never.
+func (f *faultInjector) queueHeal(req ws.RequestPayload) bool {
+	if req.Netsplit == nil || *req.Netsplit {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.convergenceRequested.Load() || !f.partitionCheck {
+		return false
+	}
+	f.healPending = true
+	return true
+}
+
+// requestConvergence requests a convergence check at the end of the current tick, unless one has already been
+// requested. To check convergence we cannot be restarting servers or doing netsplits.
+// If we're in the middle of a restart that's fine as we send sync messages to catch up
+// which will fail until we are restarted. Netsplits however are a bigger problem as they
+// are undetectable, so we block all requests to netsplit/restart until we have checked convergence,
+// and un-netsplit things immediately, unless this is a partition check.
+func (f *faultInjector) requestConvergence(partitionCheck bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.convergenceRequested.CompareAndSwap(false, true) {
+		return // multiple calls to check convergence no-op
+	}
+	f.partitionCheck = partitionCheck
+	if partitionCheck {
+		return
+	}
+	// heal the netsplit
+	f.setNetsplit(false)
+	f.healedAt = time.Now()
+	// we keep convergenceRequested set, so when the tick ends and the Start callback is called, we'll
+	// do a convergence check, and the callback will call finishConvergence.
+}
+
+// requestedCheck returns whether the requested convergence check is a partition check, and if not, when the
+// netsplit was healed for it.
+func (f *faultInjector) requestedCheck() (partitionCheck bool, healedAt time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.partitionCheck, f.healedAt
+}
+
+// finishConvergence allows faults to be injected again once the requested convergence check has finished,
+// then heals the netsplit if that was requested during a partition check.
+func (f *faultInjector) finishConvergence() {
+	f.mu.Lock()
+	f.convergenceRequested.Store(false)
+	heal := f.healPending
+	f.healPending = false
+	f.mu.Unlock()
+	if heal {
+		no := false
+		f.handle(ws.RequestPayload{Netsplit: &no})
+	}
+}
+
+// checkConvergence checks that all servers have converged, or that each side of the netsplit is consistent by
+// itself if the netsplit was left in place for the check.
+func checkConvergence(m *internal.Master, cfg *config.Chaos, faults *faultInjector) (map[string]time.Duration, error) {
+	partitionCheck, healedAt := faults.requestedCheck()
+	if partitionCheck {
+		return nil, m.CheckPartitions()
+	}
+	return m.CheckConverged(
+		time.Duration(cfg.Test.Convergence.SyncTimeoutDurationSecs)*time.Second,
+		time.Duration(cfg.Test.Convergence.BufferDurationSecs)*time.Second,
+		healedAt,
+	)
+}
+
+// reset heals any netsplit and clears any pending convergence check.
+func (f *faultInjector) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setNetsplit(false)
+	f.convergenceRequested.Store(false)
+	f.healPending = false
+}
+
+func (f *faultInjector) setNetsplit(netsplit bool) {
+	old := f.shouldBlockFederation.Swap(netsplit)
+	if old != netsplit {
+		// broadcast a netsplit state change
+		f.wsServer.Send(&ws.PayloadNetsplit{
+			Started: netsplit,
+		})
+	}
+}
+
+func createSnapshottersAndRestarters(cfg *config.Chaos) ([]snapshot.Snapshotter, []restart.Restarter, error) {
+	var snapshotters []snapshot.Snapshotter
+	var restarters []restart.Restarter
+	for _, hs := range cfg.Homeservers {
+		if hs.Snapshot.Type != "" {
+			snapshotCreator := snapshotTypes[hs.Snapshot.Type]
+			if snapshotCreator == nil {
+				return nil, nil, fmt.Errorf("hs %s has an unsupported snapshot type: %s", hs.Domain, hs.Snapshot.Type)
+			}
+			snapshotter, err := snapshotCreator(hs)
+			if err != nil {
+				return nil, nil, fmt.Errorf("hs %s : failed to create snapshotter of type %s: %s", hs.Domain, hs.Snapshot.Type, err)
+			}
+			snapshotters = append(snapshotters, snapshotter)
+		}
+		if hs.Restart.Type != "" {
+			restartCreator := restartTypes[hs.Restart.Type]
+			if restartCreator == nil {
+				return nil, nil, fmt.Errorf("hs %s has an unsupported restart type: %s", hs.Domain, hs.Restart.Type)
+			}
+			restarter, err := restartCreator(hs)
+			if err != nil {
+				return nil, nil, fmt.Errorf("hs %s : failed to create restarter of type %s: %s", hs.Domain, hs.Restart.Type, err)
+			}
+			restarters = append(restarters, restarter)
+		}
+	}
+	return snapshotters, restarters, nil
+}
+
 func setupFederationInterception(wsServer *ws.Server, mitmProxyURL, hostDomain string, delayMs time.Duration, shouldBlock func() bool) error {
 	cbServer, err := internal.NewCallbackServer(hostDomain)
 	if err != nil {
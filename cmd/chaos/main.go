@@ -32,10 +32,16 @@ func open(url string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "shrink" {
+		shrink(os.Args[2:])
+		return
+	}
 	flagConfig := flag.String("config", "", "path to the config YAML")
 	flagWeb := flag.Bool("web", false, "Enable the web UI and don't automate actions")
 	flagWebPort := flag.Int("web-port", 3405, "Listen on this port")
 	flagTimeoutSecs := flag.Int("timeout_secs", 0, "number of seconds to run chaos")
+	flagRecord := flag.String("record", "", "Record every tick, fault and convergence check to this JSONL file")
+	flagReplay := flag.String("replay", "", "Replay a file written with --record instead of generating ticks and faults")
 	flag.Parse()
 	cfg, err := config.OpenFile(*flagConfig)
 	if err != nil {
@@ -51,8 +57,16 @@ func main() {
 		}()
 	}
 
+	var opts []chaos.BootstrapOpt
+	if *flagRecord != "" {
+		opts = append(opts, chaos.WithRecording(*flagRecord))
+	}
+	if *flagReplay != "" {
+		opts = append(opts, chaos.WithReplay(*flagReplay))
+	}
+
 	wsServer := ws.NewServer(cfg)
-	if err := chaos.Bootstrap(cfg, wsServer); err != nil {
+	if err := chaos.Bootstrap(cfg, wsServer, opts...); err != nil {
 		log.Fatalf("Bootstrap: %s", err)
 	}
 
@@ -77,7 +91,34 @@ func main() {
 		// spin up an HTTP server which will start Chaos / issue faults
 		chaos.Web(*flagWebPort)
 	} else {
+		testConfig := cfg.Test
+		if *flagReplay != "" {
+			// faults and convergence checks come from the recording, so don't orchestrate any.
+			testConfig.Netsplits.DurationSecs = 0
+			testConfig.Restarts.IntervalSecs = 0
+			testConfig.Convergence.IntervalSecs = 0
+		}
 		// use the provided test yaml to automate fault injection
-		chaos.Orchestrate(cfg.WSPort, cfg.Verbose, cfg.Test)
+		chaos.Orchestrate(cfg.WSPort, cfg.Verbose, testConfig)
+	}
+}
+
+// shrink minimises a recording which fails a convergence check. Blocks until finished.
+func shrink(args []string) {
+	fs := flag.NewFlagSet("shrink", flag.ExitOnError)
+	flagConfig := fs.String("config", "", "path to the config YAML")
+	flagRecording := fs.String("recording", "", "path to a failing recording written with --record")
+	flagOut := fs.String("out", "shrunk.jsonl", "write the minimal failing recording to this JSONL file")
+	fs.Parse(args)
+	if *flagRecording == "" {
+		log.Fatalf("shrink: --recording is required")
+	}
+	cfg, err := config.OpenFile(*flagConfig)
+	if err != nil {
+		log.Fatalf("Error opening config: %s", err)
+	}
+	wsServer := ws.NewServer(cfg)
+	if err := chaos.Shrink(cfg, wsServer, *flagRecording, *flagOut); err != nil {
+		log.Fatalf("Shrink: %s", err)
 	}
 }
@@ -19,28 +19,64 @@ type Chaos struct {
 }
 
 type TestConfig struct {
-	Seed                   int64  `yaml:"seed"`
-	NumInitGoroutines      int    `yaml:"num_init_goroutines"`
-	NumUsers               int    `yaml:"num_users"`
-	NumRooms               int    `yaml:"num_rooms"`
-	OpsPerTick             int    `yaml:"ops_per_tick"`
-	RoomVersion            string `yaml:"room_version"`
-	SendToLeaveProbability int    `yaml:"send_to_leave_probability"`
-	FederationDelayMs      int    `yaml:"federation_delay_ms"`
-	Netsplits              struct {
-		DurationSecs int `yaml:"duration_secs"`
-		FreeSecs     int `yaml:"free_secs"`
+	Seed                    int64  `yaml:"seed"`
+	NumInitGoroutines       int    `yaml:"num_init_goroutines"`
+	NumUsers                int    `yaml:"num_users"`
+	NumWorkers              int    `yaml:"num_workers"`
+	NumRooms                int    `yaml:"num_rooms"`
+	OpsPerTick              int    `yaml:"ops_per_tick"`
+	RoomVersion             string `yaml:"room_version"`
+	JoinRule                string `yaml:"join_rule"`
+	RejectInviteProbability int    `yaml:"reject_invite_probability"`
+	RejectKnockProbability  int    `yaml:"reject_knock_probability"`
+	SendToLeaveProbability  int    `yaml:"send_to_leave_probability"`
+	FederationDelayMs       int    `yaml:"federation_delay_ms"`
+	ErrorBudget             int    `yaml:"error_budget"`
+	StateChurn              struct {
+		Probability     int      `yaml:"probability"`
+		CustomEventType string   `yaml:"custom_event_type"`
+		CustomStateKeys []string `yaml:"custom_state_keys"`
+	} `yaml:"state_churn"`
+	Moderation struct {
+		NumModerators int `yaml:"num_moderators"`
+		Probability   int `yaml:"probability"`
+	} `yaml:"moderation"`
+	PowerLevels struct {
+		Probability int `yaml:"probability"`
+	} `yaml:"power_levels"`
+	Upgrades struct {
+		Probability int    `yaml:"probability"`
+		RoomVersion string `yaml:"room_version"`
+	} `yaml:"upgrades"`
+	ProfileChurn struct {
+		Probability int `yaml:"probability"`
+	} `yaml:"profile_churn"`
+	Redactions struct {
+		Probability int  `yaml:"probability"`
+		StateEvents bool `yaml:"state_events"`
+	} `yaml:"redactions"`
+	Netsplits struct {
+		DurationSecs    int  `yaml:"duration_secs"`
+		FreeSecs        int  `yaml:"free_secs"`
+		PartitionChecks bool `yaml:"partition_checks"`
 	} `yaml:"netsplits"`
 	Restarts struct {
 		IntervalSecs int      `yaml:"interval_secs"`
 		RoundRobin   []string `yaml:"round_robin"`
 	} `yaml:"restarts"`
 	Convergence struct {
-		Enabled                 bool `yaml:"enabled"`
-		IntervalSecs            int  `yaml:"interval_secs"`
-		BufferDurationSecs      int  `yaml:"buffer_secs"`
-		SyncTimeoutDurationSecs int  `yaml:"synchronisation_timeout_secs"`
-		HaltOnFailure           bool `yaml:"halt_on_failure"`
+		Enabled                 bool   `yaml:"enabled"`
+		IntervalSecs            int    `yaml:"interval_secs"`
+		BufferDurationSecs      int    `yaml:"buffer_secs"`
+		SyncTimeoutDurationSecs int    `yaml:"synchronisation_timeout_secs"`
+		HaltOnFailure           bool   `yaml:"halt_on_failure"`
+		FullState               bool   `yaml:"full_state"`
+		Timeline                bool   `yaml:"timeline"`
+		PollTimeoutSecs         int    `yaml:"poll_timeout_secs"`
+		ReportDir               string `yaml:"report_dir"`
+		StrictMembership        bool   `yaml:"strict_membership"`
+		UserSync                bool   `yaml:"user_sync"`
+		DerivedViews            bool   `yaml:"derived_views"`
 	}
 	SnapshotDB string `yaml:"snapshot_db"` // path to sqlite3 file to write snapshot data to
 }
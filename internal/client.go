@@ -2,11 +2,14 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -104,6 +107,25 @@ func (c *CSAPI) CreateRoom(body map[string]interface{}) (roomID string, err erro
 	return r.RoomID, nil
 }
 
+// UpgradeRoom upgrades the room to the given room version, returning the ID of the replacement room.
+func (c *CSAPI) UpgradeRoom(roomID, roomVersion string) (string, error) {
+	res, err := c.Do(
+		"POST", []string{"_matrix", "client", "v3", "rooms", roomID, "upgrade"},
+		WithJSONBody(map[string]any{"new_version": roomVersion}),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	r := struct {
+		ReplacementRoom string `json:"replacement_room"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("UpgradeRoom: failed to read response body: %s", err)
+	}
+	return r.ReplacementRoom, nil
+}
+
 func (c *CSAPI) JoinRoom(roomIDOrAlias string, serverNames []string) error {
 	// construct URL query parameters
 	query := make(url.Values, len(serverNames))
@@ -118,6 +140,18 @@ func (c *CSAPI) JoinRoom(roomIDOrAlias string, serverNames []string) error {
 	return err
 }
 
+func (c *CSAPI) Knock(roomIDOrAlias string, serverNames []string) error {
+	query := make(url.Values, len(serverNames))
+	for _, serverName := range serverNames {
+		query.Add("server_name", serverName)
+	}
+	_, err := c.Do(
+		"POST", []string{"_matrix", "client", "v3", "knock", roomIDOrAlias},
+		WithQueries(query), WithJSONBody(map[string]interface{}{}),
+	)
+	return err
+}
+
 // EnsureFullyJoined makes sure that the room is no longer partially joined.
 // The server will block until the room is fully joined
 // so we can use this as a synchronisation primitive when joining rooms initially.
@@ -135,6 +169,43 @@ func (c *CSAPI) LeaveRoom(roomID string) error {
 	return err
 }
 
+func (c *CSAPI) Invite(roomID, userID string) error {
+	_, err := c.Do("POST", []string{"_matrix", "client", "v3", "rooms", roomID, "invite"}, WithJSONBody(map[string]any{
+		"user_id": userID,
+	}))
+	return err
+}
+
+func (c *CSAPI) Kick(roomID, userID string) error {
+	_, err := c.Do("POST", []string{"_matrix", "client", "v3", "rooms", roomID, "kick"}, WithJSONBody(map[string]any{
+		"user_id": userID,
+	}))
+	return err
+}
+
+func (c *CSAPI) Ban(roomID, userID string) error {
+	_, err := c.Do("POST", []string{"_matrix", "client", "v3", "rooms", roomID, "ban"}, WithJSONBody(map[string]any{
+		"user_id": userID,
+	}))
+	return err
+}
+
+func (c *CSAPI) Unban(roomID, userID string) error {
+	_, err := c.Do("POST", []string{"_matrix", "client", "v3", "rooms", roomID, "unban"}, WithJSONBody(map[string]any{
+		"user_id": userID,
+	}))
+	return err
+}
+
+// SetDisplayName sets the display name of the user, which the server propagates to every room they are joined to.
+func (c *CSAPI) SetDisplayName(displayName string) error {
+	_, err := c.Do(
+		"PUT", []string{"_matrix", "client", "v3", "profile", c.UserID, "displayname"},
+		WithJSONBody(map[string]any{"displayname": displayName}),
+	)
+	return err
+}
+
 func (c *CSAPI) SendMessageWithText(roomID string, text string) (string, error) {
 	c.counter++
 	paths := []string{"_matrix", "client", "v3", "rooms", roomID, "send", "m.room.message", fmt.Sprintf("%d", c.counter)}
@@ -157,6 +228,73 @@ func (c *CSAPI) SendMessageWithText(roomID string, text string) (string, error)
 	return body.EventID, nil
 }
 
+// Redact the event in the room, returning the event ID of the redaction.
+func (c *CSAPI) Redact(roomID, eventID string) (string, error) {
+	c.counter++
+	paths := []string{"_matrix", "client", "v3", "rooms", roomID, "redact", eventID, fmt.Sprintf("%d", c.counter)}
+	res, err := c.Do("PUT", paths, WithJSONBody(map[string]any{}))
+	if err != nil {
+		return "", err
+	}
+	body := struct {
+		EventID string `json:"event_id"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode response body: %s", err)
+	}
+	return body.EventID, nil
+}
+
+func (c *CSAPI) SendState(roomID, eventType, stateKey string, content map[string]any) (string, error) {
+	paths := []string{"_matrix", "client", "v3", "rooms", roomID, "state", eventType, stateKey}
+	res, err := c.Do("PUT", paths, WithJSONBody(content))
+	if err != nil {
+		return "", err
+	}
+	body := struct {
+		EventID string `json:"event_id"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode response body: %s", err)
+	}
+	return body.EventID, nil
+}
+
+// StateEvent returns the content of the state event with the given type and state key in the room.
+func (c *CSAPI) StateEvent(roomID, eventType, stateKey string) (map[string]any, error) {
+	res, err := c.Do("GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state", eventType, stateKey})
+	if err != nil {
+		return nil, fmt.Errorf("StateEvent failed: %s", err)
+	}
+	var content map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&content); err != nil {
+		return nil, fmt.Errorf("StateEvent response decoding: %s", err)
+	}
+	return content, nil
+}
+
+// SetPowerLevel sets the power level of the user in the room, leaving the rest of the power levels untouched.
+// A level of 0 removes the user from the power levels, so they get the default level.
+// This is not atomic, so concurrent callers in the same room will clobber each other's changes.
+func (c *CSAPI) SetPowerLevel(roomID, userID string, level int) error {
+	content, err := c.StateEvent(roomID, "m.room.power_levels", "")
+	if err != nil {
+		return err
+	}
+	users, _ := content["users"].(map[string]any)
+	if users == nil {
+		users = make(map[string]any)
+	}
+	if level == 0 {
+		delete(users, userID)
+	} else {
+		users[userID] = level
+	}
+	content["users"] = users
+	_, err = c.SendState(roomID, "m.room.power_levels", "", content)
+	return err
+}
+
 type Event struct {
 	StateKey    *string                `json:"state_key,omitempty"`    // The state key for the event. Only present on State Events.
 	Sender      string                 `json:"sender"`                 // The user ID of the sender of the event
@@ -223,6 +361,12 @@ type SyncResponse struct {
 			} `json:"timeline"`
 		} `json:"leave"`
 		Join map[string]struct {
+			// only present if the summary changed, or if lazy loading members
+			Summary struct {
+				Heroes             []string `json:"m.heroes"`
+				JoinedMemberCount  *int     `json:"m.joined_member_count"`
+				InvitedMemberCount *int     `json:"m.invited_member_count"`
+			} `json:"summary"`
 			State struct {
 				Events []Event `json:"events"`
 			} `json:"state"`
@@ -240,6 +384,11 @@ type SyncResponse struct {
 				Events []Event
 			} `json:"invite_state"`
 		} `json:"invite"`
+		Knock map[string]struct {
+			State struct {
+				Events []Event `json:"events"`
+			} `json:"knock_state"`
+		} `json:"knock"`
 	} `json:"rooms"`
 }
 
@@ -265,7 +414,7 @@ func (c *CSAPI) Sync(syncReq SyncReq) (*SyncResponse, error) {
 	}
 	res, err := c.Do("GET", []string{"_matrix", "client", "v3", "sync"}, WithQueries(query))
 	if err != nil {
-		return nil, fmt.Errorf("Sync failed: %s", err)
+		return nil, fmt.Errorf("Sync failed: %w", err)
 	}
 	var sr SyncResponse
 	if err := json.NewDecoder(res.Body).Decode(&sr); err != nil {
@@ -288,6 +437,80 @@ func (c *CSAPI) Members(roomID string) ([]Event, error) {
 	return body.Chunk, nil
 }
 
+// JoinedMembers returns the user IDs of everyone joined to the room, according to /joined_members.
+func (c *CSAPI) JoinedMembers(roomID string) ([]string, error) {
+	res, err := c.Do("GET", []string{"_matrix", "client", "v3", "rooms", roomID, "joined_members"})
+	if err != nil {
+		return nil, fmt.Errorf("JoinedMembers failed: %s", err)
+	}
+	body := struct {
+		Joined map[string]any `json:"joined"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("JoinedMembers response decoding: %s", err)
+	}
+	var userIDs []string
+	for userID := range body.Joined {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// JoinedRooms returns the room IDs of every room the user is joined to, according to /joined_rooms.
+func (c *CSAPI) JoinedRooms() ([]string, error) {
+	res, err := c.Do("GET", []string{"_matrix", "client", "v3", "joined_rooms"})
+	if err != nil {
+		return nil, fmt.Errorf("JoinedRooms failed: %s", err)
+	}
+	body := struct {
+		JoinedRooms []string `json:"joined_rooms"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("JoinedRooms response decoding: %s", err)
+	}
+	return body.JoinedRooms, nil
+}
+
+func (c *CSAPI) State(roomID string) ([]Event, error) {
+	res, err := c.Do("GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state"})
+	if err != nil {
+		return nil, fmt.Errorf("State failed: %s", err)
+	}
+	var events []Event
+	if err := json.NewDecoder(res.Body).Decode(&events); err != nil {
+		return nil, fmt.Errorf("State response decoding: %s", err)
+	}
+	return events, nil
+}
+
+// MessagesResponse is a single page of events from /messages.
+type MessagesResponse struct {
+	Chunk []Event `json:"chunk"`
+	Start string  `json:"start"`
+	End   string  `json:"end"` // empty if there are no more events
+}
+
+// Messages returns up to limit events in the room before the from token, newest first. If from is empty,
+// starts from the latest event in the room.
+func (c *CSAPI) Messages(roomID, from string, limit int) (*MessagesResponse, error) {
+	query := url.Values{
+		"dir":   []string{"b"},
+		"limit": []string{fmt.Sprintf("%d", limit)},
+	}
+	if from != "" {
+		query["from"] = []string{from}
+	}
+	res, err := c.Do("GET", []string{"_matrix", "client", "v3", "rooms", roomID, "messages"}, WithQueries(query))
+	if err != nil {
+		return nil, fmt.Errorf("Messages failed: %s", err)
+	}
+	var body MessagesResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Messages response decoding: %s", err)
+	}
+	return &body, nil
+}
+
 func (c *CSAPI) Event(roomID, eventID string) (*Event, error) {
 	res, err := c.Do("GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", eventID})
 	if err != nil {
@@ -362,16 +585,66 @@ func (c *CSAPI) Do(method string, paths []string, opts ...RequestOpt) (*http.Res
 		req.Body = io.NopCloser(bytes.NewBuffer(bodyCopy))
 	}
 	if res == nil {
-		return nil, fmt.Errorf("CSAPI.Do response returned error: %s", err)
+		return nil, fmt.Errorf("CSAPI.Do response returned error: %w", err)
 	}
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		defer res.Body.Close()
 		body, _ := io.ReadAll(res.Body)
-		return nil, fmt.Errorf("CSAPI.Do %s failed with response code HTTP %d : %s", req.URL.String(), res.StatusCode, string(body))
+		return nil, &HTTPError{
+			URL:        req.URL.String(),
+			StatusCode: res.StatusCode,
+			Body:       string(body),
+		}
 	}
 	return res, nil
 }
 
+// HTTPError is returned by CSAPI.Do when the server responds with a non-2xx status code.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("CSAPI.Do %s failed with response code HTTP %d : %s", e.URL, e.StatusCode, e.Body)
+}
+
+// ErrorClass is a coarse classification of errors returned by CSAPI functions.
+type ErrorClass string
+
+const (
+	// The request timed out, either on our side or at a gateway. The server may or may not have applied it.
+	ErrorClassTimeout ErrorClass = "timeout"
+	// The server rejected the request.
+	ErrorClass4xx ErrorClass = "4xx"
+	// The server failed to process the request.
+	ErrorClass5xx ErrorClass = "5xx"
+	// Anything else e.g connection refused, malformed responses.
+	ErrorClassOther ErrorClass = "other"
+)
+
+// ClassifyError returns the ErrorClass for an error returned from a CSAPI function.
+func ClassifyError(err error) ErrorClass {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusGatewayTimeout:
+			return ErrorClassTimeout
+		case httpErr.StatusCode >= 500:
+			return ErrorClass5xx
+		case httpErr.StatusCode >= 400:
+			return ErrorClass4xx
+		}
+		return ErrorClassOther
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorClassTimeout
+	}
+	return ErrorClassOther
+}
+
 // RequestOpt is a functional option which will modify an outgoing HTTP request.
 // See functions starting with `With...` in this package for more info.
 type RequestOpt func(req *http.Request)
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want ErrorClass
+	}{
+		{err: &HTTPError{StatusCode: http.StatusForbidden}, want: ErrorClass4xx},
+		{err: &HTTPError{StatusCode: http.StatusTooManyRequests}, want: ErrorClass4xx},
+		{err: &HTTPError{StatusCode: http.StatusInternalServerError}, want: ErrorClass5xx},
+		{err: &HTTPError{StatusCode: http.StatusBadGateway}, want: ErrorClass5xx},
+		{err: &HTTPError{StatusCode: http.StatusGatewayTimeout}, want: ErrorClassTimeout},
+		{err: fmt.Errorf("CSAPI.Do response returned error: %w", timeoutError{}), want: ErrorClassTimeout},
+		{err: fmt.Errorf("wrapped: %w", context.DeadlineExceeded), want: ErrorClassTimeout},
+		{err: fmt.Errorf("connection refused"), want: ErrorClassOther},
+	}
+	for _, tc := range testCases {
+		if got := ClassifyError(tc.err); got != tc.want {
+			t.Errorf("ClassifyError(%v) got %v want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -35,15 +39,43 @@ const (
 // CSAPI functions needed to do convergence checks
 type CSAPIConvergence interface {
 	Members(roomID string) ([]Event, error)
+	State(roomID string) ([]Event, error)
 	Sync(syncReq SyncReq) (*SyncResponse, error)
 	SendMessageWithText(roomID string, text string) (string, error)
 	Event(roomID, eventID string) (*Event, error)
+	Messages(roomID, from string, limit int) (*MessagesResponse, error)
+	JoinedMembers(roomID string) ([]string, error)
+	JoinedRooms() ([]string, error)
 	GetUserID() string
 }
 
 // StateMachine functions needed to do convergence checks
 type StateMachineConvergence interface {
 	GetInternalState() map[string]map[string]State //user->room->state
+	// Returns the possible states for users which are in StateIndeterminate
+	GetIndeterminateStates() map[string]map[string][]State //user->room->states
+	// Returns the possible contents of state events sent by the state machine
+	GetExpectedRoomState() map[string]map[StateKeyTuple][]map[string]any //room->state event->contents
+	// Returns the possible power levels of users whose power level was changed by the state machine
+	GetExpectedPowerLevels() map[string]map[string][]int //room->user->power levels
+	// Returns the replacement room for every room which has been upgraded
+	GetRoomUpgrades() map[string]string //room->replacement room
+	// Returns the possible display names of users whose display name was set by the state machine
+	GetExpectedDisplayNames() map[string][]string //user->display names
+	// Returns the events redacted by the state machine, and whether they are definitely redacted
+	GetExpectedRedactions() map[string]map[string]bool //room->event ID->definite
+	// Returns the messages sent since the last successful convergence check
+	GetSentMessages() []SentMessage
+	// Returns who last changed the membership of each user, which is the user themselves unless a moderator did
+	GetMembershipActors() map[string]map[string]string //room->user->actor
+	// Returns who last sent each state event sent by the state machine
+	GetStateSenders() map[string]map[StateKeyTuple]string //room->state event->sender
+}
+
+// memberState is the membership of a user in a room and the display name in their member event, as seen by a server.
+type memberState struct {
+	Membership  Membership
+	DisplayName string
 }
 
 type Convergence struct {
@@ -52,106 +84,774 @@ type Convergence struct {
 	sm            StateMachineConvergence
 	convMechanism ConvergenceMechanism
 	updaterFn     func(ws.PayloadConvergence)
+	fullState     bool // compare the entire room state between servers
+	timeline      bool // compare the entire timeline of every room between servers
+	// if set, keep checking until every server agrees or this much time has passed, instead of checking once
+	pollTimeout      time.Duration
+	reportDir        string                             // where to write reports of failed checks, if anywhere
+	reportFn         func(*ws.PayloadConvergenceReport) // if set, failed checks send a report here
+	invariants       []Invariant                        // extra checks registered by the caller
+	strict           bool                               // fail if anyone unexpected is joined to a room
+	strictMembers    []string                           // users other than test users and masters who may be joined in strict mode
+	userViews        []*userSyncView                    // test users whose own /sync is checked
+	derivedViews     bool                               // check /joined_members, /joined_rooms and /sync room summaries
+	derivedViewUsers []CSAPIConvergence                 // test users whose /joined_rooms is checked
+	unjoinedMasters  map[string]bool                    // masters which haven't joined the rooms yet. See WithUnjoinedMasters.
+}
+
+// pollInterval is how long to wait between checks when polling.
+const pollInterval = time.Second
+
+// ConvergenceOpt is a functional option which configures optional checks in Convergence.
+type ConvergenceOpt func(c *Convergence)
+
+// WithFullStateComparison makes convergence checks compare the event ID of every current state event in every room
+// between servers, in addition to checking the state the state machine knows about. This catches state resolution
+// divergence in state events the state machine doesn't model, such as the create event, join rules and the power
+// levels of the masters.
+func WithFullStateComparison() ConvergenceOpt {
+	return func(c *Convergence) {
+		c.fullState = true
+	}
+}
+
+// WithTimelineComparison makes convergence checks back-paginate the entire timeline of every room on every server,
+// and check that every server has the same events, that each user's events are in the same order on every server,
+// and that nobody sends an event before they first join the room. Servers may order concurrent events differently,
+// so only the order of causally related events is checked.
+func WithTimelineComparison() ConvergenceOpt {
+	return func(c *Convergence) {
+		c.timeline = true
+	}
 }
 
-func NewConvergence(masters []CSAPIConvergence, roomIDs []string, sm StateMachineConvergence, updaterFn func(ws.PayloadConvergence)) *Convergence {
-	return &Convergence{
+// WithPolling makes convergence checks repeatedly check every server until they all agree or the timeout passes,
+// instead of waiting for a fixed buffer duration then checking once. This measures how long each server takes to
+// catch up after a netsplit heals, which is when it last started passing. Servers are compared with the first
+// master, so a disagreement between them is only attributed to the other server: the first master is considered
+// converged as soon as it agrees with the state machine.
+func WithPolling(timeout time.Duration) ConvergenceOpt {
+	return func(c *Convergence) {
+		c.pollTimeout = timeout
+	}
+}
+
+func NewConvergence(masters []CSAPIConvergence, roomIDs []string, sm StateMachineConvergence, updaterFn func(ws.PayloadConvergence), opts ...ConvergenceOpt) *Convergence {
+	c := &Convergence{
 		masters:       masters,
 		roomIDs:       roomIDs,
 		sm:            sm,
 		convMechanism: ConvergenceMechanismMembers,
 		updaterFn:     updaterFn,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithStrictMembership makes convergence checks fail if anyone is joined to a room who isn't a user in the state
+// machine, a master or one of the given users which are always joined e.g moderators. This catches phantom members,
+// such as users from earlier runs or users the server invented.
+func WithStrictMembership(alwaysJoinedIDs ...string) ConvergenceOpt {
+	return func(c *Convergence) {
+		c.strict = true
+		c.strictMembers = append(c.strictMembers, alwaysJoinedIDs...)
+	}
+}
+
+// WithUnjoinedMasters tells Convergence that the given masters haven't joined the rooms yet, so partition checks skip
+// them until MasterJoined is called. They must have joined before AssertSince is called, which checks every master.
+func WithUnjoinedMasters(userIDs ...string) ConvergenceOpt {
+	return func(c *Convergence) {
+		if c.unjoinedMasters == nil {
+			c.unjoinedMasters = make(map[string]bool)
+		}
+		for _, userID := range userIDs {
+			c.unjoinedMasters[userID] = true
+		}
+	}
+}
+
+// MasterJoined tells Convergence that a master passed to WithUnjoinedMasters has joined every room.
+func (c *Convergence) MasterJoined(userID string) {
+	delete(c.unjoinedMasters, userID)
+}
+
+// knownMembers returns everyone who may be joined to a room in strict mode, or nil if not in strict mode.
+func (c *Convergence) knownMembers() map[string]bool {
+	if !c.strict {
+		return nil
+	}
+	known := make(map[string]bool)
+	for userID := range c.sm.GetInternalState() {
+		known[userID] = true
+	}
+	for _, master := range c.masters {
+		known[master.GetUserID()] = true
+	}
+	for _, userID := range c.strictMembers {
+		known[userID] = true
+	}
+	return known
+}
+
+// allRoomIDs returns the rooms to check in a deterministic order, including replacement rooms.
+func (c *Convergence) allRoomIDs() []string {
+	roomIDs := slices.Clone(c.roomIDs)
+	for _, replacementRoomID := range c.sm.GetRoomUpgrades() {
+		roomIDs = append(roomIDs, replacementRoomID)
+	}
+	slices.Sort(roomIDs)
+	return roomIDs
 }
 
+// Assert that all servers have converged. See AssertSince.
 func (c *Convergence) Assert(ctx context.Context, bufferDuration time.Duration) error {
-	err := c.ensureSynchronised(ctx)
+	_, err := c.AssertSince(ctx, bufferDuration, time.Now())
+	return err
+}
+
+// AssertSince asserts that all servers have converged, having healed any netsplit at healedAt. Once synchronised,
+// waits bufferDuration then checks once. With WithPolling, keeps checking until every server agrees instead, and
+// returns how long each server took to converge after healedAt, keyed by server domain. Servers are still checked
+// if they fail to synchronise, so any disagreement is reported, but an error is returned even if they agree, as
+// they may not have seen every command yet.
+func (c *Convergence) AssertSince(ctx context.Context, bufferDuration time.Duration, healedAt time.Time) (map[string]time.Duration, error) {
+	syncErr := c.ensureSynchronised(ctx)
 	errStr := ""
-	if err != nil {
-		errStr = err.Error()
+	if syncErr != nil {
+		errStr = syncErr.Error()
 	}
 	c.updaterFn(ws.PayloadConvergence{
 		State: "synchronised",
 		Error: errStr,
 	})
+	notSynchronised := func() error {
+		err := fmt.Errorf("servers agree but failed to synchronise, so may not have seen every command: %w", syncErr)
+		c.report([]error{err})
+		return err
+	}
+	if c.pollTimeout == 0 {
+		c.updaterFn(ws.PayloadConvergence{
+			State: "waiting",
+		})
+		time.Sleep(bufferDuration)
+		c.updaterFn(ws.PayloadConvergence{
+			State: "checking",
+		})
+		errs := c.check()
+		for _, err := range errs {
+			if err != nil {
+				c.report(errs)
+				return nil, err
+			}
+		}
+		if err := c.assertUserSyncViews(c.expectedRoomStates()); err != nil {
+			c.report([]error{err})
+			return nil, err
+		}
+		if err := c.checkInvariants(); err != nil {
+			c.report([]error{err})
+			return nil, err
+		}
+		if syncErr != nil {
+			return nil, notSynchronised()
+		}
+		return nil, nil
+	}
 	c.updaterFn(ws.PayloadConvergence{
-		State: "waiting",
+		State: "polling",
 	})
-	time.Sleep(bufferDuration)
-	// room ID => user ID => State, confusingly the inverse of StateMachine's user ID => room ID => State
-	roomStates := make(map[string]map[string]State)
+	deadline := time.Now().Add(c.pollTimeout)
+	timeToConverge := make(map[string]time.Duration)
+	for {
+		var firstErr error
+		errs := c.check()
+		for i, err := range errs {
+			_, domain, _ := strings.Cut(c.masters[i].GetUserID(), ":")
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				// the server only converged once it stops failing
+				delete(timeToConverge, domain)
+				continue
+			}
+			if _, ok := timeToConverge[domain]; !ok {
+				timeToConverge[domain] = time.Since(healedAt)
+			}
+		}
+		if firstErr == nil {
+			// users' own views and invariants are only worth checking once the servers agree with the state machine
+			if err := c.assertUserSyncViews(c.expectedRoomStates()); err != nil {
+				firstErr = err
+				errs = append(errs, err)
+			} else if err := c.checkInvariants(); err != nil {
+				firstErr = err
+				errs = append(errs, err)
+			}
+		}
+		if firstErr == nil && syncErr != nil {
+			return nil, notSynchronised()
+		}
+		if firstErr == nil {
+			payload := ws.PayloadConvergence{
+				State:            "converged",
+				TimeToConvergeMs: make(map[string]int64),
+			}
+			for domain, duration := range timeToConverge {
+				payload.TimeToConvergeMs[domain] = duration.Milliseconds()
+			}
+			c.updaterFn(payload)
+			return timeToConverge, nil
+		}
+		if time.Now().After(deadline) {
+			c.report(errs)
+			return timeToConverge, fmt.Errorf("servers did not converge within %s: %s", c.pollTimeout, firstErr)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// expectedRoomStates returns room ID => user ID => acceptable States, confusingly the inverse of StateMachine's
+// user ID => room ID => State.
+func (c *Convergence) expectedRoomStates() map[string]map[string][]State {
+	roomStates := make(map[string]map[string][]State)
 	state := c.sm.GetInternalState()
+	possibleStates := c.sm.GetIndeterminateStates()
 	for userID := range state {
 		for roomID := range state[userID] {
 			rs, ok := roomStates[roomID]
 			if !ok {
-				rs = make(map[string]State)
+				rs = make(map[string][]State)
 			}
-			// collapse states to either joined or left
 			s := state[userID][roomID]
-			switch s {
-			case StateSend:
-				s = StateJoined
-			case StateStart:
-				s = StateLeft
+			if s == StateIndeterminate {
+				// the server may have applied the command or not, so accept any of the possible states
+				for _, possible := range possibleStates[userID][roomID] {
+					rs[userID] = append(rs[userID], collapseState(possible))
+				}
+			} else {
+				// collapse states to either joined or left
+				rs[userID] = []State{collapseState(s)}
 			}
-			rs[userID] = s
 			roomStates[roomID] = rs
 		}
 	}
+	return roomStates
+}
+
+// check checks every server once, returning the error for each master, if any.
+func (c *Convergence) check() []error {
+	roomStates := c.expectedRoomStates()
 	// each master is on a different server, so we need to check state from both
-	c.updaterFn(ws.PayloadConvergence{
-		State: "checking",
-	})
-	for _, master := range c.masters {
-		switch c.convMechanism {
-		case ConvergenceMechanismMembers:
-			err := c.assertWithMembers(master, roomStates)
+	// room ID => user ID => membership for users who could be in more than one state or have more than one
+	// display name. All servers must agree on which state they are in.
+	agreedMemberships := make(map[string]map[string]memberState)
+	displayNames := c.sm.GetExpectedDisplayNames()
+	expectedRoomState := c.sm.GetExpectedRoomState()
+	// room ID => state event => normalised content, for state events which could have more than one content.
+	agreedRoomState := make(map[string]map[StateKeyTuple]string)
+	expectedPowerLevels := c.sm.GetExpectedPowerLevels()
+	upgrades := c.sm.GetRoomUpgrades()
+	// room ID => normalised power levels content
+	agreedPowerLevels := make(map[string]string)
+	expectedRedactions := c.sm.GetExpectedRedactions()
+	// event ID => whether it is redacted, for events which may or may not be redacted
+	agreedRedactions := make(map[string]bool)
+	sentMessages := c.sm.GetSentMessages()
+	// room ID => state event => event ID, as seen by the first master to get that far
+	var firstFullState map[string]map[StateKeyTuple]string
+	var fullStateMaster CSAPIConvergence
+	// room ID => events in chronological order, as seen by the first master to get that far
+	var firstTimelines map[string][]Event
+	var timelineMaster CSAPIConvergence
+	errs := make([]error, len(c.masters))
+	for i, master := range c.masters {
+		errs[i] = func() error {
+			gotMemberships, err := c.assertMemberships(master, roomStates, displayNames)
 			if err != nil {
 				return err
 			}
-		case ConvergenceMechanismSync:
-			err := c.assertWithSync(master, roomStates)
-			if err != nil {
+			if err := checkAgreement(master, roomStates, displayNames, gotMemberships, agreedMemberships); err != nil {
 				return err
 			}
-		default:
-			return fmt.Errorf("unknown convergence mechanism: %v", c.convMechanism)
+			if c.derivedViews {
+				if err := c.assertDerivedViews(master, roomStates, gotMemberships); err != nil {
+					return err
+				}
+			}
+			if err := c.assertRoomState(master, expectedRoomState, agreedRoomState); err != nil {
+				return err
+			}
+			if err := c.assertPowerLevels(master, expectedPowerLevels, agreedPowerLevels); err != nil {
+				return err
+			}
+			if err := c.assertRoomUpgrades(master, upgrades); err != nil {
+				return err
+			}
+			if err := c.assertRedactions(master, expectedRedactions, agreedRedactions); err != nil {
+				return err
+			}
+			if err := c.assertMessageDelivery(master, sentMessages); err != nil {
+				return err
+			}
+			if c.fullState {
+				fullState, err := c.fetchFullState(master)
+				if err != nil {
+					return err
+				}
+				if firstFullState == nil {
+					firstFullState, fullStateMaster = fullState, master
+				} else if err := compareFullState(fullStateMaster, master, firstFullState, fullState); err != nil {
+					return err
+				}
+			}
+			if c.timeline {
+				timelines, err := c.fetchTimelines(master)
+				if err != nil {
+					return err
+				}
+				if firstTimelines == nil {
+					firstTimelines, timelineMaster = timelines, master
+				} else if err := compareTimelines(timelineMaster, master, firstTimelines, timelines); err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+	}
+	return errs
+}
+
+// fetchTimelines back-paginates every room on this server, returning the events in each room in chronological
+// order. Also checks that nobody sent an event before they first joined the room.
+func (c *Convergence) fetchTimelines(master CSAPIConvergence) (map[string][]Event, error) {
+	result := make(map[string][]Event)
+	var errs []string
+	for _, roomID := range c.allRoomIDs() {
+		events, err := paginateTimeline(master, roomID)
+		if err != nil {
+			return nil, err
+		}
+		result[roomID] = events
+		// A user's join is an ancestor of everything they send, so must come first. Later memberships are not
+		// checked, as e.g a kick which is concurrent with a message may be ordered before it.
+		joined := make(map[string]bool)
+		for _, ev := range events {
+			if ev.Type == "m.room.member" && ev.StateKey != nil && *ev.StateKey == ev.Sender && ev.Content["membership"] == string(MembershipJoin) {
+				joined[ev.Sender] = true
+				continue
+			}
+			if ev.Type == "m.room.create" || (ev.Type == "m.room.member" && ev.StateKey != nil && *ev.StateKey == ev.Sender) {
+				// e.g knocking and leaving, which don't need the sender to be joined
+				continue
+			}
+			if !joined[ev.Sender] {
+				errs = append(errs, fmt.Sprintf("room %s: %s (%s) sent by %s before they joined", roomID, ev.ID, ev.Type, ev.Sender))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s has causal order violations: %s", master.GetUserID(), strings.Join(errs, "\n"))
+	}
+	return result, nil
+}
+
+// paginateTimeline returns every event in the room in chronological order.
+func paginateTimeline(master CSAPIConvergence, roomID string) ([]Event, error) {
+	var events []Event
+	from := ""
+	for {
+		res, err := master.Messages(roomID, from, 100)
+		if err != nil {
+			return nil, fmt.Errorf("/messages for %s failed: %s", roomID, err)
+		}
+		events = append(events, res.Chunk...)
+		if res.End == "" || len(res.Chunk) == 0 {
+			break
+		}
+		from = res.End
+	}
+	slices.Reverse(events)
+	return events, nil
+}
+
+// compareTimelines checks that both servers have the same events in every room, and that the events sent by each
+// user are in the same order on both servers. A user's events are all sent via their own server, so each one
+// is causally after the last.
+func compareTimelines(masterA, masterB CSAPIConvergence, timelinesA, timelinesB map[string][]Event) error {
+	var errs []string
+	for roomID, eventsA := range timelinesA {
+		eventsB := timelinesB[roomID]
+		has := func(events []Event) map[string]bool {
+			result := make(map[string]bool, len(events))
+			for _, ev := range events {
+				result[ev.ID] = true
+			}
+			return result
+		}
+		hasA, hasB := has(eventsA), has(eventsB)
+		for _, ev := range eventsA {
+			if !hasB[ev.ID] {
+				errs = append(errs, fmt.Sprintf("room %s: %s (%s from %s) is on %s but not %s", roomID, ev.ID, ev.Type, ev.Sender, masterA.GetUserID(), masterB.GetUserID()))
+			}
+		}
+		for _, ev := range eventsB {
+			if !hasA[ev.ID] {
+				errs = append(errs, fmt.Sprintf("room %s: %s (%s from %s) is on %s but not %s", roomID, ev.ID, ev.Type, ev.Sender, masterB.GetUserID(), masterA.GetUserID()))
+			}
+		}
+		// sender => event IDs in order, for events on both servers
+		bySender := func(events []Event, other map[string]bool) map[string][]string {
+			result := make(map[string][]string)
+			for _, ev := range events {
+				if other[ev.ID] {
+					result[ev.Sender] = append(result[ev.Sender], ev.ID)
+				}
+			}
+			return result
+		}
+		orderB := bySender(eventsB, hasA)
+		for sender, orderA := range bySender(eventsA, hasB) {
+			if !slices.Equal(orderA, orderB[sender]) {
+				errs = append(errs, fmt.Sprintf(
+					"room %s: events from %s are in a different order. %s has %v but %s has %v",
+					roomID, sender, masterA.GetUserID(), orderA, masterB.GetUserID(), orderB[sender],
+				))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	slices.Sort(errs)
+	return fmt.Errorf("timeline mismatch: %s", strings.Join(errs, "\n"))
+}
+
+// assertMessageDelivery checks that this server has every message which was sent. Masters are always joined to
+// every room, so every server was in the room when the message was sent.
+func (c *Convergence) assertMessageDelivery(master CSAPIConvergence, messages []SentMessage) error {
+	var errs []string
+	for _, msg := range messages {
+		if _, err := master.Event(msg.RoomID, msg.EventID); err != nil {
+			errs = append(errs, fmt.Sprintf("tick %d: %s sent by %s in %s is missing: %s", msg.Tick, msg.EventID, msg.SenderID, msg.RoomID, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s is missing %d/%d messages: %s", master.GetUserID(), len(errs), len(messages), strings.Join(errs, "\n"))
+}
+
+// fetchFullState returns the event ID of every current state event in every room on this server.
+func (c *Convergence) fetchFullState(master CSAPIConvergence) (map[string]map[StateKeyTuple]string, error) {
+	result := make(map[string]map[StateKeyTuple]string)
+	for _, roomID := range c.allRoomIDs() {
+		stateEvents, err := master.State(roomID)
+		if err != nil {
+			return nil, fmt.Errorf("/state for %s failed: %s", roomID, err)
+		}
+		result[roomID] = make(map[StateKeyTuple]string)
+		for _, ev := range stateEvents {
+			if ev.StateKey == nil {
+				continue
+			}
+			result[roomID][StateKeyTuple{Type: ev.Type, StateKey: *ev.StateKey}] = ev.ID
+		}
+	}
+	return result, nil
+}
+
+// compareFullState checks that both servers have the same current state events in every room, reporting every
+// state event which differs.
+func compareFullState(masterA, masterB CSAPIConvergence, fullStateA, fullStateB map[string]map[StateKeyTuple]string) error {
+	var errs []string
+	for roomID, stateA := range fullStateA {
+		stateB := fullStateB[roomID]
+		var tuples []StateKeyTuple
+		for tuple := range stateA {
+			tuples = append(tuples, tuple)
+		}
+		for tuple := range stateB {
+			if _, ok := stateA[tuple]; !ok {
+				tuples = append(tuples, tuple)
+			}
+		}
+		slices.SortFunc(tuples, func(a, b StateKeyTuple) int {
+			if a.Type != b.Type {
+				return strings.Compare(a.Type, b.Type)
+			}
+			return strings.Compare(a.StateKey, b.StateKey)
+		})
+		for _, tuple := range tuples {
+			eventA, eventB := stateA[tuple], stateB[tuple]
+			if eventA == eventB {
+				continue
+			}
+			if eventA == "" {
+				eventA = "missing"
+			}
+			if eventB == "" {
+				eventB = "missing"
+			}
+			errs = append(errs, fmt.Sprintf(
+				"room %s state event (%s, '%s') is %s on %s but %s on %s",
+				roomID, tuple.Type, tuple.StateKey, eventA, masterA.GetUserID(), eventB, masterB.GetUserID(),
+			))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	slices.Sort(errs)
+	return fmt.Errorf("full state mismatch: %s", strings.Join(errs, "\n"))
+}
+
+// assertRedactions checks that events which were redacted by the state machine are returned in their redacted
+// form by this server, and that all servers agree on whether events which may or may not be redacted are redacted.
+func (c *Convergence) assertRedactions(master CSAPIConvergence, expected map[string]map[string]bool, agreed map[string]bool) error {
+	for roomID, events := range expected {
+		var errs []string
+		for eventID, definite := range events {
+			ev, err := master.Event(roomID, eventID)
+			if err != nil {
+				return fmt.Errorf("/event for %s in %s failed: %s", eventID, roomID, err)
+			}
+			redacted := ev.Unsigned["redacted_because"] != nil
+			if redacted && len(ev.Content) > 0 {
+				// none of the events we redact keep any of their content
+				errs = append(errs, fmt.Sprintf("event %s is redacted but has content %s", eventID, normaliseContent(ev.Content)))
+				continue
+			}
+			if definite {
+				if !redacted {
+					errs = append(errs, fmt.Sprintf("event %s is not redacted", eventID))
+				}
+				continue
+			}
+			if agreedRedacted, ok := agreed[eventID]; !ok {
+				agreed[eventID] = redacted
+			} else if agreedRedacted != redacted {
+				errs = append(errs, fmt.Sprintf("event %s redacted=%v but other servers think redacted=%v", eventID, redacted, agreedRedacted))
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("room %s from %s perspective redaction mismatch: %s", roomID, master.GetUserID(), strings.Join(errs, "\n"))
 		}
 	}
 	return nil
 }
 
-func (c *Convergence) assertWithMembers(master CSAPIConvergence, roomStates map[string]map[string]State) error {
+// assertRoomUpgrades checks that every upgraded room has a tombstone pointing to its replacement room on this
+// server, and that the replacement room points back to the upgraded room.
+func (c *Convergence) assertRoomUpgrades(master CSAPIConvergence, upgrades map[string]string) error {
+	for roomID, replacementRoomID := range upgrades {
+		var errs []string
+		stateEvents, err := master.State(roomID)
+		if err != nil {
+			return fmt.Errorf("/state for %s failed: %s", roomID, err)
+		}
+		var tombstone map[string]any
+		for _, ev := range stateEvents {
+			if ev.Type == "m.room.tombstone" && ev.StateKey != nil && *ev.StateKey == "" {
+				tombstone = ev.Content
+			}
+		}
+		if got := tombstone["replacement_room"]; got != replacementRoomID {
+			errs = append(errs, fmt.Sprintf("tombstone replacement_room is %v. Want %s", got, replacementRoomID))
+		}
+		stateEvents, err = master.State(replacementRoomID)
+		if err != nil {
+			return fmt.Errorf("/state for %s failed: %s", replacementRoomID, err)
+		}
+		var predecessor map[string]any
+		for _, ev := range stateEvents {
+			if ev.Type == "m.room.create" && ev.StateKey != nil && *ev.StateKey == "" {
+				predecessor, _ = ev.Content["predecessor"].(map[string]any)
+			}
+		}
+		if got := predecessor["room_id"]; got != roomID {
+			errs = append(errs, fmt.Sprintf("replacement room %s has predecessor %v. Want %s", replacementRoomID, got, roomID))
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("room %s from %s perspective upgrade mismatch: %s", roomID, master.GetUserID(), strings.Join(errs, "\n"))
+		}
+	}
+	return nil
+}
+
+// assertPowerLevels checks that users whose power level was changed by the state machine have the expected power
+// level on this server, and that all servers agree on the entire power levels event in those rooms.
+func (c *Convergence) assertPowerLevels(master CSAPIConvergence, expected map[string]map[string][]int, agreed map[string]string) error {
+	for roomID, wantLevels := range expected {
+		stateEvents, err := master.State(roomID)
+		if err != nil {
+			return fmt.Errorf("/state for %s failed: %s", roomID, err)
+		}
+		var content map[string]any
+		for _, ev := range stateEvents {
+			if ev.Type == "m.room.power_levels" && ev.StateKey != nil && *ev.StateKey == "" {
+				content = ev.Content
+			}
+		}
+		users, _ := content["users"].(map[string]any)
+		var errs []string
+		for userID, want := range wantLevels {
+			got := 0 // the users_default, as we never change it
+			if level, ok := users[userID].(float64); ok {
+				got = int(level)
+			}
+			if !slices.Contains(want, got) {
+				errs = append(errs, fmt.Sprintf("user %s has power level %d. Want one of %v", userID, got, want))
+			}
+		}
+		// other users may have used their power based on these power levels, so they must agree everywhere
+		got := normaliseContent(content)
+		if agreedContent, ok := agreed[roomID]; !ok {
+			agreed[roomID] = got
+		} else if agreedContent != got {
+			errs = append(errs, fmt.Sprintf("power levels are %s but other servers think they are %s", got, agreedContent))
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("room %s from %s perspective power levels mismatch: %s", roomID, master.GetUserID(), strings.Join(errs, "\n"))
+		}
+	}
+	return nil
+}
+
+// assertRoomState checks that the state events sent by the state machine have the expected content on this server,
+// and that all servers agree on the content of state events which could have more than one content.
+func (c *Convergence) assertRoomState(master CSAPIConvergence, expected map[string]map[StateKeyTuple][]map[string]any, agreed map[string]map[StateKeyTuple]string) error {
+	for roomID, wantEvents := range expected {
+		stateEvents, err := master.State(roomID)
+		if err != nil {
+			return fmt.Errorf("/state for %s failed: %s", roomID, err)
+		}
+		gotContents := make(map[StateKeyTuple]string)
+		for _, ev := range stateEvents {
+			if ev.StateKey == nil {
+				continue
+			}
+			gotContents[StateKeyTuple{Type: ev.Type, StateKey: *ev.StateKey}] = normaliseContent(ev.Content)
+		}
+		var errs []string
+		for tuple, wantContents := range wantEvents {
+			got, ok := gotContents[tuple]
+			if !ok {
+				got = normaliseContent(nil)
+			}
+			var want []string
+			for _, content := range wantContents {
+				want = append(want, normaliseContent(content))
+			}
+			if !slices.Contains(want, got) {
+				errs = append(errs, fmt.Sprintf("state event (%s, '%s') is %s. Want one of %v", tuple.Type, tuple.StateKey, got, want))
+				continue
+			}
+			if len(want) < 2 {
+				continue
+			}
+			if agreed[roomID] == nil {
+				agreed[roomID] = make(map[StateKeyTuple]string)
+			}
+			if agreedContent, ok := agreed[roomID][tuple]; !ok {
+				agreed[roomID][tuple] = got
+			} else if agreedContent != got {
+				errs = append(errs, fmt.Sprintf("state event (%s, '%s') is %s but other servers think it is %s", tuple.Type, tuple.StateKey, got, agreedContent))
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("room %s from %s perspective state mismatch: %s", roomID, master.GetUserID(), strings.Join(errs, "\n"))
+		}
+	}
+	return nil
+}
+
+// checkAgreement ensures that all servers agree on the membership of users who could be in more than one state,
+// and on the display name of joined users who could have more than one display name.
+func checkAgreement(
+	master CSAPIConvergence, roomStates map[string]map[string][]State, displayNames map[string][]string,
+	gotMemberships, agreedMemberships map[string]map[string]memberState,
+) error {
+	var errs []string
+	for roomID, wantRoomState := range roomStates {
+		for userID, wantStates := range wantRoomState {
+			if len(wantStates) < 2 && len(displayNames[userID]) < 2 {
+				continue
+			}
+			got := gotMemberships[roomID][userID]
+			if agreedMemberships[roomID] == nil {
+				agreedMemberships[roomID] = make(map[string]memberState)
+			}
+			agreed, ok := agreedMemberships[roomID][userID]
+			if !ok {
+				agreedMemberships[roomID][userID] = got
+				continue
+			}
+			if agreed.Membership != got.Membership {
+				errs = append(errs, fmt.Sprintf("user %s is '%s' but other servers think they are '%s'", userID, got.Membership, agreed.Membership))
+			} else if got.Membership == MembershipJoin && agreed.DisplayName != got.DisplayName {
+				errs = append(errs, fmt.Sprintf("user %s has display name '%s' but other servers think it is '%s'", userID, got.DisplayName, agreed.DisplayName))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s disagrees with other servers: %s", master.GetUserID(), strings.Join(errs, "\n"))
+}
+
+// assertMemberships checks the memberships and display names in roomStates using the configured mechanism.
+func (c *Convergence) assertMemberships(master CSAPIConvergence, roomStates map[string]map[string][]State, displayNames map[string][]string) (map[string]map[string]memberState, error) {
+	knownMembers := c.knownMembers()
+	switch c.convMechanism {
+	case ConvergenceMechanismMembers:
+		return c.assertWithMembers(master, roomStates, displayNames, knownMembers)
+	case ConvergenceMechanismSync:
+		return c.assertWithSync(master, roomStates, displayNames, knownMembers)
+	default:
+		return nil, fmt.Errorf("unknown convergence mechanism: %v", c.convMechanism)
+	}
+}
+
+func (c *Convergence) assertWithMembers(master CSAPIConvergence, roomStates map[string]map[string][]State, displayNames map[string][]string, knownMembers map[string]bool) (map[string]map[string]memberState, error) {
+	result := make(map[string]map[string]memberState)
 	for roomID, wantRoomState := range roomStates {
 		stateEvents, err := master.Members(roomID)
 		if err != nil {
-			return fmt.Errorf("/members for %s failed: %s", roomID, err)
+			return nil, fmt.Errorf("/members for %s failed: %s", roomID, err)
 		}
-		if err := c.checkRoomState(stateEvents, nil, wantRoomState); err != nil {
-			return fmt.Errorf("room %s from %s perspective mismatch: %s", roomID, master.GetUserID(), err)
+		gotMemberships, err := c.checkRoomState(master, roomID, stateEvents, nil, wantRoomState, displayNames, knownMembers)
+		if err != nil {
+			return nil, fmt.Errorf("room %s from %s perspective mismatch: %w", roomID, master.GetUserID(), err)
 		}
+		result[roomID] = gotMemberships
 	}
-	return nil
+	return result, nil
 }
 
-func (c *Convergence) assertWithSync(master CSAPIConvergence, roomStates map[string]map[string]State) error {
+func (c *Convergence) assertWithSync(master CSAPIConvergence, roomStates map[string]map[string][]State, displayNames map[string][]string, knownMembers map[string]bool) (map[string]map[string]memberState, error) {
 	sr, err := master.Sync(SyncReq{
 		FullState: true,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to /sync on %s : %s", master.GetUserID(), err)
+		return nil, fmt.Errorf("failed to /sync on %s : %s", master.GetUserID(), err)
 	}
+	result := make(map[string]map[string]memberState)
 	for roomID, roomState := range roomStates {
 		room, ok := sr.Rooms.Join[roomID]
 		if !ok {
-			return fmt.Errorf("rooms.join.%s does not exist", roomID)
+			return nil, fmt.Errorf("rooms.join.%s does not exist", roomID)
 		}
-		if err := c.checkRoomState(room.State.Events, room.Timeline.Events, roomState); err != nil {
-			return fmt.Errorf("room %s from %s perspective mismatch: %s", roomID, master.GetUserID(), err)
+		gotMemberships, err := c.checkRoomState(master, roomID, room.State.Events, room.Timeline.Events, roomState, displayNames, knownMembers)
+		if err != nil {
+			return nil, fmt.Errorf("room %s from %s perspective mismatch: %w", roomID, master.GetUserID(), err)
 		}
+		result[roomID] = gotMemberships
 	}
-	return nil
+	return result, nil
 }
 
 // To ensure we have synchronised rooms after a netsplit, each master sends a synchronise message and we wait
@@ -162,9 +862,22 @@ func (c *Convergence) ensureSynchronised(ctx context.Context) error {
 	// small buffer to ensure we actually are no longer netsplit
 	time.Sleep(time.Second)
 
-	// each master sends a synchronise in each room. Remember the event ID of each.
+	roomIDs := c.allRoomIDs()
+	// get a since token for each master before anyone sends a synchronise, so incremental syncs include all of them
+	sinces := make([]string, len(c.masters))
+	for i, master := range c.masters {
+		res, err := master.Sync(SyncReq{
+			Filter:        c.synchroniseFilter(roomIDs, 1),
+			TimeoutMillis: "0",
+		})
+		if err != nil {
+			return fmt.Errorf("master %s failed to /sync : %s", master.GetUserID(), err)
+		}
+		sinces[i] = res.NextBatch
+	}
+	// each master sends a synchronise in each room, including replacement rooms. Remember the event ID of each.
 	for _, master := range c.masters {
-		for _, roomID := range c.roomIDs {
+		for _, roomID := range roomIDs {
 			eventID, err := master.SendMessageWithText(roomID, "SYNCHRONISE")
 			if err != nil {
 				return fmt.Errorf("master %s failed to send event in room %s : %s", master.GetUserID(), roomID, err)
@@ -173,10 +886,13 @@ func (c *Convergence) ensureSynchronised(ctx context.Context) error {
 		}
 	}
 	// sync on all masters until we see all events
+	filter := c.synchroniseFilter(roomIDs, synchroniseTimelineLimit)
 	errCh := make(chan error, len(c.masters))
+	var lastErrsMu sync.Mutex
+	lastErrs := make(map[string]error) // master user ID => the last transient error, if any
 	var wg sync.WaitGroup
 	wg.Add(len(c.masters))
-	for _, master := range c.masters {
+	for i, master := range c.masters {
 		// clone the messages so each goroutine can check them off, and use a set not a slice
 		// for ergonomics
 		syncMessagesCopy := make(map[string]map[string]bool)
@@ -186,56 +902,21 @@ func (c *Convergence) ensureSynchronised(ctx context.Context) error {
 				syncMessagesCopy[roomID][eventID] = true
 			}
 		}
-		go func(m CSAPIConvergence, workingCopy map[string]map[string]bool) {
+		go func(m CSAPIConvergence, since string, workingCopy map[string]map[string]bool) {
 			defer wg.Done()
-
-			for len(workingCopy) > 0 {
-				for roomID, eventIDs := range workingCopy {
-					for eventID := range eventIDs {
-						time.Sleep(10 * time.Millisecond) // avoid hammering
-						ev, _ := m.Event(roomID, eventID)
-						if ev == nil {
-							continue // not found yet
-						}
-						// log.Printf("%s found event %v\n", m.UserID, eventID)
-						delete(workingCopy[roomID], eventID)
-						if len(workingCopy[roomID]) == 0 {
-							delete(workingCopy, roomID)
-						}
-					}
+			err := waitForEvents(ctx, m, filter, since, workingCopy, func(err error) {
+				lastErrsMu.Lock()
+				defer lastErrsMu.Unlock()
+				lastErrs[m.GetUserID()] = err
+			})
+			if err != nil {
+				if ctx.Err() == nil {
+					errCh <- err
 				}
+				return
 			}
-
-			/* unreliable when run for a few minutes :/ never returns the events.
-			since := ""
-			for len(workingCopy) > 0 {
-				log.Printf("%s working copy = %+v\n", m.UserID, workingCopy)
-				res, err := m.Sync(SyncReq{
-					Since:         since,
-					TimeoutMillis: "1000",
-					Filter:        `{"room":{"timeline":{"limit":512}}}`,
-				})
-				if err != nil {
-					errCh <- fmt.Errorf("/sync on %s failed, terminating: %s", m.UserID, err)
-					return
-				}
-				for roomID, room := range res.Rooms.Join {
-					if len(workingCopy[roomID]) == 0 {
-						delete(workingCopy, roomID)
-						continue // base case
-					}
-					for _, ev := range room.Timeline.Events {
-						delete(workingCopy[roomID], ev.ID)
-					}
-					if len(workingCopy[roomID]) == 0 {
-						delete(workingCopy, roomID)
-					}
-				}
-				since = res.NextBatch
-				time.Sleep(1000 * time.Millisecond) // ensure we never hammer the HS
-			} */
 			log.Printf("  %s has synchronised", m.GetUserID())
-		}(master, syncMessagesCopy)
+		}(master, sinces[i], syncMessagesCopy)
 	}
 	done := make(chan bool)
 	go func() {
@@ -247,14 +928,113 @@ func (c *Convergence) ensureSynchronised(ctx context.Context) error {
 		return err
 	case <-ctx.Done():
 		log.Printf("Failed to see all event IDs from all servers:\n %+v", syncMessages)
+		lastErrsMu.Lock()
+		defer lastErrsMu.Unlock()
+		if len(lastErrs) > 0 {
+			return fmt.Errorf("context cancelled: %s, last errors: %v", ctx.Err(), lastErrs)
+		}
 		return fmt.Errorf("context cancelled: %s", ctx.Err())
 	case <-done:
 	}
 	return nil
 }
 
-func (c *Convergence) checkRoomState(stateEvents, timelineEvents []Event, want map[string]State) error {
-	gotMemberships := make(map[string]Membership)
+// synchroniseTimelineLimit is the most synchronise messages /sync returns per room in one response. If more arrive
+// between syncs, the timeline is limited and the missing ones are fetched with /event.
+const synchroniseTimelineLimit = 100
+
+// maxSyncBackoff is the longest to wait before retrying /sync after a transient error.
+const maxSyncBackoff = 5 * time.Second
+
+// synchroniseFilter returns a /sync filter which only includes messages sent by the masters in the given rooms, so
+// that other traffic doesn't push synchronise messages out of the timeline.
+func (c *Convergence) synchroniseFilter(roomIDs []string, timelineLimit int) string {
+	var masterIDs []string
+	for _, master := range c.masters {
+		masterIDs = append(masterIDs, master.GetUserID())
+	}
+	none := map[string]any{"types": []string{}}
+	b, _ := json.Marshal(map[string]any{
+		"account_data": none,
+		"presence":     none,
+		"room": map[string]any{
+			"rooms":        roomIDs,
+			"account_data": none,
+			"ephemeral":    none,
+			"state":        none,
+			"timeline": map[string]any{
+				"limit":   timelineLimit,
+				"types":   []string{"m.room.message"},
+				"senders": masterIDs,
+			},
+		},
+	})
+	return string(b)
+}
+
+// waitForEvents streams incremental /syncs from since until the master has seen every pending event, removing
+// them from pending as they arrive. Events which may be in a gap in the timeline are looked up with /event.
+// Transient errors, e.g whilst the server restarts or rate limits us, are passed to onTransientErr and retried with
+// backoff, but the server rejecting /sync is returned as there is no point retrying.
+func waitForEvents(
+	ctx context.Context, master CSAPIConvergence, filter, since string, pending map[string]map[string]bool,
+	onTransientErr func(err error),
+) error {
+	backoff := 100 * time.Millisecond
+	for len(pending) > 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		res, err := master.Sync(SyncReq{
+			Since:         since,
+			Filter:        filter,
+			TimeoutMillis: "1000",
+		})
+		if err != nil {
+			var httpErr *HTTPError
+			if errors.As(err, &httpErr) && httpErr.StatusCode != http.StatusTooManyRequests && ClassifyError(err) == ErrorClass4xx {
+				return fmt.Errorf("/sync on %s failed, terminating: %s", master.GetUserID(), err)
+			}
+			onTransientErr(err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxSyncBackoff)
+			continue
+		}
+		backoff = 100 * time.Millisecond
+		for roomID, room := range res.Rooms.Join {
+			if pending[roomID] == nil {
+				continue
+			}
+			for _, ev := range room.Timeline.Events {
+				delete(pending[roomID], ev.ID)
+			}
+			if room.Timeline.Limited {
+				// some of the events may have arrived in the gap before this timeline
+				for eventID := range pending[roomID] {
+					if ev, _ := master.Event(roomID, eventID); ev != nil {
+						delete(pending[roomID], eventID)
+					}
+				}
+			}
+			if len(pending[roomID]) == 0 {
+				delete(pending, roomID)
+			}
+		}
+		since = res.NextBatch
+	}
+	return nil
+}
+
+// checkRoomState checks that the memberships in the provided events match one of the wanted states for each user,
+// and that joined users have one of the wanted display names, if any. If knownMembers is set, nobody else may be
+// joined. Returns the memberships of all users in the room, and a *MismatchError describing every user who doesn't
+// match.
+func (c *Convergence) checkRoomState(master CSAPIConvergence, roomID string, stateEvents, timelineEvents []Event, want map[string][]State, wantDisplayNames map[string][]string, knownMembers map[string]bool) (map[string]memberState, error) {
+	gotMemberships := make(map[string]memberState)
+	memberEvents := make(map[string]Event) // user ID => the member event which gave them their membership
 	processEvent := func(ev Event) {
 		if ev.Type != "m.room.member" {
 			return
@@ -262,23 +1042,12 @@ func (c *Convergence) checkRoomState(stateEvents, timelineEvents []Event, want m
 		if ev.StateKey == nil {
 			return
 		}
-		gotMemberships[*ev.StateKey] = Membership(ev.Content["membership"].(string))
-	}
-	membershipToState := func(m Membership) State {
-		switch m {
-		case MembershipBan: // TODO
-			fallthrough
-		case MembershipInvite: // TODO
-			fallthrough
-		case MembershipKnock: // TODO
-			fallthrough
-		case MembershipLeave:
-			return StateLeft
-		case MembershipJoin:
-			return StateJoined
-		default:
-			panic("unknown membership: " + m)
+		displayName, _ := ev.Content["displayname"].(string)
+		gotMemberships[*ev.StateKey] = memberState{
+			Membership:  Membership(ev.Content["membership"].(string)),
+			DisplayName: displayName,
 		}
+		memberEvents[*ev.StateKey] = ev
 	}
 	for _, ev := range stateEvents {
 		processEvent(ev)
@@ -286,20 +1055,66 @@ func (c *Convergence) checkRoomState(stateEvents, timelineEvents []Event, want m
 	for _, ev := range timelineEvents {
 		processEvent(ev)
 	}
-	errs := []string{}
-	for wantUserID, wantState := range want {
-		if gotMemberships[wantUserID] == "" {
-			gotMemberships[wantUserID] = MembershipLeave
+	mismatchErr := &MismatchError{}
+	for wantUserID, wantStates := range want {
+		got := gotMemberships[wantUserID]
+		if got.Membership == "" {
+			got.Membership = MembershipLeave
+			gotMemberships[wantUserID] = got
 		}
-		if membershipToState(gotMemberships[wantUserID]) != wantState {
-			errs = append(errs, fmt.Sprintf("user %s is '%s'. Want '%s'", wantUserID, gotMemberships[wantUserID], wantState))
+		// only join events are guaranteed to have the display name
+		wantDisplayNames := wantDisplayNames[wantUserID]
+		var errStr string
+		if !slices.Contains(wantStates, membershipToState(got.Membership)) {
+			if len(wantStates) == 1 {
+				errStr = fmt.Sprintf("user %s is '%s'. Want '%s'", wantUserID, got.Membership, wantStates[0])
+			} else {
+				errStr = fmt.Sprintf("user %s is '%s'. Want one of %v", wantUserID, got.Membership, wantStates)
+			}
+		} else if got.Membership == MembershipJoin && len(wantDisplayNames) > 0 && !slices.Contains(wantDisplayNames, got.DisplayName) {
+			errStr = fmt.Sprintf("user %s has display name '%s'. Want one of %v", wantUserID, got.DisplayName, wantDisplayNames)
+		} else {
+			continue
 		}
+		mismatchErr.add(errStr, newMembershipMismatch(master, roomID, wantUserID, wantStates, got, wantDisplayNames, memberEvents))
 	}
 	// we don't explicitly check if the server sends back MORE members than expected, as we do expect this due to
 	// master users sitting in each room. We aren't really interested in that though, hence we never do
-	// assert(len(got) == len(want))
-	if len(errs) == 0 {
-		return nil
+	// assert(len(got) == len(want)). In strict mode we know who those users are, so anyone else is a phantom.
+	if knownMembers != nil {
+		var phantomIDs []string
+		for userID, got := range gotMemberships {
+			if got.Membership == MembershipJoin && !knownMembers[userID] {
+				phantomIDs = append(phantomIDs, userID)
+			}
+		}
+		slices.Sort(phantomIDs)
+		for _, userID := range phantomIDs {
+			mismatchErr.add(
+				fmt.Sprintf("user %s is 'join' but is not a test user, master or moderator", userID),
+				newMembershipMismatch(master, roomID, userID, []State{StateLeft}, gotMemberships[userID], nil, memberEvents),
+			)
+		}
+	}
+	if len(mismatchErr.Mismatches) == 0 {
+		return gotMemberships, nil
+	}
+	return gotMemberships, mismatchErr
+}
+
+func membershipToState(m Membership) State {
+	switch m {
+	case MembershipBan:
+		return StateBanned
+	case MembershipInvite:
+		return StateInvited
+	case MembershipKnock:
+		return StateKnocking
+	case MembershipLeave:
+		return StateLeft
+	case MembershipJoin:
+		return StateJoined
+	default:
+		panic("unknown membership: " + m)
 	}
-	return fmt.Errorf(strings.Join(errs, "\n"))
 }
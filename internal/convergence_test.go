@@ -2,7 +2,12 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -25,20 +30,59 @@ type mockCSAPI struct {
 	sentCounter         int
 	onSync              func(syncReq SyncReq) (*SyncResponse, error)
 	onMembers           func(roomID string) ([]Event, error)
+	onState             func(roomID string) ([]Event, error)
+	onMessages          func(roomID, from string, limit int) (*MessagesResponse, error)
+	onJoinedMembers     func(roomID string) ([]string, error)
+	onJoinedRooms       func() ([]string, error)
 	dontAddEventsOnSend bool
+	timeline            []*Event // messages sent by this master in the order they were sent, for /sync
 }
 
 func (c *mockCSAPI) Members(roomID string) ([]Event, error) {
 	return c.onMembers(roomID)
 }
+func (c *mockCSAPI) State(roomID string) ([]Event, error) {
+	if c.onState == nil {
+		return nil, nil
+	}
+	return c.onState(roomID)
+}
 func (c *mockCSAPI) Sync(syncReq SyncReq) (*SyncResponse, error) {
-	return c.onSync(syncReq)
+	if c.onSync != nil {
+		return c.onSync(syncReq)
+	}
+	return c.syncTimeline(syncReq)
+}
+
+// syncTimeline returns the messages this master sent since the since token.
+func (c *mockCSAPI) syncTimeline(syncReq SyncReq) (*SyncResponse, error) {
+	// the since token is how many messages had been sent
+	from := 0
+	fmt.Sscanf(syncReq.Since, "%d", &from)
+	if from == len(c.timeline) {
+		time.Sleep(10 * time.Millisecond) // pretend to long-poll
+	}
+	join := make(map[string]any)
+	for _, ev := range c.timeline[from:] {
+		if join[ev.RoomID] == nil {
+			join[ev.RoomID] = map[string]any{"timeline": map[string]any{"events": []*Event{}}}
+		}
+		timeline := join[ev.RoomID].(map[string]any)["timeline"].(map[string]any)
+		timeline["events"] = append(timeline["events"].([]*Event), ev)
+	}
+	b, _ := json.Marshal(map[string]any{
+		"next_batch": fmt.Sprintf("%d", len(c.timeline)),
+		"rooms":      map[string]any{"join": join},
+	})
+	var res SyncResponse
+	err := json.Unmarshal(b, &res)
+	return &res, err
 }
 func (c *mockCSAPI) SendMessageWithText(roomID string, text string) (string, error) {
 	c.sentCounter++
 	eventID := fmt.Sprintf("$sent-%d", c.sentCounter)
 	if !c.dontAddEventsOnSend {
-		c.events[roomID+eventID] = &Event{
+		ev := &Event{
 			RoomID: roomID,
 			ID:     eventID,
 			Type:   "m.room.message",
@@ -48,6 +92,8 @@ func (c *mockCSAPI) SendMessageWithText(roomID string, text string) (string, err
 			Sender:    c.userID,
 			Timestamp: time.Now().UnixMilli(),
 		}
+		c.events[roomID+eventID] = ev
+		c.timeline = append(c.timeline, ev)
 	}
 	return eventID, nil
 }
@@ -59,6 +105,15 @@ func (c *mockCSAPI) Event(roomID, eventID string) (*Event, error) {
 	}
 	return ev, nil
 }
+func (c *mockCSAPI) Messages(roomID, from string, limit int) (*MessagesResponse, error) {
+	return c.onMessages(roomID, from, limit)
+}
+func (c *mockCSAPI) JoinedMembers(roomID string) ([]string, error) {
+	return c.onJoinedMembers(roomID)
+}
+func (c *mockCSAPI) JoinedRooms() ([]string, error) {
+	return c.onJoinedRooms()
+}
 func (c *mockCSAPI) GetUserID() string {
 	return c.userID
 }
@@ -74,6 +129,125 @@ type mockStateMachine map[string]map[string]State
 func (sm mockStateMachine) GetInternalState() map[string]map[string]State {
 	return sm
 }
+func (sm mockStateMachine) GetIndeterminateStates() map[string]map[string][]State {
+	return nil
+}
+func (sm mockStateMachine) GetExpectedRoomState() map[string]map[StateKeyTuple][]map[string]any {
+	return nil
+}
+func (sm mockStateMachine) GetExpectedPowerLevels() map[string]map[string][]int {
+	return nil
+}
+func (sm mockStateMachine) GetRoomUpgrades() map[string]string {
+	return nil
+}
+func (sm mockStateMachine) GetExpectedDisplayNames() map[string][]string {
+	return nil
+}
+func (sm mockStateMachine) GetExpectedRedactions() map[string]map[string]bool {
+	return nil
+}
+func (sm mockStateMachine) GetSentMessages() []SentMessage {
+	return nil
+}
+func (sm mockStateMachine) GetMembershipActors() map[string]map[string]string {
+	return nil
+}
+func (sm mockStateMachine) GetStateSenders() map[string]map[StateKeyTuple]string {
+	return nil
+}
+
+// mockIndeterminateStateMachine is a mockStateMachine with some indeterminate states
+type mockIndeterminateStateMachine struct {
+	mockStateMachine
+	possible map[string]map[string][]State
+}
+
+func (sm mockIndeterminateStateMachine) GetIndeterminateStates() map[string]map[string][]State {
+	return sm.possible
+}
+
+// mockRoomStateMachine is a mockStateMachine which has sent some state events
+type mockRoomStateMachine struct {
+	mockStateMachine
+	expected map[string]map[StateKeyTuple][]map[string]any
+}
+
+func (sm mockRoomStateMachine) GetExpectedRoomState() map[string]map[StateKeyTuple][]map[string]any {
+	return sm.expected
+}
+
+// mockPowerLevelStateMachine is a mockStateMachine which has changed some power levels
+type mockPowerLevelStateMachine struct {
+	mockStateMachine
+	expected map[string]map[string][]int
+}
+
+func (sm mockPowerLevelStateMachine) GetExpectedPowerLevels() map[string]map[string][]int {
+	return sm.expected
+}
+
+// mockUpgradeStateMachine is a mockStateMachine which has upgraded some rooms
+type mockUpgradeStateMachine struct {
+	mockStateMachine
+	upgrades map[string]string
+}
+
+func (sm mockUpgradeStateMachine) GetRoomUpgrades() map[string]string {
+	return sm.upgrades
+}
+
+// mockDisplayNameStateMachine is a mockStateMachine which has set some display names
+type mockDisplayNameStateMachine struct {
+	mockStateMachine
+	displayNames map[string][]string
+}
+
+func (sm mockDisplayNameStateMachine) GetExpectedDisplayNames() map[string][]string {
+	return sm.displayNames
+}
+
+// mockRedactionStateMachine is a mockStateMachine which has redacted some events
+type mockRedactionStateMachine struct {
+	mockStateMachine
+	redactions map[string]map[string]bool
+}
+
+func (sm mockRedactionStateMachine) GetExpectedRedactions() map[string]map[string]bool {
+	return sm.redactions
+}
+
+// mockMessageStateMachine is a mockStateMachine which has sent some messages
+type mockMessageStateMachine struct {
+	mockStateMachine
+	messages []SentMessage
+}
+
+func (sm mockMessageStateMachine) GetSentMessages() []SentMessage {
+	return sm.messages
+}
+
+// mockPartitionStateMachine is a mockStateMachine which knows who last changed each membership and state event
+type mockPartitionStateMachine struct {
+	mockStateMachine
+	actors   map[string]map[string]string
+	expected map[string]map[StateKeyTuple][]map[string]any
+	senders  map[string]map[StateKeyTuple]string
+	messages []SentMessage
+}
+
+func (sm mockPartitionStateMachine) GetMembershipActors() map[string]map[string]string {
+	return sm.actors
+}
+func (sm mockPartitionStateMachine) GetExpectedRoomState() map[string]map[StateKeyTuple][]map[string]any {
+	return sm.expected
+}
+func (sm mockPartitionStateMachine) GetStateSenders() map[string]map[StateKeyTuple]string {
+	return sm.senders
+}
+func (sm mockPartitionStateMachine) GetSentMessages() []SentMessage {
+	return sm.messages
+}
 
 func createMemberEvent(roomID, sender, target string, membership Membership) Event {
 	nowMillis := time.Now().UnixMilli()
@@ -216,8 +390,10 @@ func TestConvergenceEventCtxTimeout(t *testing.T) {
 	}
 	master := newMockCSAPI("@master:localhost")
 	master.dontAddEventsOnSend = true
+	checked := false
 	master.onMembers = func(requestedRoomID string) ([]Event, error) {
 		assert.Equal(t, roomID, requestedRoomID)
+		checked = true
 		return []Event{
 			createMemberEvent(roomID, userA, userA, MembershipJoin),
 		}, nil
@@ -237,6 +413,1112 @@ func TestConvergenceEventCtxTimeout(t *testing.T) {
 	}()
 	err := conv.Assert(ctx, 0)
 	assertFinished.Store(true)
-	assert.NoError(t, err)
+	assert.True(t, checked)
+	// the server agrees, but we don't know if it has seen every command
+	assert.ErrorContains(t, err, "failed to synchronise")
 	wg.Wait()
 }
+
+// Test that indeterminate states accept any possible state, provided all servers agree.
+func TestConvergenceIndeterminate(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockIndeterminateStateMachine{
+		mockStateMachine: mockStateMachine{
+			userA: map[string]State{roomID: StateIndeterminate},
+			userB: map[string]State{roomID: StateJoined},
+		},
+		possible: map[string]map[string][]State{
+			userA: {roomID: {StateStart, StateJoined}},
+		},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	membersWithUserA := func(membership Membership) func(requestedRoomID string) ([]Event, error) {
+		return func(requestedRoomID string) ([]Event, error) {
+			return []Event{
+				createMemberEvent(roomID, userA, userA, membership),
+				createMemberEvent(roomID, userB, userB, MembershipJoin),
+			}, nil
+		}
+	}
+	testCases := []struct {
+		name              string
+		master1Membership Membership
+		master2Membership Membership
+		wantErr           bool
+	}{
+		{name: "both joined", master1Membership: MembershipJoin, master2Membership: MembershipJoin},
+		{name: "both left", master1Membership: MembershipLeave, master2Membership: MembershipLeave},
+		{name: "disagree", master1Membership: MembershipJoin, master2Membership: MembershipLeave, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			master1 := newMockCSAPI("@master:localhost1")
+			master1.onMembers = membersWithUserA(tc.master1Membership)
+			master2 := newMockCSAPI("@master:localhost2")
+			master2.onMembers = membersWithUserA(tc.master2Membership)
+			conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn)
+			err := conv.Assert(context.Background(), 0)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// Test that state events sent by the state machine are checked against /state on every server.
+func TestConvergenceRoomState(t *testing.T) {
+	roomID := "!room:id"
+	nameTuple := StateKeyTuple{Type: "m.room.name"}
+	customTuple := StateKeyTuple{Type: "org.example.custom", StateKey: "a"}
+	sm := mockRoomStateMachine{
+		mockStateMachine: mockStateMachine{
+			userA: map[string]State{roomID: StateJoined},
+		},
+		expected: map[string]map[StateKeyTuple][]map[string]any{
+			roomID: {
+				nameTuple: {{"name": "glum goose"}},
+				// the custom state event timed out, so it may or may not exist
+				customTuple: {nil, {"value": "lucky bus"}},
+			},
+		},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	members := func(requestedRoomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	stateWith := func(name string, custom map[string]any) func(requestedRoomID string) ([]Event, error) {
+		return func(requestedRoomID string) ([]Event, error) {
+			emptyStateKey := ""
+			events := []Event{
+				createMemberEvent(roomID, userA, userA, MembershipJoin),
+				{Type: "m.room.name", StateKey: &emptyStateKey, Content: map[string]any{"name": name}},
+			}
+			if custom != nil {
+				events = append(events, Event{Type: customTuple.Type, StateKey: &customTuple.StateKey, Content: custom})
+			}
+			return events, nil
+		}
+	}
+	testCases := []struct {
+		name    string
+		master1 func(requestedRoomID string) ([]Event, error)
+		master2 func(requestedRoomID string) ([]Event, error)
+		wantErr bool
+	}{
+		{
+			name:    "matches",
+			master1: stateWith("glum goose", map[string]any{"value": "lucky bus"}),
+			master2: stateWith("glum goose", map[string]any{"value": "lucky bus"}),
+		},
+		{
+			name:    "timed out state event does not exist",
+			master1: stateWith("glum goose", nil),
+			master2: stateWith("glum goose", nil),
+		},
+		{
+			name:    "wrong name",
+			master1: stateWith("glum goose", nil),
+			master2: stateWith("happy house", nil),
+			wantErr: true,
+		},
+		{
+			name:    "disagree on timed out state event",
+			master1: stateWith("glum goose", map[string]any{"value": "lucky bus"}),
+			master2: stateWith("glum goose", nil),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			master1 := newMockCSAPI("@master:localhost1")
+			master1.onMembers = members
+			master1.onState = tc.master1
+			master2 := newMockCSAPI("@master:localhost2")
+			master2.onMembers = members
+			master2.onState = tc.master2
+			conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn)
+			err := conv.Assert(context.Background(), 0)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// Test that banned, invited and knocking users are checked exactly, rather than being treated as having left.
+func TestConvergenceExactMemberships(t *testing.T) {
+	roomID := "!room:id"
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	for _, tc := range []struct {
+		state      State
+		membership Membership
+		wantErr    bool
+	}{
+		{state: StateBanned, membership: MembershipBan},
+		{state: StateBanned, membership: MembershipLeave, wantErr: true},
+		{state: StateInvited, membership: MembershipInvite},
+		{state: StateInvited, membership: MembershipLeave, wantErr: true},
+		{state: StateRejected, membership: MembershipLeave},
+		{state: StateRejected, membership: MembershipInvite, wantErr: true},
+		{state: StateKnocking, membership: MembershipKnock},
+		{state: StateKnocking, membership: MembershipLeave, wantErr: true},
+	} {
+		sm := mockStateMachine{
+			userA: map[string]State{roomID: tc.state},
+		}
+		master := newMockCSAPI("@master:localhost")
+		master.onMembers = func(requestedRoomID string) ([]Event, error) {
+			return []Event{createMemberEvent(roomID, "@mod:localhost", userA, tc.membership)}, nil
+		}
+		conv := NewConvergence([]CSAPIConvergence{master}, []string{roomID}, sm, updaterFn)
+		err := conv.Assert(context.Background(), 0)
+		if tc.wantErr {
+			assert.Error(t, err, "%s %s", tc.state, tc.membership)
+		} else {
+			assert.NoError(t, err, "%s %s", tc.state, tc.membership)
+		}
+	}
+}
+
+// Test that power levels are checked, and that servers must agree on the entire power levels event.
+func TestConvergencePowerLevels(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockPowerLevelStateMachine{
+		mockStateMachine: mockStateMachine{
+			userA: map[string]State{roomID: StateJoined},
+			userB: map[string]State{roomID: StateJoined},
+		},
+		expected: map[string]map[string][]int{
+			roomID: {
+				userA: {50},
+				// demoting bob timed out
+				userB: {50, 0},
+			},
+		},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	members := func(requestedRoomID string) ([]Event, error) {
+		return []Event{
+			createMemberEvent(roomID, userA, userA, MembershipJoin),
+			createMemberEvent(roomID, userB, userB, MembershipJoin),
+		}, nil
+	}
+	stateWith := func(users map[string]any) func(requestedRoomID string) ([]Event, error) {
+		return func(requestedRoomID string) ([]Event, error) {
+			emptyStateKey := ""
+			return []Event{
+				{Type: "m.room.power_levels", StateKey: &emptyStateKey, Content: map[string]any{"users": users}},
+			}, nil
+		}
+	}
+	testCases := []struct {
+		name    string
+		master1 func(requestedRoomID string) ([]Event, error)
+		master2 func(requestedRoomID string) ([]Event, error)
+		wantErr bool
+	}{
+		{
+			name:    "matches",
+			master1: stateWith(map[string]any{userA: 50.0, userB: 50.0}),
+			master2: stateWith(map[string]any{userA: 50.0, userB: 50.0}),
+		},
+		{
+			name:    "timed out demotion was applied",
+			master1: stateWith(map[string]any{userA: 50.0}),
+			master2: stateWith(map[string]any{userA: 50.0}),
+		},
+		{
+			name:    "wrong power level",
+			master1: stateWith(map[string]any{userA: 50.0}),
+			master2: stateWith(map[string]any{}),
+			wantErr: true,
+		},
+		{
+			name:    "disagree on timed out demotion",
+			master1: stateWith(map[string]any{userA: 50.0, userB: 50.0}),
+			master2: stateWith(map[string]any{userA: 50.0}),
+			wantErr: true,
+		},
+		{
+			name:    "disagree on other users",
+			master1: stateWith(map[string]any{userA: 50.0, userC: 100.0}),
+			master2: stateWith(map[string]any{userA: 50.0}),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			master1 := newMockCSAPI("@master:localhost1")
+			master1.onMembers = members
+			master1.onState = tc.master1
+			master2 := newMockCSAPI("@master:localhost2")
+			master2.onMembers = members
+			master2.onState = tc.master2
+			conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn)
+			err := conv.Assert(context.Background(), 0)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// Test that tombstones and predecessors are checked for upgraded rooms.
+func TestConvergenceRoomUpgrades(t *testing.T) {
+	oldRoomID := "!old:id"
+	roomID := "!new:id"
+	sm := mockUpgradeStateMachine{
+		mockStateMachine: mockStateMachine{
+			userA: map[string]State{roomID: StateJoined},
+		},
+		upgrades: map[string]string{oldRoomID: roomID},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	members := func(requestedRoomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	stateWith := func(replacementRoomID, predecessorRoomID string) func(requestedRoomID string) ([]Event, error) {
+		return func(requestedRoomID string) ([]Event, error) {
+			emptyStateKey := ""
+			if requestedRoomID == oldRoomID {
+				if replacementRoomID == "" {
+					return nil, nil
+				}
+				return []Event{
+					{Type: "m.room.tombstone", StateKey: &emptyStateKey, Content: map[string]any{"replacement_room": replacementRoomID}},
+				}, nil
+			}
+			return []Event{
+				{Type: "m.room.create", StateKey: &emptyStateKey, Content: map[string]any{"predecessor": map[string]any{"room_id": predecessorRoomID}}},
+			}, nil
+		}
+	}
+	testCases := []struct {
+		name    string
+		state   func(requestedRoomID string) ([]Event, error)
+		wantErr bool
+	}{
+		{
+			name:  "matches",
+			state: stateWith(roomID, oldRoomID),
+		},
+		{
+			name:    "missing tombstone",
+			state:   stateWith("", oldRoomID),
+			wantErr: true,
+		},
+		{
+			name:    "wrong replacement room",
+			state:   stateWith("!other:id", oldRoomID),
+			wantErr: true,
+		},
+		{
+			name:    "wrong predecessor",
+			state:   stateWith(roomID, "!other:id"),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			master := newMockCSAPI("@master:localhost")
+			master.onMembers = members
+			master.onState = tc.state
+			conv := NewConvergence([]CSAPIConvergence{master}, []string{oldRoomID}, sm, updaterFn)
+			err := conv.Assert(context.Background(), 0)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// Test that the display names of joined users are checked, and that servers agree on timed out display names.
+func TestConvergenceDisplayNames(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockDisplayNameStateMachine{
+		mockStateMachine: mockStateMachine{
+			userA: map[string]State{roomID: StateJoined},
+			userB: map[string]State{roomID: StateJoined},
+			userC: map[string]State{roomID: StateLeft},
+		},
+		displayNames: map[string][]string{
+			userA: {"glum goose"},
+			// setting bob's display name timed out
+			userB: {"lucky bus", "happy house"},
+			// only join events are checked
+			userC: {"angry ant"},
+		},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	membersWith := func(aliceName, bobName string) func(requestedRoomID string) ([]Event, error) {
+		return func(requestedRoomID string) ([]Event, error) {
+			alice := createMemberEvent(roomID, userA, userA, MembershipJoin)
+			alice.Content["displayname"] = aliceName
+			bob := createMemberEvent(roomID, userB, userB, MembershipJoin)
+			bob.Content["displayname"] = bobName
+			return []Event{alice, bob, createMemberEvent(roomID, userC, userC, MembershipLeave)}, nil
+		}
+	}
+	testCases := []struct {
+		name    string
+		master1 func(requestedRoomID string) ([]Event, error)
+		master2 func(requestedRoomID string) ([]Event, error)
+		wantErr bool
+	}{
+		{
+			name:    "matches",
+			master1: membersWith("glum goose", "happy house"),
+			master2: membersWith("glum goose", "happy house"),
+		},
+		{
+			name:    "wrong display name",
+			master1: membersWith("glum goose", "happy house"),
+			master2: membersWith("sad goose", "happy house"),
+			wantErr: true,
+		},
+		{
+			name:    "disagree on timed out display name",
+			master1: membersWith("glum goose", "happy house"),
+			master2: membersWith("glum goose", "lucky bus"),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			master1 := newMockCSAPI("@master:localhost1")
+			master1.onMembers = tc.master1
+			master2 := newMockCSAPI("@master:localhost2")
+			master2.onMembers = tc.master2
+			conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn)
+			err := conv.Assert(context.Background(), 0)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConvergenceRedactions(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockRedactionStateMachine{
+		mockStateMachine: mockStateMachine{
+			userA: map[string]State{roomID: StateJoined},
+		},
+		redactions: map[string]map[string]bool{
+			roomID: {
+				"$definite": true,
+				// redacting this timed out
+				"$maybe": false,
+			},
+		},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	members := func(requestedRoomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	redactedEvent := func(eventID string) *Event {
+		return &Event{
+			ID:       eventID,
+			RoomID:   roomID,
+			Type:     "m.room.message",
+			Content:  map[string]any{},
+			Unsigned: map[string]any{"redacted_because": map[string]any{"type": "m.room.redaction"}},
+		}
+	}
+	unredactedEvent := func(eventID string) *Event {
+		return &Event{
+			ID:      eventID,
+			RoomID:  roomID,
+			Type:    "m.room.message",
+			Content: map[string]any{"body": "happy house"},
+		}
+	}
+	testCases := []struct {
+		name    string
+		master1 []*Event
+		master2 []*Event
+		wantErr bool
+	}{
+		{
+			name:    "matches",
+			master1: []*Event{redactedEvent("$definite"), redactedEvent("$maybe")},
+			master2: []*Event{redactedEvent("$definite"), redactedEvent("$maybe")},
+		},
+		{
+			name:    "timed out redaction was not applied",
+			master1: []*Event{redactedEvent("$definite"), unredactedEvent("$maybe")},
+			master2: []*Event{redactedEvent("$definite"), unredactedEvent("$maybe")},
+		},
+		{
+			name:    "not redacted",
+			master1: []*Event{redactedEvent("$definite"), redactedEvent("$maybe")},
+			master2: []*Event{unredactedEvent("$definite"), redactedEvent("$maybe")},
+			wantErr: true,
+		},
+		{
+			name:    "redacted with content",
+			master1: []*Event{redactedEvent("$definite"), redactedEvent("$maybe")},
+			master2: []*Event{{ID: "$definite", RoomID: roomID, Content: map[string]any{"body": "happy house"}, Unsigned: map[string]any{"redacted_because": map[string]any{}}}, redactedEvent("$maybe")},
+			wantErr: true,
+		},
+		{
+			name:    "disagree on timed out redaction",
+			master1: []*Event{redactedEvent("$definite"), redactedEvent("$maybe")},
+			master2: []*Event{redactedEvent("$definite"), unredactedEvent("$maybe")},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			master1 := newMockCSAPI("@master:localhost1")
+			master1.onMembers = members
+			master2 := newMockCSAPI("@master:localhost2")
+			master2.onMembers = members
+			for _, ev := range tc.master1 {
+				master1.events[roomID+ev.ID] = ev
+			}
+			for _, ev := range tc.master2 {
+				master2.events[roomID+ev.ID] = ev
+			}
+			conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn)
+			err := conv.Assert(context.Background(), 0)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConvergenceFullState(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateJoined},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	members := func(requestedRoomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	stateWith := func(eventIDs map[string]string) func(requestedRoomID string) ([]Event, error) {
+		return func(requestedRoomID string) ([]Event, error) {
+			var events []Event
+			for evType, eventID := range eventIDs {
+				events = append(events, Event{
+					ID:       eventID,
+					Type:     evType,
+					StateKey: new(string),
+					RoomID:   roomID,
+					Content:  map[string]any{},
+				})
+			}
+			return events, nil
+		}
+	}
+	testCases := []struct {
+		name      string
+		fullState bool
+		master1   map[string]string
+		master2   map[string]string
+		wantErr   bool
+	}{
+		{
+			name:      "matches",
+			fullState: true,
+			master1:   map[string]string{"m.room.create": "$create", "m.room.join_rules": "$jr"},
+			master2:   map[string]string{"m.room.create": "$create", "m.room.join_rules": "$jr"},
+		},
+		{
+			name:      "different event",
+			fullState: true,
+			master1:   map[string]string{"m.room.create": "$create", "m.room.join_rules": "$jr"},
+			master2:   map[string]string{"m.room.create": "$create", "m.room.join_rules": "$jr2"},
+			wantErr:   true,
+		},
+		{
+			name:      "missing event",
+			fullState: true,
+			master1:   map[string]string{"m.room.create": "$create"},
+			master2:   map[string]string{"m.room.create": "$create", "m.room.join_rules": "$jr"},
+			wantErr:   true,
+		},
+		{
+			name:    "only checked when enabled",
+			master1: map[string]string{"m.room.create": "$create", "m.room.join_rules": "$jr"},
+			master2: map[string]string{"m.room.create": "$create", "m.room.join_rules": "$jr2"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			master1 := newMockCSAPI("@master:localhost1")
+			master1.onMembers = members
+			master1.onState = stateWith(tc.master1)
+			master2 := newMockCSAPI("@master:localhost2")
+			master2.onMembers = members
+			master2.onState = stateWith(tc.master2)
+			var opts []ConvergenceOpt
+			if tc.fullState {
+				opts = append(opts, WithFullStateComparison())
+			}
+			conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn, opts...)
+			err := conv.Assert(context.Background(), 0)
+			if tc.wantErr {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "m.room.join_rules")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConvergenceMessageDelivery(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockMessageStateMachine{
+		mockStateMachine: mockStateMachine{
+			userA: map[string]State{roomID: StateSend},
+		},
+		messages: []SentMessage{
+			{RoomID: roomID, EventID: "$first", SenderID: userA, Tick: 1},
+			{RoomID: roomID, EventID: "$second", SenderID: userA, Tick: 2},
+		},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	members := func(requestedRoomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	master1 := newMockCSAPI("@master:localhost1")
+	master1.onMembers = members
+	master2 := newMockCSAPI("@master:localhost2")
+	master2.onMembers = members
+	for _, master := range []*mockCSAPI{master1, master2} {
+		master.events[roomID+"$first"] = &Event{ID: "$first", RoomID: roomID, Type: "m.room.message"}
+	}
+	master1.events[roomID+"$second"] = &Event{ID: "$second", RoomID: roomID, Type: "m.room.message"}
+	conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn)
+	err := conv.Assert(context.Background(), 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "@master:localhost2 is missing 1/2 messages")
+	assert.Contains(t, err.Error(), "tick 2: $second")
+
+	master2.events[roomID+"$second"] = &Event{ID: "$second", RoomID: roomID, Type: "m.room.message"}
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+}
+
+func TestConvergenceTimeline(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateSend},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	members := func(requestedRoomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	event := func(id, sender, evType string) Event {
+		ev := Event{ID: id, Sender: sender, Type: evType, RoomID: roomID, Content: map[string]any{}}
+		if evType == "m.room.member" {
+			ev.StateKey = &ev.Sender
+			ev.Content["membership"] = "join"
+		}
+		return ev
+	}
+	create := event("$create", userB, "m.room.create")
+	joinB := event("$joinB", userB, "m.room.member")
+	joinA := event("$joinA", userA, "m.room.member")
+	msgA1 := event("$msgA1", userA, "m.room.message")
+	msgA2 := event("$msgA2", userA, "m.room.message")
+	msgB := event("$msgB", userB, "m.room.message")
+	// timelineOf returns a /messages handler which returns the events newest first, 2 at a time
+	timelineOf := func(events ...Event) func(roomID, from string, limit int) (*MessagesResponse, error) {
+		return func(roomID, from string, limit int) (*MessagesResponse, error) {
+			end := len(events)
+			if from != "" {
+				fmt.Sscanf(from, "%d", &end)
+			}
+			start := max(end-2, 0)
+			res := &MessagesResponse{}
+			for i := end - 1; i >= start; i-- {
+				res.Chunk = append(res.Chunk, events[i])
+			}
+			if start > 0 {
+				res.End = fmt.Sprintf("%d", start)
+			}
+			return res, nil
+		}
+	}
+	testCases := []struct {
+		name    string
+		master1 []Event
+		master2 []Event
+		wantErr string
+	}{
+		{
+			name:    "matches",
+			master1: []Event{create, joinB, joinA, msgA1, msgB, msgA2},
+			master2: []Event{create, joinB, joinA, msgA1, msgB, msgA2},
+		},
+		{
+			name:    "concurrent events in a different order",
+			master1: []Event{create, joinB, joinA, msgA1, msgB, msgA2},
+			master2: []Event{create, joinB, joinA, msgA1, msgA2, msgB},
+		},
+		{
+			name:    "missing event",
+			master1: []Event{create, joinB, joinA, msgA1, msgB, msgA2},
+			master2: []Event{create, joinB, joinA, msgA1, msgA2},
+			wantErr: "$msgB (m.room.message from @bob:localhost) is on @master:localhost1 but not @master:localhost2",
+		},
+		{
+			name:    "user's events in a different order",
+			master1: []Event{create, joinB, joinA, msgA1, msgB, msgA2},
+			master2: []Event{create, joinB, joinA, msgA2, msgB, msgA1},
+			wantErr: "events from @alice:localhost are in a different order",
+		},
+		{
+			name:    "message before join",
+			master1: []Event{create, joinB, joinA, msgA1, msgB, msgA2},
+			master2: []Event{create, joinB, msgA1, joinA, msgB, msgA2},
+			wantErr: "$msgA1 (m.room.message) sent by @alice:localhost before they joined",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			master1 := newMockCSAPI("@master:localhost1")
+			master1.onMembers = members
+			master1.onMessages = timelineOf(tc.master1...)
+			master2 := newMockCSAPI("@master:localhost2")
+			master2.onMembers = members
+			master2.onMessages = timelineOf(tc.master2...)
+			conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn, WithTimelineComparison())
+			err := conv.Assert(context.Background(), 0)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConvergencePolling(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateJoined},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	joined := func(requestedRoomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	// joinedAfter returns a /members handler which only sees the join after the given number of calls
+	joinedAfter := func(calls int) func(requestedRoomID string) ([]Event, error) {
+		var count atomic.Int32
+		return func(requestedRoomID string) ([]Event, error) {
+			if int(count.Add(1)) <= calls {
+				return nil, nil
+			}
+			return joined(requestedRoomID)
+		}
+	}
+	master1 := newMockCSAPI("@master:localhost1")
+	master1.onMembers = joined
+	master2 := newMockCSAPI("@master:localhost2")
+	master2.onMembers = joinedAfter(2)
+	conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn, WithPolling(10*time.Second))
+	healedAt := time.Now()
+	timeToConverge, err := conv.AssertSince(context.Background(), 0, healedAt)
+	assert.NoError(t, err)
+	assert.Len(t, timeToConverge, 2)
+	// localhost2 needed 2 more checks, which are a second apart
+	assert.GreaterOrEqual(t, timeToConverge["localhost2"]-timeToConverge["localhost1"], 2*pollInterval)
+
+	// servers which pass then fail again have only converged once they stop failing
+	var count atomic.Int32
+	master1.onMembers = func(requestedRoomID string) ([]Event, error) {
+		if count.Add(1) == 2 {
+			return nil, nil
+		}
+		return joined(requestedRoomID)
+	}
+	master2.onMembers = joinedAfter(3)
+	conv = NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn, WithPolling(10*time.Second))
+	healedAt = time.Now()
+	timeToConverge, err = conv.AssertSince(context.Background(), 0, healedAt)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, timeToConverge["localhost1"], 2*pollInterval)
+
+	// gives up after the timeout
+	master1.onMembers = joined
+	master2.onMembers = joinedAfter(100)
+	conv = NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn, WithPolling(1500*time.Millisecond))
+	timeToConverge, err = conv.AssertSince(context.Background(), 0, time.Now())
+	assert.ErrorContains(t, err, "servers did not converge within 1.5s")
+	assert.Contains(t, timeToConverge, "localhost1")
+	assert.NotContains(t, timeToConverge, "localhost2")
+}
+
+func TestConvergencePartitioned(t *testing.T) {
+	roomID := "!room:id"
+	alice := "@alice:localhost1"
+	bob := "@bob:localhost2"
+	charlie := "@charlie:localhost1"
+	topic := StateKeyTuple{Type: "m.room.topic"}
+	// alice joined and set the topic on localhost1, whilst bob joined and kicked charlie on localhost2
+	sm := mockPartitionStateMachine{
+		mockStateMachine: mockStateMachine{
+			alice:   map[string]State{roomID: StateJoined},
+			bob:     map[string]State{roomID: StateJoined},
+			charlie: map[string]State{roomID: StateLeft},
+		},
+		actors:   map[string]map[string]string{roomID: {alice: alice, bob: bob, charlie: bob}},
+		expected: map[string]map[StateKeyTuple][]map[string]any{roomID: {topic: {{"topic": "split"}}}},
+		senders:  map[string]map[StateKeyTuple]string{roomID: {topic: alice}},
+		messages: []SentMessage{{RoomID: roomID, EventID: "$alice", SenderID: alice, Tick: 1}},
+	}
+	var gotStates []string
+	updaterFn := func(payload ws.PayloadConvergence) {
+		gotStates = append(gotStates, payload.State)
+	}
+	// neither server has seen what happened on the other server
+	aliceMembership := MembershipJoin
+	master1 := newMockCSAPI("@master:localhost1")
+	master1.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{
+			createMemberEvent(roomID, alice, alice, aliceMembership),
+			createMemberEvent(roomID, charlie, charlie, MembershipJoin),
+		}, nil
+	}
+	master1.onState = func(roomID string) ([]Event, error) {
+		return []Event{{Type: topic.Type, StateKey: &topic.StateKey, Content: map[string]any{"topic": "split"}}}, nil
+	}
+	master1.events[roomID+"$alice"] = &Event{ID: "$alice", RoomID: roomID, Type: "m.room.message"}
+	master2 := newMockCSAPI("@master:localhost2")
+	master2.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{
+			createMemberEvent(roomID, bob, bob, MembershipJoin),
+			createMemberEvent(roomID, bob, charlie, MembershipLeave),
+		}, nil
+	}
+	conv := NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn)
+	assert.NoError(t, conv.AssertPartitioned())
+	assert.Equal(t, []string{"checking partitions"}, gotStates)
+
+	// the server where alice joined must agree that she joined
+	aliceMembership = MembershipLeave
+	assert.ErrorContains(t, conv.AssertPartitioned(), "user @alice:localhost1 is 'leave'")
+	aliceMembership = MembershipJoin
+
+	delete(master1.events, roomID+"$alice")
+	assert.ErrorContains(t, conv.AssertPartitioned(), "@master:localhost1 is missing 1/1 messages")
+	master1.events[roomID+"$alice"] = &Event{ID: "$alice", RoomID: roomID, Type: "m.room.message"}
+
+	master2.dontAddEventsOnSend = true
+	assert.ErrorContains(t, conv.AssertPartitioned(), "@master:localhost2 is unavailable whilst partitioned")
+
+	// a master which hasn't joined the rooms yet isn't checked until it joins
+	conv = NewConvergence([]CSAPIConvergence{master1, master2}, []string{roomID}, sm, updaterFn, WithUnjoinedMasters(master2.GetUserID()))
+	assert.NoError(t, conv.AssertPartitioned())
+	conv.MasterJoined(master2.GetUserID())
+	assert.ErrorContains(t, conv.AssertPartitioned(), "@master:localhost2 is unavailable whilst partitioned")
+}
+
+func TestConvergenceReports(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateLeft},
+		userB: map[string]State{roomID: StateJoined},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	join := createMemberEvent(roomID, "@bob:remote", userA, MembershipJoin)
+	join.ID = "$join"
+	join.Unsigned = map[string]any{"age": float64(1500)}
+	master1 := newMockCSAPI("@master:localhost1")
+	master1.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{join, createMemberEvent(roomID, userB, userB, MembershipJoin)}, nil
+	}
+	dir := t.TempDir()
+	var reports []*ws.PayloadConvergenceReport
+	conv := NewConvergence([]CSAPIConvergence{master1}, []string{roomID}, sm, updaterFn, WithReports(dir, func(report *ws.PayloadConvergenceReport) {
+		reports = append(reports, report)
+	}))
+	err := conv.Assert(context.Background(), 0)
+	assert.ErrorContains(t, err, "user @alice:localhost is 'join'. Want 'left'")
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1", len(reports))
+	}
+	report := reports[0]
+	assert.Equal(t, err.Error(), report.Error)
+	assert.Equal(t, []ws.MembershipMismatch{{
+		RoomID:         roomID,
+		Server:         "localhost1",
+		UserID:         userA,
+		WantStates:     []string{string(StateLeft)},
+		GotMembership:  string(MembershipJoin),
+		EventID:        "$join",
+		OriginServer:   "remote",
+		OriginServerTS: join.Timestamp,
+		AgeMs:          1500,
+	}}, report.Mismatches)
+
+	b, err := os.ReadFile(report.Path)
+	if err != nil {
+		t.Fatalf("failed to read report: %s", err)
+	}
+	var written ws.PayloadConvergenceReport
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatalf("failed to unmarshal report: %s", err)
+	}
+	assert.Equal(t, report.Mismatches, written.Mismatches)
+
+	// successful checks aren't reported
+	sm[userA][roomID] = StateJoined
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+	assert.Len(t, reports, 1)
+}
+
+func TestConvergenceInvariants(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateJoined},
+	}
+	var invariantPayloads []ws.PayloadConvergence
+	updaterFn := func(payload ws.PayloadConvergence) {
+		if payload.State == "invariants" {
+			invariantPayloads = append(invariantPayloads, payload)
+		}
+	}
+	master1 := newMockCSAPI("@master:localhost1")
+	master1.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	var gotMasters []CSAPIConvergence
+	violation := ""
+	var checkErr error
+	conv := NewConvergence([]CSAPIConvergence{master1}, []string{roomID}, sm, updaterFn, WithInvariants(
+		Invariant{Name: "sees masters", Check: func(masters []CSAPIConvergence, sm StateMachineConvergence) (string, error) {
+			gotMasters = masters
+			return "", nil
+		}},
+		Invariant{Name: "configurable", Check: func(masters []CSAPIConvergence, sm StateMachineConvergence) (string, error) {
+			return violation, checkErr
+		}},
+	))
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+	assert.Equal(t, []CSAPIConvergence{master1}, gotMasters)
+
+	violation = "alice is sad"
+	assert.ErrorContains(t, conv.Assert(context.Background(), 0), "invariant configurable does not hold: alice is sad")
+
+	checkErr = fmt.Errorf("request failed")
+	assert.ErrorContains(t, conv.Assert(context.Background(), 0), "failed to check invariant configurable: request failed")
+
+	assert.Equal(t, []ws.PayloadConvergence{
+		{State: "invariants", Invariants: []ws.InvariantResult{{Name: "sees masters", Result: "pass"}, {Name: "configurable", Result: "pass"}}},
+		{State: "invariants", Invariants: []ws.InvariantResult{{Name: "sees masters", Result: "pass"}, {Name: "configurable", Result: "fail", Detail: "alice is sad"}}},
+		{State: "invariants", Invariants: []ws.InvariantResult{{Name: "sees masters", Result: "pass"}, {Name: "configurable", Result: "error", Detail: "request failed"}}},
+	}, invariantPayloads)
+}
+
+func TestConvergenceSynchroniseErrors(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateJoined},
+	}
+	var synchronisedErr string
+	updaterFn := func(payload ws.PayloadConvergence) {
+		if payload.State == "synchronised" {
+			synchronisedErr = payload.Error
+		}
+	}
+	master := newMockCSAPI("@master:localhost")
+	master.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{createMemberEvent(roomID, userA, userA, MembershipJoin)}, nil
+	}
+	var failures int
+	var failWith int
+	master.onSync = func(syncReq SyncReq) (*SyncResponse, error) {
+		if syncReq.Since != "" && failures > 0 {
+			failures--
+			return nil, fmt.Errorf("Sync failed: %w", &HTTPError{StatusCode: failWith})
+		}
+		return master.syncTimeline(syncReq)
+	}
+	conv := NewConvergence([]CSAPIConvergence{master}, []string{roomID}, sm, updaterFn)
+
+	// transient errors are retried
+	failures, failWith = 2, http.StatusBadGateway
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+	assert.Equal(t, "", synchronisedErr)
+	assert.Equal(t, 0, failures)
+
+	// the server rejecting /sync is reported straight away, and fails the check even though the server agrees
+	failures, failWith = 1, http.StatusForbidden
+	assert.ErrorContains(t, conv.Assert(context.Background(), 0), "failed to synchronise")
+	assert.Contains(t, synchronisedErr, "/sync on @master:localhost failed, terminating")
+
+	// transient errors which never go away are reported when we give up
+	failures, failWith = math.MaxInt, http.StatusBadGateway
+	// synchronising always waits a second before starting
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.ErrorContains(t, conv.Assert(ctx, 0), "failed to synchronise")
+	assert.Contains(t, synchronisedErr, "last errors")
+	assert.Contains(t, synchronisedErr, "HTTP 502")
+}
+
+func TestConvergenceStrictMembership(t *testing.T) {
+	roomID := "!room:id"
+	moderator := "@moderator:localhost"
+	phantom := "@phantom:localhost"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateJoined},
+		userB: map[string]State{roomID: StateLeft},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	phantomMembership := MembershipJoin
+	master := newMockCSAPI("@master:localhost")
+	master.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{
+			createMemberEvent(roomID, master.userID, master.userID, MembershipJoin),
+			createMemberEvent(roomID, moderator, moderator, MembershipJoin),
+			createMemberEvent(roomID, userA, userA, MembershipJoin),
+			createMemberEvent(roomID, phantom, phantom, phantomMembership),
+		}, nil
+	}
+	// extra members are ignored by default
+	conv := NewConvergence([]CSAPIConvergence{master}, []string{roomID}, sm, updaterFn)
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+
+	conv = NewConvergence([]CSAPIConvergence{master}, []string{roomID}, sm, updaterFn, WithStrictMembership(moderator))
+	err := conv.Assert(context.Background(), 0)
+	assert.ErrorContains(t, err, "user @phantom:localhost is 'join' but is not a test user, master or moderator")
+	assert.NotContains(t, err.Error(), moderator)
+
+	// only joined members are phantoms
+	phantomMembership = MembershipLeave
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+}
+
+func TestConvergenceUserSyncViews(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateJoined},
+		userB: map[string]State{roomID: StateBanned},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	master := newMockCSAPI("@master:localhost")
+	master.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{
+			createMemberEvent(roomID, userA, userA, MembershipJoin),
+			createMemberEvent(roomID, userA, userB, MembershipBan),
+		}, nil
+	}
+	// sections returns a /sync handler for a user which returns the next comma separated sections each time, with
+	// the since token being how many times they have synced.
+	sections := func(responses ...string) func(syncReq SyncReq) (*SyncResponse, error) {
+		return func(syncReq SyncReq) (*SyncResponse, error) {
+			i := 0
+			fmt.Sscanf(syncReq.Since, "%d", &i)
+			rooms := map[string]any{}
+			if i < len(responses) && responses[i] != "" {
+				for _, section := range strings.Split(responses[i], ",") {
+					rooms[section] = map[string]any{roomID: map[string]any{}}
+				}
+			}
+			b, _ := json.Marshal(map[string]any{
+				"next_batch": fmt.Sprintf("%d", i+1),
+				"rooms":      rooms,
+			})
+			var res SyncResponse
+			err := json.Unmarshal(b, &res)
+			return &res, err
+		}
+	}
+	alice := newMockCSAPI(userA)
+	bob := newMockCSAPI(userB)
+	// nobody is in the room at the start, then alice joins and bob joins
+	alice.onSync = sections("", "join")
+	bob.onSync = sections("", "join")
+	conv := NewConvergence([]CSAPIConvergence{master}, []string{roomID}, sm, updaterFn, WithUserSyncViews([]CSAPIConvergence{alice, bob}))
+	assert.NoError(t, conv.StartUserSyncViews())
+	err := conv.Assert(context.Background(), 0)
+	assert.ErrorContains(t, err, "@bob:localhost's own /sync disagrees with the state machine: room !room:id is in rooms.join. Want one of [banned]")
+
+	// bob's server finally tells him he was banned, and the room isn't mentioned again for alice
+	bob.onSync = sections("", "join", "leave")
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+
+	// bob is unbanned and invited again, so the room is in both rooms.leave and rooms.invite
+	sm[userB][roomID] = StateInvited
+	master.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{
+			createMemberEvent(roomID, userA, userA, MembershipJoin),
+			createMemberEvent(roomID, userA, userB, MembershipInvite),
+		}, nil
+	}
+	bob.onSync = sections("", "join", "leave", "invite,leave")
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+}
+
+func TestConvergenceDerivedViews(t *testing.T) {
+	roomID := "!room:id"
+	sm := mockStateMachine{
+		userA: map[string]State{roomID: StateJoined},
+		userB: map[string]State{roomID: StateInvited},
+	}
+	updaterFn := func(payload ws.PayloadConvergence) {}
+	master := newMockCSAPI("@master:localhost")
+	master.onMembers = func(roomID string) ([]Event, error) {
+		return []Event{
+			createMemberEvent(roomID, master.userID, master.userID, MembershipJoin),
+			createMemberEvent(roomID, userA, userA, MembershipJoin),
+			createMemberEvent(roomID, userA, userB, MembershipInvite),
+		}, nil
+	}
+	joinedMembers := []string{userA, master.userID}
+	master.onJoinedMembers = func(roomID string) ([]string, error) {
+		return joinedMembers, nil
+	}
+	joinedCount := 2
+	master.onSync = func(syncReq SyncReq) (*SyncResponse, error) {
+		if syncReq.Filter != summaryFilter {
+			return master.syncTimeline(syncReq)
+		}
+		var res SyncResponse
+		err := json.Unmarshal([]byte(fmt.Sprintf(
+			`{"rooms":{"join":{%q:{"summary":{"m.joined_member_count":%d,"m.invited_member_count":1}}}}}`, roomID, joinedCount,
+		)), &res)
+		return &res, err
+	}
+	joinedRooms := []string{roomID}
+	alice := newMockCSAPI(userA)
+	alice.onJoinedRooms = func() ([]string, error) {
+		return joinedRooms, nil
+	}
+	bob := newMockCSAPI(userB)
+	bob.onJoinedRooms = func() ([]string, error) {
+		return nil, nil
+	}
+	conv := NewConvergence([]CSAPIConvergence{master}, []string{roomID}, sm, updaterFn, WithDerivedViewChecks([]CSAPIConvergence{alice, bob}))
+	assert.NoError(t, conv.Assert(context.Background(), 0))
+
+	joinedMembers = []string{master.userID}
+	assert.ErrorContains(t, conv.Assert(context.Background(), 0), "room !room:id /joined_members is [@master:localhost] but /members has [@alice:localhost @master:localhost] joined")
+	joinedMembers = []string{userA, master.userID}
+
+	joinedCount = 3
+	assert.ErrorContains(t, conv.Assert(context.Background(), 0), "room !room:id m.joined_member_count is 3 but /members has 2 joined")
+	joinedCount = 2
+
+	joinedRooms = nil
+	assert.ErrorContains(t, conv.Assert(context.Background(), 0), "user @alice:localhost /joined_rooms says they are left in !room:id. Want one of [joined]")
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// WithDerivedViewChecks makes convergence checks also check views which servers derive from the room state, and
+// often cache, against the room state itself. These caches are a frequent source of drift after restarts. On every
+// server, /joined_members and the joined and invited member counts in the /sync room summary must match /members,
+// and /joined_rooms for each of the given test users on that server must match the state machine.
+func WithDerivedViewChecks(users []CSAPIConvergence) ConvergenceOpt {
+	return func(c *Convergence) {
+		c.derivedViews = true
+		c.derivedViewUsers = users
+	}
+}
+
+// summaryFilter only includes the room summary. Servers only have to send the summary when lazy loading members.
+var summaryFilter = func() string {
+	none := map[string]any{"types": []string{}}
+	b, _ := json.Marshal(map[string]any{
+		"account_data": none,
+		"presence":     none,
+		"room": map[string]any{
+			"account_data": none,
+			"ephemeral":    none,
+			"state":        map[string]any{"types": []string{}, "lazy_load_members": true},
+			"timeline":     map[string]any{"limit": 1, "lazy_load_members": true},
+		},
+	})
+	return string(b)
+}()
+
+// assertDerivedViews checks the derived views on the master's server against gotMemberships, which is what the
+// server returned from /members, and roomStates for the server's test users.
+func (c *Convergence) assertDerivedViews(master CSAPIConvergence, roomStates map[string]map[string][]State, gotMemberships map[string]map[string]memberState) error {
+	sr, err := master.Sync(SyncReq{
+		Filter:        summaryFilter,
+		TimeoutMillis: "0",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to /sync on %s : %s", master.GetUserID(), err)
+	}
+	var errs []string
+	for _, roomID := range c.allRoomIDs() {
+		memberships, ok := gotMemberships[roomID]
+		if !ok {
+			continue
+		}
+		var joined []string
+		invited := 0
+		for userID, got := range memberships {
+			switch got.Membership {
+			case MembershipJoin:
+				joined = append(joined, userID)
+			case MembershipInvite:
+				invited++
+			}
+		}
+		slices.Sort(joined)
+		joinedMembers, err := master.JoinedMembers(roomID)
+		if err != nil {
+			return fmt.Errorf("/joined_members for %s failed: %s", roomID, err)
+		}
+		slices.Sort(joinedMembers)
+		if !slices.Equal(joined, joinedMembers) {
+			errs = append(errs, fmt.Sprintf("room %s /joined_members is %v but /members has %v joined", roomID, joinedMembers, joined))
+		}
+		// counts may be missing if the server doesn't send a summary
+		summary := sr.Rooms.Join[roomID].Summary
+		if summary.JoinedMemberCount != nil && *summary.JoinedMemberCount != len(joined) {
+			errs = append(errs, fmt.Sprintf("room %s m.joined_member_count is %d but /members has %d joined", roomID, *summary.JoinedMemberCount, len(joined)))
+		}
+		if summary.InvitedMemberCount != nil && *summary.InvitedMemberCount != invited {
+			errs = append(errs, fmt.Sprintf("room %s m.invited_member_count is %d but /members has %d invited", roomID, *summary.InvitedMemberCount, invited))
+		}
+	}
+	for _, user := range c.derivedViewUsers {
+		if domainOf(user.GetUserID()) != domainOf(master.GetUserID()) {
+			continue
+		}
+		joinedRooms, err := user.JoinedRooms()
+		if err != nil {
+			return fmt.Errorf("/joined_rooms for %s failed: %s", user.GetUserID(), err)
+		}
+		for _, roomID := range c.allRoomIDs() {
+			wantStates, ok := roomStates[roomID][user.GetUserID()]
+			if !ok {
+				continue
+			}
+			got := StateLeft
+			if slices.Contains(joinedRooms, roomID) {
+				got = StateJoined
+			}
+			// invites, knocks and bans are all not joined
+			var want []State
+			for _, state := range wantStates {
+				if state != StateJoined {
+					state = StateLeft
+				}
+				want = append(want, state)
+			}
+			if !slices.Contains(want, got) {
+				errs = append(errs, fmt.Sprintf("user %s /joined_rooms says they are %s in %s. Want one of %v", user.GetUserID(), got, roomID, wantStates))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s derived views disagree with room state: %s", master.GetUserID(), strings.Join(errs, "\n"))
+	}
+	return nil
+}
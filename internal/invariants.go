@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/element-hq/chaos/ws"
+)
+
+// the results of checking an invariant
+const (
+	invariantPass  = "pass"
+	invariantFail  = "fail"
+	invariantError = "error"
+)
+
+// InvariantFn checks an invariant against every master and the state machine once the servers have synchronised.
+// It returns a non-empty violation if the invariant does not hold, or an error if it could not be checked e.g
+// because a request failed.
+type InvariantFn func(masters []CSAPIConvergence, sm StateMachineConvergence) (violation string, err error)
+
+// Invariant is a named InvariantFn.
+type Invariant struct {
+	Name  string
+	Check InvariantFn
+}
+
+// WithInvariants makes convergence checks also check the given invariants, after checking the state the state
+// machine knows about. Invariants are not checked whilst partitioned, as servers have not synchronised.
+func WithInvariants(invariants ...Invariant) ConvergenceOpt {
+	return func(c *Convergence) {
+		c.invariants = append(c.invariants, invariants...)
+	}
+}
+
+// checkInvariants checks every invariant, sending the result of each. Returns an error describing the first
+// invariant which failed or could not be checked, if any.
+func (c *Convergence) checkInvariants() error {
+	if len(c.invariants) == 0 {
+		return nil
+	}
+	var firstErr error
+	results := make([]ws.InvariantResult, len(c.invariants))
+	for i, inv := range c.invariants {
+		results[i] = ws.InvariantResult{
+			Name:   inv.Name,
+			Result: invariantPass,
+		}
+		violation, err := inv.Check(c.masters, c.sm)
+		switch {
+		case err != nil:
+			results[i].Result = invariantError
+			results[i].Detail = err.Error()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to check invariant %s: %s", inv.Name, err)
+			}
+		case violation != "":
+			results[i].Result = invariantFail
+			results[i].Detail = violation
+			if firstErr == nil {
+				firstErr = fmt.Errorf("invariant %s does not hold: %s", inv.Name, violation)
+			}
+		}
+	}
+	c.updaterFn(ws.PayloadConvergence{
+		State:      "invariants",
+		Invariants: results,
+	})
+	return firstErr
+}
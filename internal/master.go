@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"maps"
 	"net/http"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/element-hq/chaos/config"
@@ -18,22 +20,59 @@ type Master struct {
 	cfg            *config.Chaos
 	roomIDs        []string
 	users          []CSAPI
+	moderators     []CSAPI
+	spaceID        string // the last room in roomIDs, if set
 	userIDToWorker map[string]*Worker
 	workers        []*Worker
 	masters        []CSAPI
 	convergence    *Convergence
+	stateMachine   *StateMachine
 	wsServer       *ws.Server
+	errorCounts    map[ErrorClass]int
+	recorder       *Recorder
+	currentTick    atomic.Int64
+	invariants     []Invariant
+	// returns true whilst federation is blocked by a netsplit, if set
+	federationBlocked func() bool
+	// the server whose master and moderators don't join knock rooms, so its users knock over federation, if any.
+	// Its master joins before the first convergence check, which sets nonResidentJoined. See joinNonResident.
+	nonResident       string
+	nonResidentJoined bool
 }
 
 func NewMaster(wsServer *ws.Server) *Master {
 	return &Master{
 		userIDToWorker: make(map[string]*Worker),
 		wsServer:       wsServer,
+		errorCounts:    make(map[ErrorClass]int),
 	}
 }
 
 func (m *Master) Prepare(cfg *config.Chaos) error {
 	m.cfg = cfg
+	switch m.joinRule() {
+	case JoinRulePublic, JoinRuleInvite:
+	case JoinRuleKnock:
+		if roomVersion, err := strconv.Atoi(cfg.Test.RoomVersion); err == nil && roomVersion < 7 {
+			return fmt.Errorf("join_rule 'knock' requires room version 7 or later, got %s", cfg.Test.RoomVersion)
+		}
+	case JoinRuleRestricted:
+		if roomVersion, err := strconv.Atoi(cfg.Test.RoomVersion); err == nil && roomVersion < 8 {
+			return fmt.Errorf("join_rule 'restricted' requires room version 8 or later, got %s", cfg.Test.RoomVersion)
+		}
+	default:
+		return fmt.Errorf("unknown join_rule '%s'", m.joinRule())
+	}
+	if cfg.Test.Upgrades.Probability > 0 {
+		if cfg.Test.Upgrades.RoomVersion == "" {
+			return fmt.Errorf("upgrades require a room_version to upgrade to")
+		}
+		// servers don't copy invites or knocks to the replacement room, and restricted rooms would need
+		// their space to be updated as well.
+		if m.joinRule() != JoinRulePublic {
+			return fmt.Errorf("upgrades require join_rule 'public', got '%s'", m.joinRule())
+		}
+	}
 	now := time.Now()
 	// create masters on each server.
 	// They will create the rooms and lurk to ensure that if all test users leave the room is still joinable.
@@ -60,6 +99,76 @@ func (m *Master) Prepare(cfg *config.Chaos) error {
 		masterIDs = append(masterIDs, master.UserID)
 	}
 	log.Printf("Created masters: %v", masterIDs)
+	m.nonResident = nonResidentDomain(m.joinRule(), masters)
+	nonResident := m.nonResident
+	if nonResident != "" {
+		log.Printf("Nobody on %s will be joined to rooms until the first convergence check, so its users knock over federation", nonResident)
+	}
+	// create moderators, alternating each server. They need to exist before the rooms so they can be
+	// given power in the initial power levels.
+	var moderators []CSAPI
+	var moderatorIDs []string
+	for i := 0; i < cfg.Test.Moderation.NumModerators; i++ {
+		server := servers[i%len(servers)]
+		moderator, err := m.registerUser(server.Domain, fmt.Sprintf("moderator-%d-%d", now.UnixMilli(), i), server.URL, cfg.Verbose)
+		if err != nil {
+			return fmt.Errorf("error registering moderator on %s : %s", server.URL, err)
+		}
+		moderators = append(moderators, moderator)
+		moderatorIDs = append(moderatorIDs, moderator.UserID)
+	}
+	if len(moderatorIDs) > 0 {
+		log.Printf("Created moderators: %v", moderatorIDs)
+	}
+	// everyone else joins the room: masters so the room is always joinable, moderators so they can kick and ban.
+	joinEveryoneElse := func(roomID string, creatorIndex int) error {
+		creator := masters[creatorIndex]
+		for m := range masters {
+			if m == creatorIndex || masters[m].Domain == nonResident {
+				continue
+			}
+			if err := masters[m].JoinRoom(roomID, []string{creator.Domain}); err != nil {
+				return fmt.Errorf("%s failed to join room %s : %s", masters[m].UserID, roomID, err)
+			}
+			masters[m].EnsureFullyJoined(roomID)
+		}
+		for i := range moderators {
+			if moderators[i].Domain == nonResident {
+				continue
+			}
+			if err := moderators[i].JoinRoom(roomID, []string{creator.Domain}); err != nil {
+				return fmt.Errorf("%s failed to join room %s : %s", moderators[i].UserID, roomID, err)
+			}
+			moderators[i].EnsureFullyJoined(roomID)
+		}
+		return nil
+	}
+	// restricted rooms can only be joined by members of the space, which is a public room.
+	var spaceID string
+	if m.joinRule() == JoinRuleRestricted {
+		createOpts := map[string]interface{}{
+			"preset": "public_chat",
+			"creation_content": map[string]any{
+				"type": "m.space",
+			},
+		}
+		if cfg.Test.RoomVersion != "" {
+			createOpts["room_version"] = cfg.Test.RoomVersion
+		}
+		if override := powerLevelContentOverride(cfg, m.joinRule(), masterIDs, moderatorIDs); override != nil {
+			createOpts["power_level_content_override"] = override
+		}
+		var err error
+		spaceID, err = masters[0].CreateRoom(createOpts)
+		if err != nil {
+			return fmt.Errorf("%s failed to create space: %s", masters[0].UserID, err)
+		}
+		if err := joinEveryoneElse(spaceID, 0); err != nil {
+			return fmt.Errorf("failed to join space: %s", err)
+		}
+		log.Printf("Created space: %s", spaceID)
+	}
+
 	// create the required rooms. Cycle who creates them to ensure we don't make them all on one server.
 
 	ch := make(chan int, cfg.Test.NumRooms)
@@ -68,9 +177,9 @@ func (m *Master) Prepare(cfg *config.Chaos) error {
 	}
 	close(ch)
 	errChan := make(chan error, cfg.Test.NumInitGoroutines)
-	resultRoomsCh := make(chan *string, cfg.Test.NumRooms)
-
-	var roomIDs []string
+	// rooms are stored in creation order so recordings can map them between runs.
+	// Each goroutine writes to a different index so this is safe to do concurrently.
+	roomIDs := make([]string, cfg.Test.NumRooms)
 
 	var wgRooms sync.WaitGroup
 	wgRooms.Add(cfg.Test.NumInitGoroutines)
@@ -79,49 +188,104 @@ func (m *Master) Prepare(cfg *config.Chaos) error {
 		go func() {
 			defer wgRooms.Done()
 			for work := range ch {
-				creatorIndex := work % len(masters)
+				numCreators := len(masters)
+				if nonResident != "" {
+					// the non-resident server's master is always the last one
+					numCreators--
+				}
+				creatorIndex := work % numCreators
 				creator := masters[creatorIndex]
 				createOpts := map[string]interface{}{
 					"preset": "public_chat",
 				}
+				if m.joinRule() != JoinRulePublic {
+					// everyone else needs an invite to join below
+					var invitees []string
+					for m := range masters {
+						if m != creatorIndex && masters[m].Domain != nonResident {
+							invitees = append(invitees, masters[m].UserID)
+						}
+					}
+					for i := range moderators {
+						if moderators[i].Domain != nonResident {
+							invitees = append(invitees, moderators[i].UserID)
+						}
+					}
+					createOpts["preset"] = "private_chat"
+					createOpts["invite"] = invitees
+				}
+				switch m.joinRule() {
+				case JoinRuleKnock:
+					createOpts["initial_state"] = []map[string]any{
+						{
+							"type":      "m.room.join_rules",
+							"state_key": "",
+							"content": map[string]any{
+								"join_rule": "knock",
+							},
+						},
+					}
+				case JoinRuleRestricted:
+					createOpts["initial_state"] = []map[string]any{
+						{
+							"type":      "m.room.join_rules",
+							"state_key": "",
+							"content": map[string]any{
+								"join_rule": "restricted",
+								"allow": []map[string]any{
+									{
+										"type":    "m.room_membership",
+										"room_id": spaceID,
+									},
+								},
+							},
+						},
+					}
+				}
 				if cfg.Test.RoomVersion != "" {
 					createOpts["room_version"] = cfg.Test.RoomVersion
 				}
+				if override := powerLevelContentOverride(cfg, m.joinRule(), masterIDs, moderatorIDs); override != nil {
+					createOpts["power_level_content_override"] = override
+				}
 				roomID, err := creator.CreateRoom(createOpts)
 				if err != nil {
 					errChan <- fmt.Errorf("%s failed to create room: %s", creator.UserID, err)
 					return
 				}
-				// everyone else joins the room
-				for m := range masters {
-					if m == creatorIndex {
-						continue
-					}
-					if err := masters[m].JoinRoom(roomID, []string{creator.Domain}); err != nil {
-						errChan <- fmt.Errorf("%s failed to join room %s : %s", masters[m].UserID, roomID, err)
+				if err := joinEveryoneElse(roomID, creatorIndex); err != nil {
+					errChan <- err
+					return
+				}
+				if spaceID != "" {
+					// let clients see the room in the space. This doesn't affect who can join.
+					_, err := masters[0].SendState(spaceID, "m.space.child", roomID, map[string]any{
+						"via": []string{creator.Domain},
+					})
+					if err != nil {
+						errChan <- fmt.Errorf("%s failed to add room %s to space: %s", masters[0].UserID, roomID, err)
 						return
 					}
-					masters[m].EnsureFullyJoined(roomID)
 				}
-				resultRoomsCh <- &roomID
+				roomIDs[work] = roomID
 			}
 		}()
 	}
 	wgRooms.Wait()
 	close(errChan)
-	close(resultRoomsCh)
 
 	for err := range errChan {
 		return fmt.Errorf("failed to create rooms: %s", err)
 	}
 
-	for roomID := range resultRoomsCh {
-		roomIDs = append(roomIDs, *roomID)
-	}
 	log.Printf("Created rooms: %v", roomIDs)
+	if spaceID != "" {
+		// the space is treated like any other room, apart from its join rule
+		roomIDs = append(roomIDs, spaceID)
+	}
 
-	// create the users, alternating each server
-	var users []CSAPI
+	// create the users, alternating each server. Like rooms, users are stored in creation order.
+	users := make([]CSAPI, cfg.Test.NumUsers)
 	var userIDs []string
 
 	ch = make(chan int, cfg.Test.NumUsers)
@@ -130,7 +294,6 @@ func (m *Master) Prepare(cfg *config.Chaos) error {
 	}
 	close(ch)
 	errChan = make(chan error, cfg.Test.NumInitGoroutines)
-	resultUsersCh := make(chan *CSAPI, cfg.Test.NumUsers)
 
 	var wgUsers sync.WaitGroup
 	wgUsers.Add(cfg.Test.NumInitGoroutines)
@@ -145,20 +308,18 @@ func (m *Master) Prepare(cfg *config.Chaos) error {
 					errChan <- fmt.Errorf("failed to register user on domain %s: %s", server.Domain, err)
 					return
 				}
-				resultUsersCh <- &u
+				users[work] = u
 			}
 		}()
 	}
 	wgUsers.Wait()
 	close(errChan)
-	close(resultUsersCh)
 
 	for err := range errChan {
 		return fmt.Errorf("failed to create users: %s", err)
 	}
 
-	for user := range resultUsersCh {
-		users = append(users, *user)
+	for _, user := range users {
 		userIDs = append(userIDs, user.UserID)
 	}
 
@@ -166,27 +327,106 @@ func (m *Master) Prepare(cfg *config.Chaos) error {
 	m.roomIDs = roomIDs
 	m.users = users
 	m.masters = masters
+	m.moderators = moderators
+	m.spaceID = spaceID
+	return nil
+}
+
+// nonResidentDomain returns the server whose master and moderators don't join knock rooms, so that its users knock
+// over federation, or "" if everyone joins every room. This is always the last master's server.
+func nonResidentDomain(joinRule JoinRule, masters []CSAPI) string {
+	if joinRule != JoinRuleKnock || len(masters) < 2 {
+		return ""
+	}
+	return masters[len(masters)-1].Domain
+}
+
+// residents returns the IDs of the actors who are joined to every room from the start.
+func (m *Master) residents(actors []CSAPI) []string {
+	var result []string
+	for _, actor := range actors {
+		if actor.Domain != m.nonResident {
+			result = append(result, actor.UserID)
+		}
+	}
+	return result
+}
+
+// nonResidentMaster returns the master on the non-resident server, or nil if there isn't one.
+func (m *Master) nonResidentMaster() *CSAPI {
+	if m.nonResident == "" {
+		return nil
+	}
+	return &m.masters[len(m.masters)-1]
+}
+
+// isResident returns true if the master or moderator is currently joined to every room.
+func (m *Master) isResident(actor *CSAPI) bool {
+	if actor.Domain != m.nonResident {
+		return true
+	}
+	return m.nonResidentJoined && actor == m.nonResidentMaster()
+}
+
+// joinNonResident joins the non-resident server's master to every room, so convergence checks can compare that
+// server's view of the rooms with every other server. Its users have knocked over federation until now, and it
+// receives the current state of every room when it joins. Does nothing if it has already joined.
+func (m *Master) joinNonResident() error {
+	master := m.nonResidentMaster()
+	if master == nil || m.nonResidentJoined {
+		return nil
+	}
+	inviter := &m.masters[0]
+	for _, roomID := range m.convergence.allRoomIDs() {
+		if err := inviter.Invite(roomID, master.UserID); err != nil {
+			// e.g it was invited by an earlier attempt which failed to join
+			log.Printf("%s failed to invite %s to %s: %s", inviter.UserID, master.UserID, roomID, err)
+		}
+		if err := master.JoinRoom(roomID, []string{inviter.Domain}); err != nil {
+			return fmt.Errorf("%s failed to join room %s : %s", master.UserID, roomID, err)
+		}
+		master.EnsureFullyJoined(roomID)
+	}
+	log.Printf("%s joined every room, so %s is now checked for convergence", master.UserID, m.nonResident)
+	m.nonResidentJoined = true
+	m.convergence.MasterJoined(master.UserID)
+	m.stateMachine.SetResident(m.nonResident)
 	return nil
 }
 
-// StartWorkers starts the requested number of workers, returning their user IDs
+// joinRule returns the configured join rule for rooms, defaulting to public.
+func (m *Master) joinRule() JoinRule {
+	if m.cfg.Test.JoinRule == "" {
+		return JoinRulePublic
+	}
+	return JoinRule(m.cfg.Test.JoinRule)
+}
+
+// StartWorkers starts the requested number of workers and buckets users and moderators onto them, returning the
+// user IDs. If numWorkers is 0, each user gets their own worker.
 func (m *Master) StartWorkers(numWorkers, opsPerTick int) []string {
-	if numWorkers > len(m.users) {
-		log.Printf("Requested %d workers but only %d users exist, setting workers to %d", numWorkers, len(m.users), len(m.users))
-		numWorkers = len(m.users)
+	// masters are on workers so they can invite users
+	var actors []*CSAPI
+	for _, users := range [][]CSAPI{m.users, m.moderators, m.masters} {
+		for i := range users {
+			actors = append(actors, &users[i])
+		}
 	}
-	// TODO: handle multi users per worker
-	if numWorkers < len(m.users) {
-		panic("not implemented")
+	if numWorkers > len(actors) {
+		log.Printf("Requested %d workers but only %d users exist, setting workers to %d", numWorkers, len(actors), len(actors))
+		numWorkers = len(actors)
+	}
+	if numWorkers <= 0 {
+		numWorkers = len(actors)
 	}
 	var result []string
-	for i := 0; i < numWorkers; i++ {
-		users := []CSAPI{m.users[i]}
-		// if the tick randomly makes work all for one worker we want to be able to queue it all up without blocking + EOF signal
-		workerCh := make(chan WorkerCommand, opsPerTick+1)
-		// if an error is sent back or if we EOF we should block the worker
-		errCh := make(chan error)
-		w := NewWorker(users, m.wsServer, workerCh, errCh)
+	for _, users := range bucketUsers(actors, numWorkers) {
+		// if the tick randomly makes work all for one worker we want to be able to queue it all up without blocking + EOF signal.
+		// A tick has at most 2*opsPerTick+1 commands, as users migrating to replacement rooms are on top of opsPerTick.
+		workerCh := make(chan WorkerCommand, 2*opsPerTick+2)
+		// a result is sent back for every command, buffer them so workers don't block on each other
+		resultCh := make(chan CommandResult, 2*opsPerTick+2)
+		w := NewWorker(users, m.wsServer, workerCh, resultCh)
 		for _, u := range users {
 			m.userIDToWorker[u.UserID] = w
 			result = append(result, u.UserID)
@@ -194,78 +434,663 @@ func (m *Master) StartWorkers(numWorkers, opsPerTick int) []string {
 		m.workers = append(m.workers, w)
 		go w.Run()
 	}
-	log.Printf("Started %d workers", numWorkers)
-	if len(m.userIDToWorker) != len(m.users) {
-		log.Fatalf("not all users have workers: %d != %d", len(m.userIDToWorker), len(m.users))
+	log.Printf("Started %d workers for %d users", numWorkers, len(actors))
+	if len(m.userIDToWorker) != len(actors) {
+		log.Fatalf("not all users have workers: %d != %d", len(m.userIDToWorker), len(actors))
 	}
 	return result
 }
 
+// powerLevelContentOverride returns the power_level_content_override to use when creating rooms, or nil if
+// the server defaults should be used.
+func powerLevelContentOverride(cfg *config.Chaos, joinRule JoinRule, masterIDs, moderatorIDs []string) map[string]any {
+	override := make(map[string]any)
+	if cfg.Test.StateChurn.Probability > 0 || cfg.Test.PowerLevels.Probability > 0 {
+		override["events"] = powerLevelEvents(cfg)
+	}
+	if len(moderatorIDs) > 0 || joinRule == JoinRuleKnock || cfg.Test.PowerLevels.Probability > 0 {
+		// overriding "users" replaces the default of just the creator. All masters need power to
+		// reject knocks, which is done by kicking the knocking user, and to change power levels.
+		users := make(map[string]int)
+		for _, masterID := range masterIDs {
+			users[masterID] = 100
+		}
+		for _, moderatorID := range moderatorIDs {
+			users[moderatorID] = 50
+		}
+		override["users"] = users
+	}
+	if len(override) == 0 {
+		return nil
+	}
+	return override
+}
+
+// powerLevelEvents returns the "events" key for the room's power levels. Overriding "events" replaces the
+// server defaults entirely, so this includes the spec defaults for the public_chat preset as well as
+// letting any user send the state events used for state churn. When power levels churn, only promoted
+// users can change the topic.
+func powerLevelEvents(cfg *config.Chaos) map[string]int {
+	events := map[string]int{
+		"m.room.name":               0,
+		"m.room.topic":              0,
+		"m.room.power_levels":       100,
+		"m.room.history_visibility": 100,
+		"m.room.canonical_alias":    50,
+		"m.room.avatar":             50,
+		"m.room.tombstone":          100,
+		"m.room.server_acl":         100,
+		"m.room.encryption":         100,
+	}
+	if cfg.Test.StateChurn.CustomEventType != "" {
+		events[cfg.Test.StateChurn.CustomEventType] = 0
+	}
+	if cfg.Test.PowerLevels.Probability > 0 {
+		events["m.room.topic"] = PowerLevelPromoted
+	}
+	return events
+}
+
+// bucketUsers assigns users to numWorkers buckets. Users are sorted by user ID then round-robined
+// onto each bucket, so the same set of users always produces the same buckets.
+func bucketUsers(users []*CSAPI, numWorkers int) [][]*CSAPI {
+	sorted := slices.Clone(users)
+	slices.SortFunc(sorted, func(a, b *CSAPI) int {
+		return strings.Compare(a.UserID, b.UserID)
+	})
+	buckets := make([][]*CSAPI, numWorkers)
+	for i, u := range sorted {
+		buckets[i%numWorkers] = append(buckets[i%numWorkers], u)
+	}
+	return buckets
+}
+
+// RecordingHeader returns the header to use when recording this run.
+func (m *Master) RecordingHeader() RecordingHeader {
+	header := RecordingHeader{
+		Seed:    m.cfg.Test.Seed,
+		RoomIDs: slices.Clone(m.roomIDs),
+	}
+	for _, u := range m.users {
+		header.UserIDs = append(header.UserIDs, u.UserID)
+	}
+	for _, u := range m.moderators {
+		header.ModeratorIDs = append(header.ModeratorIDs, u.UserID)
+	}
+	for _, u := range m.masters {
+		header.MasterIDs = append(header.MasterIDs, u.UserID)
+	}
+	return header
+}
+
+// SetRecorder records every tick to the provided recorder when calling Start.
+func (m *Master) SetRecorder(recorder *Recorder) {
+	m.recorder = recorder
+}
+
+// SetInvariants sets extra invariants to check in every convergence check. Must be called before Start or Replay.
+func (m *Master) SetInvariants(invariants []Invariant) {
+	m.invariants = invariants
+}
+
+// SetFederationBlocked tells the state machine when federation is blocked by a netsplit, so it doesn't generate
+// commands which would fail because of it. isBlocked is only called between ticks, and the result is recorded
+// with the tick. Must be called before Start.
+func (m *Master) SetFederationBlocked(isBlocked func() bool) {
+	m.federationBlocked = isBlocked
+}
+
+// CurrentTick returns the tick number which is currently being executed, or the last tick
+// which was executed if we are between ticks.
+func (m *Master) CurrentTick() int {
+	return int(m.currentTick.Load())
+}
+
+// Start generating ticks from the state machine. Blocks forever.
 func (m *Master) Start(postTickFn func(tickIteration int)) {
-	userIDs := slices.Collect(maps.Keys(m.userIDToWorker))
-	stateMachine := NewStateMachine(m.cfg.Test.Seed, m.cfg.Test.OpsPerTick, m.cfg.Test.SendToLeaveProbability, userIDs, m.roomIDs)
+	stateMachine := m.newStateMachine()
+	for {
+		// a netsplit can start at any time, so only look at it between ticks
+		federationBlocked := m.federationBlocked != nil && m.federationBlocked()
+		stateMachine.SetFederationBlocked(federationBlocked)
+		cmds := stateMachine.Tick()
+		if m.recorder != nil {
+			if err := m.recorder.RecordTick(stateMachine.Index, cmds, federationBlocked); err != nil {
+				log.Fatalf("failed to record tick: %s", err)
+			}
+		}
+		dispatched := m.dispatch(stateMachine.Index, cmds)
+		if err := m.finishTick(stateMachine, cmds, dispatched); err != nil {
+			log.Fatalf("%s", err)
+		}
+		if postTickFn != nil {
+			postTickFn(stateMachine.Index)
+		}
+	}
+}
+
+// Replay the ticks in the recording instead of generating them from the state machine. Faults are passed to
+// faultFn and convergence checks to checkFn in the same order relative to ticks as they were recorded:
+// faults are injected whilst the tick they were recorded in is executing, and convergence checks are
+// requested just before the tick they were recorded in finishes. checkFn is told whether the check was a
+// partition check, rather than working it out again. Returns when the recording has been replayed, or if
+// the error budget is exceeded.
+func (m *Master) Replay(rec *Recording, faultFn func(req ws.RequestPayload), checkFn func(partitionCheck bool), postTickFn func(tickIteration int)) error {
+	translate, roomIDs, err := m.replayTranslator(rec.Header)
+	if err != nil {
+		return err
+	}
+	// replacement rooms in the recording for rooms which were not upgraded in this replay
+	notUpgraded := make(map[string]bool)
+	stateMachine := m.newStateMachine()
+	var inFlight []WorkerCommand
+	var dispatched map[*Worker][]int
+	// Upgrades are recorded whilst finishing the tick, before postTickFn is called, so postTickFn is only called
+	// once we know no more upgrades or convergence checks were recorded in the tick.
+	postTickPending := false
+	finishInFlight := func() error {
+		if dispatched == nil {
+			return nil
+		}
+		err := m.finishTick(stateMachine, inFlight, dispatched)
+		dispatched = nil
+		if err != nil {
+			return err
+		}
+		postTickPending = true
+		return nil
+	}
+	postTick := func() {
+		if postTickPending && postTickFn != nil {
+			postTickFn(stateMachine.Index)
+		}
+		postTickPending = false
+	}
+	for _, entry := range rec.Entries {
+		switch {
+		case entry.Fault != nil:
+			faultFn(*entry.Fault)
+		case entry.Convergence:
+			checkFn(entry.PartitionCheck)
+			if err := finishInFlight(); err != nil {
+				return err
+			}
+			if stateMachine.Index != entry.Tick {
+				// the tick this check was recorded in has no commands, so just check now.
+				postTick()
+				stateMachine.Index = entry.Tick
+				postTickPending = true
+			}
+			postTick()
+		case entry.Upgrade != nil:
+			if err := finishInFlight(); err != nil {
+				return err
+			}
+			replacementRoomID := stateMachine.GetRoomUpgrades()[roomIDs[entry.Upgrade.RoomID]]
+			if replacementRoomID == "" {
+				// e.g the upgrade was removed when shrinking
+				log.Printf("tick %d: %s was not upgraded, dropping commands in %s", entry.Tick, entry.Upgrade.RoomID, entry.Upgrade.ReplacementRoomID)
+				notUpgraded[entry.Upgrade.ReplacementRoomID] = true
+				continue
+			}
+			roomIDs[entry.Upgrade.ReplacementRoomID] = replacementRoomID
+		default:
+			if err := finishInFlight(); err != nil {
+				return err
+			}
+			postTick()
+			inFlight = nil
+			for _, cmd := range entry.Commands {
+				if notUpgraded[cmd.RoomID] {
+					continue
+				}
+				cmd, err = translate(cmd)
+				if err != nil {
+					return fmt.Errorf("tick %d: %s", entry.Tick, err)
+				}
+				if cmd.Action == ActionRedact {
+					// event IDs differ between runs, so use the event sent by the same command in this replay
+					cmd.EventID = stateMachine.RedactableEventID(cmd.UserID, cmd.RoomID, cmd.Redacts)
+					if cmd.EventID == "" {
+						// e.g sending the event was removed when shrinking
+						log.Printf("tick %d: event %s was not sent, dropping redaction", entry.Tick, cmd.Redacts)
+						continue
+					}
+				}
+				inFlight = append(inFlight, cmd)
+			}
+			stateMachine.Index = entry.Tick
+			dispatched = m.dispatch(stateMachine.Index, inFlight)
+		}
+	}
+	if err := finishInFlight(); err != nil {
+		return err
+	}
+	postTick()
+	return nil
+}
+
+// replayTranslator returns a function which maps commands in a recording onto the users and rooms in this run,
+// along with the mapping of rooms in the recording to rooms in this run. Replacement rooms must be added to the
+// mapping as rooms are upgraded.
+func (m *Master) replayTranslator(header RecordingHeader) (func(cmd WorkerCommand) (WorkerCommand, error), map[string]string, error) {
+	if len(header.UserIDs) != len(m.users) {
+		return nil, nil, fmt.Errorf("recording has %d users but %d were created", len(header.UserIDs), len(m.users))
+	}
+	if len(header.RoomIDs) != len(m.roomIDs) {
+		return nil, nil, fmt.Errorf("recording has %d rooms but %d were created", len(header.RoomIDs), len(m.roomIDs))
+	}
+	if len(header.ModeratorIDs) != len(m.moderators) {
+		return nil, nil, fmt.Errorf("recording has %d moderators but %d were created", len(header.ModeratorIDs), len(m.moderators))
+	}
+	if len(header.MasterIDs) != len(m.masters) {
+		return nil, nil, fmt.Errorf("recording has %d masters but %d were created", len(header.MasterIDs), len(m.masters))
+	}
+	userIDs := make(map[string]string, len(header.UserIDs)+len(header.ModeratorIDs)+len(header.MasterIDs))
+	for i, userID := range header.UserIDs {
+		userIDs[userID] = m.users[i].UserID
+	}
+	for i, moderatorID := range header.ModeratorIDs {
+		userIDs[moderatorID] = m.moderators[i].UserID
+	}
+	for i, masterID := range header.MasterIDs {
+		userIDs[masterID] = m.masters[i].UserID
+	}
+	roomIDs := make(map[string]string, len(header.RoomIDs))
+	for i, roomID := range header.RoomIDs {
+		roomIDs[roomID] = m.roomIDs[i]
+	}
+	return func(cmd WorkerCommand) (WorkerCommand, error) {
+		userID, ok := userIDs[cmd.UserID]
+		if !ok {
+			return cmd, fmt.Errorf("unknown user %s in recording", cmd.UserID)
+		}
+		roomID, ok := roomIDs[cmd.RoomID]
+		if !ok && cmd.RoomID != "" {
+			return cmd, fmt.Errorf("unknown room %s in recording", cmd.RoomID)
+		}
+		if cmd.Target != "" {
+			target, ok := userIDs[cmd.Target]
+			if !ok {
+				return cmd, fmt.Errorf("unknown target user %s in recording", cmd.Target)
+			}
+			cmd.Target = target
+		}
+		cmd.UserID = userID
+		cmd.RoomID = roomID
+		return cmd, nil
+	}, roomIDs, nil
+}
+
+func (m *Master) newStateMachine() *StateMachine {
+	var userIDs []string
+	for _, u := range m.users {
+		userIDs = append(userIDs, u.UserID)
+	}
+	// only moderators who are joined to every room can moderate
+	moderatorIDs := m.residents(m.moderators)
+	var masterIDs []string
+	for _, u := range m.masters {
+		masterIDs = append(masterIDs, u.UserID)
+	}
+	stateChurn := m.cfg.Test.StateChurn
+	stateMachine := NewStateMachine(
+		m.cfg.Test.Seed, m.cfg.Test.OpsPerTick, m.cfg.Test.SendToLeaveProbability, userIDs, slices.Clone(m.roomIDs),
+		WithStateChurn(stateChurn.Probability, stateChurn.CustomEventType, stateChurn.CustomStateKeys),
+		WithModeration(moderatorIDs, m.cfg.Test.Moderation.Probability),
+		// moderators can also accept and reject knocks, but masters are on every server
+		WithJoinRule(m.joinRule(), append(m.residents(m.masters), moderatorIDs...), m.cfg.Test.RejectInviteProbability),
+		WithKnockRejection(m.cfg.Test.RejectKnockProbability),
+		WithNonResidentServer(m.nonResident),
+		WithSpace(m.spaceID),
+		// a single editor means power level changes never clobber each other
+		WithPowerLevelChurn(masterIDs[0], m.cfg.Test.PowerLevels.Probability),
+		WithRoomUpgrades(m.residents(m.masters), m.cfg.Test.Upgrades.RoomVersion, m.cfg.Test.Upgrades.Probability),
+		WithProfileChurn(m.cfg.Test.ProfileChurn.Probability),
+		WithRedactions(m.cfg.Test.Redactions.Probability, m.cfg.Test.Redactions.StateEvents),
+	)
 	convMasters := make([]CSAPIConvergence, len(m.masters))
 	for i := range convMasters {
 		convMasters[i] = &m.masters[i]
 	}
+	var convOpts []ConvergenceOpt
+	if master := m.nonResidentMaster(); master != nil && !m.nonResidentJoined {
+		// it joins before the first convergence check, but partition checks can happen before then
+		convOpts = append(convOpts, WithUnjoinedMasters(master.UserID))
+	}
+	if m.cfg.Test.Convergence.FullState {
+		convOpts = append(convOpts, WithFullStateComparison())
+	}
+	if m.cfg.Test.Convergence.Timeline {
+		convOpts = append(convOpts, WithTimelineComparison())
+	}
+	if m.cfg.Test.Convergence.PollTimeoutSecs > 0 {
+		convOpts = append(convOpts, WithPolling(time.Duration(m.cfg.Test.Convergence.PollTimeoutSecs)*time.Second))
+	}
+	if m.cfg.Test.Convergence.StrictMembership {
+		var moderatorIDs []string
+		for _, moderator := range m.moderators {
+			moderatorIDs = append(moderatorIDs, moderator.UserID)
+		}
+		convOpts = append(convOpts, WithStrictMembership(moderatorIDs...))
+	}
+	users := make([]CSAPIConvergence, len(m.users))
+	for i := range users {
+		users[i] = &m.users[i]
+	}
+	if m.cfg.Test.Convergence.UserSync {
+		convOpts = append(convOpts, WithUserSyncViews(users))
+	}
+	if m.cfg.Test.Convergence.DerivedViews {
+		convOpts = append(convOpts, WithDerivedViewChecks(users))
+	}
+	if len(m.invariants) > 0 {
+		convOpts = append(convOpts, WithInvariants(m.invariants...))
+	}
+	convOpts = append(convOpts, WithReports(m.cfg.Test.Convergence.ReportDir, func(report *ws.PayloadConvergenceReport) {
+		m.wsServer.Send(report)
+	}))
 	m.convergence = NewConvergence(convMasters, m.roomIDs, stateMachine, func(wc ws.PayloadConvergence) {
 		m.wsServer.Send(&wc)
+	}, convOpts...)
+	// users haven't done anything yet, so their /sync sees everything from the start of the run
+	if err := m.convergence.StartUserSyncViews(); err != nil {
+		log.Fatalf("StartUserSyncViews: %s", err)
+	}
+	m.stateMachine = stateMachine
+	return stateMachine
+}
+
+// dispatch sends the commands for a tick to the workers, returning which commands went to which worker,
+// as workers send back results in the order they received commands.
+func (m *Master) dispatch(tick int, cmds []WorkerCommand) map[*Worker][]int {
+	m.currentTick.Store(int64(tick))
+	var joins, sends, leaves int = 0, 0, 0
+	dispatched := make(map[*Worker][]int)
+	for i, cmd := range cmds {
+		switch cmd.Action {
+		case ActionJoin:
+			joins++
+		case ActionLeave:
+			leaves++
+		case ActionSend:
+			sends++
+		}
+		w := m.userIDToWorker[cmd.UserID]
+		if w == nil {
+			log.Fatalf("unknown user %s", cmd.UserID)
+		}
+		dispatched[w] = append(dispatched[w], i)
+		w.Chan <- cmd
+	}
+	// send EOF action last so we know when workers are done
+	for _, w := range m.workers {
+		w.Chan <- WorkerCommand{
+			Action: ActionTickEOF,
+		}
+	}
+	m.wsServer.Send(&ws.PayloadTickGeneration{
+		Number: tick,
+		Joins:  joins,
+		Sends:  sends,
+		Leaves: leaves,
 	})
-	for {
-		var joins, sends, leaves int = 0, 0, 0
-		cmds := stateMachine.Tick()
-		for _, cmd := range cmds {
-			switch cmd.Action {
-			case ActionJoin:
-				joins++
-			case ActionLeave:
-				leaves++
-			case ActionSend:
-				sends++
+	return dispatched
+}
+
+// finishTick waits for the workers to execute the dispatched commands then applies the results to the
+// state machine. Returns an error if the error budget has been exceeded.
+func (m *Master) finishTick(stateMachine *StateMachine, cmds []WorkerCommand, dispatched map[*Worker][]int) error {
+	results := make([]CommandResult, len(cmds))
+	var budgetErr error
+	for _, w := range m.workers {
+		indexes := dispatched[w]
+		for res := range w.SignalChan {
+			if res.Err == ErrTickEOF {
+				// wait until we see EOF then go to the next worker
+				break
 			}
-			w := m.userIDToWorker[cmd.UserID]
-			if w == nil {
-				log.Fatalf("unknown user %s", cmd.UserID)
+			i := indexes[0]
+			indexes = indexes[1:]
+			results[i] = res
+			if res.Err != nil && cmds[i].Contested && ClassifyError(res.Err) == ErrorClass4xx {
+				// this is an expected outcome, which the state machine rolls back
+				log.Printf("%s %s %s was rejected as it was contested: %s", cmds[i].UserID, cmds[i].Action, cmds[i].RoomID, res.Err)
+			} else if res.Err != nil {
+				// This could be a CSAPI timeout and hence ephemeral. The state machine will roll back
+				// this command, so we only need to terminate if we've used up our error budget.
+				if err := m.recordError(cmds[i], res.Err); err != nil {
+					budgetErr = err
+				}
 			}
-			w.Chan <- cmd
 		}
-		// send EOF action last so we know when workers are done
-		for _, w := range m.workers {
-			w.Chan <- WorkerCommand{
-				Action: ActionTickEOF,
+	}
+	if budgetErr != nil {
+		return budgetErr
+	}
+	// we saw EOF from every worker, so update our internal state and go onto the next tick.
+	stateMachine.Apply(cmds, results)
+	m.resolveIndeterminate(stateMachine)
+	m.resolveIndeterminatePowerLevels(stateMachine)
+	for i, cmd := range cmds {
+		if cmd.Action == ActionUpgrade && results[i].Err == nil {
+			if err := m.roomUpgraded(cmd.UserID, cmd.RoomID, results[i].ReplacementRoomID); err != nil {
+				return err
 			}
 		}
-		m.wsServer.Send(&ws.PayloadTickGeneration{
-			Number: stateMachine.Index,
-			Joins:  joins,
-			Sends:  sends,
-			Leaves: leaves,
-		})
-		// wait for responses
-		for _, w := range m.workers {
-			for signalErr := range w.SignalChan {
-				if signalErr == ErrTickEOF {
-					// wait until we see EOF then go to the next worker
-					break
+	}
+	return m.resolveIndeterminateUpgrades(stateMachine)
+}
+
+// upgradeJoinTimeout is how long masters and moderators have to join a replacement room, between them.
+var upgradeJoinTimeout = 30 * time.Second
+
+// roomUpgraded joins the masters and moderators to the replacement room, as they must always be joined to
+// every room unless they are on the non-resident server and haven't joined yet, and records the upgrade so it
+// can be replayed. They join concurrently, and fail if they haven't all joined within upgradeJoinTimeout.
+func (m *Master) roomUpgraded(upgraderID, roomID, replacementRoomID string) error {
+	log.Printf("%s upgraded %s to %s", upgraderID, roomID, replacementRoomID)
+	_, domain, _ := strings.Cut(upgraderID, ":")
+	var actors []*CSAPI
+	for i := range m.masters {
+		actors = append(actors, &m.masters[i])
+	}
+	for i := range m.moderators {
+		actors = append(actors, &m.moderators[i])
+	}
+	// a netsplit may be in progress, so keep trying until it heals, but don't hold up the next tick for long
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeJoinTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(actors))
+	for i, actor := range actors {
+		if actor.UserID == upgraderID || !m.isResident(actor) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := actor.JoinRoom(replacementRoomID, []string{domain})
+				if err == nil {
+					actor.EnsureFullyJoined(replacementRoomID)
+					return
+				}
+				select {
+				case <-ctx.Done():
+					errs[i] = fmt.Errorf("%s failed to join replacement room %s : %s", actor.UserID, replacementRoomID, err)
+					return
+				case <-time.After(time.Second):
 				}
-				// otherwise we got a genuine error. This could be a CSAPI timeout and hence ephemeral
-				// but it breaks the state machine so we have to terminate. If we were cleverer, we could
-				// rollback the state transition.
-				log.Fatalf("worker returned an error, terminating: %s", signalErr)
 			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
-		// we either paniced or saw EOF from every worker, so update our internal state and go onto the next tick.
-		stateMachine.Apply(cmds)
-		if postTickFn != nil {
-			postTickFn(stateMachine.Index)
+	}
+	if m.recorder != nil {
+		if err := m.recorder.RecordUpgrade(m.CurrentTick(), roomID, replacementRoomID); err != nil {
+			return fmt.Errorf("failed to record upgrade: %s", err)
 		}
 	}
+	return nil
 }
 
-func (m *Master) CheckConverged(syncTimeoutDuration, bufferDuration time.Duration) error {
+// resolveIndeterminateUpgrades asks the upgrader's homeserver whether rooms which may or may not have
+// been upgraded have a tombstone. Like resolveIndeterminate, only upgrades from earlier ticks are resolved.
+func (m *Master) resolveIndeterminateUpgrades(stateMachine *StateMachine) error {
+	roomIDs, upgraderIDs := stateMachine.IndeterminateUpgrades(stateMachine.Index)
+	for i, roomID := range roomIDs {
+		master := m.masterOnServer(upgraderIDs[i])
+		if master == nil {
+			log.Printf("resolveIndeterminateUpgrades: no master on the same server as %s", upgraderIDs[i])
+			continue
+		}
+		stateEvents, err := master.State(roomID)
+		if err != nil {
+			log.Printf("resolveIndeterminateUpgrades: failed to get state in %s: %s", roomID, err)
+			continue
+		}
+		replacementRoomID := ""
+		for _, ev := range stateEvents {
+			if ev.Type == "m.room.tombstone" && ev.StateKey != nil && *ev.StateKey == "" {
+				replacementRoomID, _ = ev.Content["replacement_room"].(string)
+			}
+		}
+		if err := stateMachine.ResolveUpgrade(roomID, replacementRoomID); err != nil {
+			log.Printf("resolveIndeterminateUpgrades: %s", err)
+			continue
+		}
+		if replacementRoomID == "" {
+			log.Printf("resolveIndeterminateUpgrades: %s was not upgraded", roomID)
+			continue
+		}
+		if err := m.roomUpgraded(upgraderIDs[i], roomID, replacementRoomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordError counts a failed command, returning an error if the error budget has been exceeded.
+func (m *Master) recordError(cmd WorkerCommand, err error) error {
+	class := ClassifyError(err)
+	m.errorCounts[class]++
+	total := 0
+	for _, count := range m.errorCounts {
+		total += count
+	}
+	log.Printf("%s %s %s failed (%s), rolling back: %s", cmd.UserID, cmd.Action, cmd.RoomID, class, err)
+	if total > m.cfg.Test.ErrorBudget {
+		return fmt.Errorf(
+			"worker errors exceeded error budget of %d, terminating: timeout=%d 4xx=%d 5xx=%d other=%d",
+			m.cfg.Test.ErrorBudget, m.errorCounts[ErrorClassTimeout], m.errorCounts[ErrorClass4xx],
+			m.errorCounts[ErrorClass5xx], m.errorCounts[ErrorClassOther],
+		)
+	}
+	return nil
+}
+
+// resolveIndeterminate asks each user's homeserver what happened to commands with unknown outcomes.
+// We only resolve commands from earlier ticks to give the server a chance to finish processing them.
+// Contested commands are only resolved once a convergence check has confirmed every server agrees on their
+// outcome, so asking any one server is enough. Anything we fail to resolve will be retried at the end of the next tick.
+func (m *Master) resolveIndeterminate(stateMachine *StateMachine) {
+	for _, ur := range stateMachine.Indeterminate(stateMachine.Index) {
+		master := m.masterOnServer(ur.UserID)
+		if master != nil && !m.isResident(master) {
+			// their master isn't joined to the room, so ask the first master instead
+			master = &m.masters[0]
+		}
+		if master == nil {
+			log.Printf("resolveIndeterminate: no master on the same server as %s", ur.UserID)
+			continue
+		}
+		members, err := master.Members(ur.RoomID)
+		if err != nil {
+			log.Printf("resolveIndeterminate: failed to get members in %s for %s: %s", ur.RoomID, ur.UserID, err)
+			continue
+		}
+		membership := MembershipLeave
+		for _, ev := range members {
+			if ev.StateKey != nil && *ev.StateKey == ur.UserID {
+				membership = Membership(ev.Content["membership"].(string))
+			}
+		}
+		if err := stateMachine.Resolve(ur.UserID, ur.RoomID, membershipToState(membership)); err != nil {
+			log.Printf("resolveIndeterminate: %s", err)
+			continue
+		}
+		log.Printf("resolveIndeterminate: %s is '%s' in %s", ur.UserID, membership, ur.RoomID)
+	}
+}
+
+// resolveIndeterminatePowerLevels asks the power level editor's homeserver what happened to power level
+// changes with unknown outcomes. Like resolveIndeterminate, only changes from earlier ticks are resolved.
+func (m *Master) resolveIndeterminatePowerLevels(stateMachine *StateMachine) {
+	for _, ur := range stateMachine.IndeterminatePowerLevels(stateMachine.Index) {
+		content, err := m.masters[0].StateEvent(ur.RoomID, "m.room.power_levels", "")
+		if err != nil {
+			log.Printf("resolveIndeterminatePowerLevels: failed to get power levels in %s: %s", ur.RoomID, err)
+			continue
+		}
+		level := 0
+		users, _ := content["users"].(map[string]any)
+		if l, ok := users[ur.UserID].(float64); ok {
+			level = int(l)
+		}
+		if err := stateMachine.ResolvePowerLevel(ur.UserID, ur.RoomID, level); err != nil {
+			log.Printf("resolveIndeterminatePowerLevels: %s", err)
+			continue
+		}
+		log.Printf("resolveIndeterminatePowerLevels: %s has power level %d in %s", ur.UserID, level, ur.RoomID)
+	}
+}
+
+// masterOnServer returns the master on the same homeserver as the provided user ID.
+func (m *Master) masterOnServer(userID string) *CSAPI {
+	_, domain, _ := strings.Cut(userID, ":")
+	for i := range m.masters {
+		if m.masters[i].Domain == domain {
+			return &m.masters[i]
+		}
+	}
+	return nil
+}
+
+// Stop the workers. The Master cannot be used after this has been called.
+func (m *Master) Stop() {
+	for _, w := range m.workers {
+		close(w.Chan)
+	}
+	m.workers = nil
+}
+
+// CheckConverged checks that all servers have converged after any netsplit was healed at healedAt. When polling
+// for convergence, returns how long each server took to converge, keyed by server domain.
+func (m *Master) CheckConverged(syncTimeoutDuration, bufferDuration time.Duration, healedAt time.Time) (map[string]time.Duration, error) {
+	if err := m.joinNonResident(); err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), syncTimeoutDuration)
 	defer cancel()
-	return m.convergence.Assert(ctx, bufferDuration)
+	timeToConverge, err := m.convergence.AssertSince(ctx, bufferDuration, healedAt)
+	if err != nil {
+		return nil, err
+	}
+	// every server has now seen every command, which lets promoted users use their power
+	m.stateMachine.Synchronised()
+	return timeToConverge, nil
+}
+
+// CheckPartitions checks that every server is available and consistent with the state machine for everything
+// its own users did, whilst federation is still blocked by a netsplit. Unlike CheckConverged, the state machine
+// is not synchronised afterwards as servers have not seen each other's commands.
+func (m *Master) CheckPartitions() error {
+	return m.convergence.AssertPartitioned()
 }
 
 func (m *Master) registerUser(hsDomain, localpart, serverURL string, verbose bool) (CSAPI, error) {
@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/element-hq/chaos/config"
+	"github.com/element-hq/chaos/ws"
+)
+
+func TestBucketUsersIsDeterministic(t *testing.T) {
+	var users []*CSAPI
+	for i := 0; i < 7; i++ {
+		users = append(users, &CSAPI{UserID: fmt.Sprintf("@user-%d:hs%d", i, i%2)})
+	}
+	userIDsOf := func(buckets [][]*CSAPI) [][]string {
+		result := make([][]string, len(buckets))
+		for i, b := range buckets {
+			for _, u := range b {
+				result[i] = append(result[i], u.UserID)
+			}
+		}
+		return result
+	}
+	want := [][]string{
+		{"@user-0:hs0", "@user-3:hs1", "@user-6:hs0"},
+		{"@user-1:hs1", "@user-4:hs0"},
+		{"@user-2:hs0", "@user-5:hs1"},
+	}
+	if got := userIDsOf(bucketUsers(users, 3)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	// reversing the input order should not change the buckets
+	reversed := make([]*CSAPI, len(users))
+	for i := range users {
+		reversed[len(users)-1-i] = users[i]
+	}
+	if got := userIDsOf(bucketUsers(reversed, 3)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reversed: got %v want %v", got, want)
+	}
+	// a single worker gets everyone
+	if got := bucketUsers(users, 1); len(got) != 1 || len(got[0]) != len(users) {
+		t.Fatalf("single worker: got %v", userIDsOf(got))
+	}
+}
+
+func TestMasterLeavesOneServerOutOfKnockRooms(t *testing.T) {
+	cfg := &config.Chaos{}
+	cfg.Test.Seed = 1
+	cfg.Test.OpsPerTick = 10
+	cfg.Test.JoinRule = string(JoinRuleKnock)
+	cfg.Test.Moderation.Probability = 10
+	m := NewMaster(nil)
+	m.cfg = cfg
+	m.masters = []CSAPI{
+		{UserID: "@master:hs1", Domain: "hs1"},
+		{UserID: "@master:hs2", Domain: "hs2"},
+	}
+	m.moderators = []CSAPI{
+		{UserID: "@moderator-0:hs1", Domain: "hs1"},
+		{UserID: "@moderator-1:hs2", Domain: "hs2"},
+	}
+	for i := 0; i < 6; i++ {
+		domain := fmt.Sprintf("hs%d", i%2+1)
+		m.users = append(m.users, CSAPI{UserID: fmt.Sprintf("@user-%d:%s", i, domain), Domain: domain})
+	}
+	m.roomIDs = []string{"!a:hs1", "!b:hs1"}
+	m.nonResident = nonResidentDomain(m.joinRule(), m.masters)
+	sm := m.newStateMachine()
+
+	if got, want := m.residents(m.masters), []string{"@master:hs1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("resident masters: got %v want %v", got, want)
+	}
+	if got, want := sm.inviterIDs, []string{"@master:hs1", "@moderator-0:hs1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("inviters: got %v want %v", got, want)
+	}
+	if got, want := sm.moderatorIDs, []string{"@moderator-0:hs1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("moderators: got %v want %v", got, want)
+	}
+	// hs2 is still checked for convergence, but not until its master joins the rooms
+	if len(m.convergence.masters) != 2 {
+		t.Fatalf("convergence masters should include every master, got %d", len(m.convergence.masters))
+	}
+	if !m.convergence.unjoinedMasters["@master:hs2"] || m.convergence.unjoinedMasters["@master:hs1"] {
+		t.Fatalf("only the hs2 master should be unjoined, got %v", m.convergence.unjoinedMasters)
+	}
+	// users on hs2 must knock over federation, and only hs1 can accept or reject them
+	knocksFromHS2 := 0
+	for i := 0; i < 100; i++ {
+		cmds := sm.Tick()
+		for _, cmd := range cmds {
+			if cmd.Action == ActionKnock && strings.HasSuffix(cmd.UserID, ":hs2") {
+				knocksFromHS2++
+			}
+			if strings.HasSuffix(cmd.UserID, ":hs2") && cmd.Target != "" {
+				t.Fatalf("tick %d: %s acted on %s but isn't joined to the room", i, cmd.UserID, cmd.Target)
+			}
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	}
+	if knocksFromHS2 == 0 {
+		t.Fatalf("no users on hs2 knocked")
+	}
+
+	// whilst federation is blocked, hs2 users can't knock or respond to invites
+	sm = m.newStateMachine()
+	sm.SetFederationBlocked(true)
+	for i := 0; i < 100; i++ {
+		cmds := sm.Tick()
+		for _, cmd := range cmds {
+			if !strings.HasSuffix(cmd.UserID, ":hs2") {
+				continue
+			}
+			switch cmd.Action {
+			case ActionKnock, ActionJoin, ActionReject:
+				t.Fatalf("tick %d: %s did %s in %s during a netsplit", i, cmd.UserID, cmd.Action, cmd.RoomID)
+			}
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	}
+}
+
+func TestMasterJoinsNonResidentBeforeConvergence(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Header.Get("Authorization")+" "+req.Method+" "+req.URL.Path)
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	cfg := &config.Chaos{}
+	cfg.Test.Seed = 1
+	cfg.Test.JoinRule = string(JoinRuleKnock)
+	m := NewMaster(nil)
+	m.cfg = cfg
+	m.masters = []CSAPI{
+		{UserID: "@master:hs1", Domain: "hs1", AccessToken: "hs1", BaseURL: srv.URL, Client: srv.Client()},
+		{UserID: "@master:hs2", Domain: "hs2", AccessToken: "hs2", BaseURL: srv.URL, Client: srv.Client()},
+	}
+	m.users = []CSAPI{{UserID: "@user-0:hs2", Domain: "hs2"}}
+	m.roomIDs = []string{"!a:hs1"}
+	m.nonResident = nonResidentDomain(m.joinRule(), m.masters)
+	m.stateMachine = m.newStateMachine()
+	if m.stateMachine.nonResidentDomain != "hs2" {
+		t.Fatalf("hs2 should be non-resident, got %q", m.stateMachine.nonResidentDomain)
+	}
+
+	if err := m.joinNonResident(); err != nil {
+		t.Fatalf("joinNonResident: %s", err)
+	}
+	want := []string{
+		"Bearer hs1 POST /_matrix/client/v3/rooms/!a:hs1/invite",
+		"Bearer hs2 POST /_matrix/client/v3/join/!a:hs1",
+		"Bearer hs2 GET /_matrix/client/v3/rooms/!a:hs1/joined_members",
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Fatalf("got requests %v want %v", requests, want)
+	}
+	if len(m.convergence.unjoinedMasters) != 0 {
+		t.Fatalf("hs2 master should now be checked for convergence, got unjoined %v", m.convergence.unjoinedMasters)
+	}
+	if m.stateMachine.nonResidentDomain != "" {
+		t.Fatalf("hs2 should now be resident, got %q", m.stateMachine.nonResidentDomain)
+	}
+	if !m.isResident(&m.masters[1]) {
+		t.Fatalf("hs2 master should be resident once joined")
+	}
+
+	// joining again does nothing
+	requests = nil
+	if err := m.joinNonResident(); err != nil {
+		t.Fatalf("joinNonResident: %s", err)
+	}
+	if len(requests) != 0 {
+		t.Fatalf("joining again should do nothing, got %v", requests)
+	}
+}
+
+// newUpgradeTestMaster returns a master for a single room on hs1 with one master, two moderators and the given
+// users, whose requests are all handled by handler.
+func newUpgradeTestMaster(t *testing.T, opsPerTick int, numUsers int, handler http.HandlerFunc) *Master {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg := &config.Chaos{}
+	cfg.Test.Seed = 1
+	cfg.Test.OpsPerTick = opsPerTick
+	cfg.Test.Upgrades.RoomVersion = "11"
+	cfg.Test.Upgrades.Probability = 100
+	wsServer := ws.NewServer(cfg)
+	go wsServer.Start("127.0.0.1:0")
+	m := NewMaster(wsServer)
+	m.cfg = cfg
+	newUser := func(userID string) CSAPI {
+		return CSAPI{UserID: userID, Domain: "hs1", AccessToken: userID, BaseURL: srv.URL, Client: srv.Client()}
+	}
+	m.masters = []CSAPI{newUser("@master:hs1")}
+	m.moderators = []CSAPI{newUser("@moderator-0:hs1"), newUser("@moderator-1:hs1")}
+	for i := 0; i < numUsers; i++ {
+		m.users = append(m.users, newUser(fmt.Sprintf("@user-%d:hs1", i)))
+	}
+	m.roomIDs = []string{"!foo:hs1"}
+	return m
+}
+
+func TestMasterMigratesUsersAtCapacity(t *testing.T) {
+	var mu sync.Mutex
+	replacementJoins := make(map[string]int)
+	opsPerTick := 2
+	m := newUpgradeTestMaster(t, opsPerTick, 12, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/_matrix/client/v3/join/!new:hs1" {
+			mu.Lock()
+			replacementJoins[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]++
+			mu.Unlock()
+		}
+		w.Write([]byte(`{"event_id":"$event","replacement_room":"!new:hs1"}`))
+	})
+	// everyone is on the same worker, so a tick full of migrations must fit in its buffers. There are more users
+	// than fit in a single tick, so they must be migrated over several ticks.
+	m.StartWorkers(1, opsPerTick)
+	sm := m.newStateMachine()
+	for _, u := range m.users {
+		sm.setState(u.UserID, "!foo:hs1", StateJoined)
+	}
+	sm.Synchronised()
+
+	done := make(chan error)
+	maxCmds := 0
+	go func() {
+		for i := 0; i < 10; i++ {
+			cmds := sm.Tick()
+			maxCmds = max(maxCmds, len(cmds))
+			if err := m.finishTick(sm, cmds, m.dispatch(sm.Index, cmds)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("tick failed: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("ticks didn't finish, workers may have deadlocked")
+	}
+	if maxCmds <= opsPerTick+1 {
+		t.Fatalf("no tick had more than %d commands, so migrations were never at capacity", opsPerTick+1)
+	}
+	for _, actor := range append(m.users, m.moderators...) {
+		if replacementJoins[actor.UserID] == 0 {
+			t.Errorf("%s never joined the replacement room", actor.UserID)
+		}
+	}
+}
+
+func TestMasterReplacementRoomJoinsHaveADeadline(t *testing.T) {
+	defer func(timeout time.Duration) { upgradeJoinTimeout = timeout }(upgradeJoinTimeout)
+	upgradeJoinTimeout = 100 * time.Millisecond
+	var mu sync.Mutex
+	var joined []string
+	m := newUpgradeTestMaster(t, 1, 0, func(w http.ResponseWriter, req *http.Request) {
+		userID := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if strings.HasPrefix(req.URL.Path, "/_matrix/client/v3/join/") {
+			if userID == "@moderator-1:hs1" {
+				// e.g its server is on the other side of a netsplit which never heals
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			mu.Lock()
+			joined = append(joined, userID)
+			mu.Unlock()
+		}
+		w.Write([]byte(`{}`))
+	})
+	start := time.Now()
+	err := m.roomUpgraded("@master:hs1", "!foo:hs1", "!new:hs1")
+	if err == nil || !strings.Contains(err.Error(), "@moderator-1:hs1 failed to join replacement room !new:hs1") {
+		t.Fatalf("expected moderator-1 to fail to join, got %v", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("gave up joining after %s, want about %s", took, upgradeJoinTimeout)
+	}
+	if !reflect.DeepEqual(joined, []string{"@moderator-0:hs1"}) {
+		t.Fatalf("got joined %v want only moderator-0", joined)
+	}
+}
+
+func TestMasterReplayKeepsTheRecordedCheck(t *testing.T) {
+	m := newUpgradeTestMaster(t, 1, 1, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	rec := &Recording{
+		Header: RecordingHeader{
+			Seed:         1,
+			UserIDs:      []string{"@user-0:old"},
+			ModeratorIDs: []string{"@moderator-0:old", "@moderator-1:old"},
+			MasterIDs:    []string{"@master:old"},
+			RoomIDs:      []string{"!foo:old"},
+		},
+		Entries: []RecordingEntry{
+			{Tick: 1},
+			{Tick: 1, Convergence: true, PartitionCheck: true},
+			{Tick: 2},
+			{Tick: 2, Convergence: true},
+		},
+	}
+	var checks []string
+	err := m.Replay(rec, func(req ws.RequestPayload) {
+		t.Fatalf("unexpected fault %+v", req)
+	}, func(partitionCheck bool) {
+		checks = append(checks, fmt.Sprintf("tick %d partition=%v", m.CurrentTick(), partitionCheck))
+	}, nil)
+	if err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	want := []string{"tick 1 partition=true", "tick 2 partition=false"}
+	if !reflect.DeepEqual(checks, want) {
+		t.Fatalf("got checks %v want %v", checks, want)
+	}
+}
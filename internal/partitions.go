@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/element-hq/chaos/ws"
+)
+
+// GetMembershipActors returns who last changed the membership of every (user, room) pair, as
+// room ID => user ID => actor. The actor is the user themselves unless a moderator changed their membership.
+func (s *StateMachine) GetMembershipActors() map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	for ur, actorID := range s.membershipActors {
+		if result[ur.RoomID] == nil {
+			result[ur.RoomID] = make(map[string]string)
+		}
+		result[ur.RoomID][ur.UserID] = actorID
+	}
+	return result
+}
+
+// GetStateSenders returns who last sent every state event sent by the state machine.
+func (s *StateMachine) GetStateSenders() map[string]map[StateKeyTuple]string {
+	result := make(map[string]map[StateKeyTuple]string)
+	for roomID, senders := range s.stateSenders {
+		result[roomID] = make(map[StateKeyTuple]string)
+		for tuple, senderID := range senders {
+			result[roomID][tuple] = senderID
+		}
+	}
+	return result
+}
+
+// AssertPartitioned asserts that every server is available and consistent with the state machine whilst
+// federation is blocked. Every server is on its own side of the netsplit, so servers cannot be compared with
+// each other. Instead, each server must accept new events in every room, and must agree with the state machine
+// about everything its own users did last: their memberships, the state events they sent, their display names
+// and their messages. Anything last changed by a remote user may not have reached the server yet, so isn't checked.
+// Masters which haven't joined the rooms yet are skipped. See WithUnjoinedMasters.
+func (c *Convergence) AssertPartitioned() error {
+	c.updaterFn(ws.PayloadConvergence{
+		State: "checking partitions",
+	})
+	err := c.assertPartitioned()
+	if err != nil {
+		c.report([]error{err})
+	}
+	return err
+}
+
+func (c *Convergence) assertPartitioned() error {
+	roomStates := c.expectedRoomStates()
+	actors := c.sm.GetMembershipActors()
+	displayNames := c.sm.GetExpectedDisplayNames()
+	expectedRoomState := c.sm.GetExpectedRoomState()
+	senders := c.sm.GetStateSenders()
+	sentMessages := c.sm.GetSentMessages()
+	for _, master := range c.masters {
+		if c.unjoinedMasters[master.GetUserID()] {
+			// its server isn't in the rooms yet, so it has nothing to agree with
+			continue
+		}
+		isLocal := func(userID string) bool {
+			return domainOf(userID) == domainOf(master.GetUserID())
+		}
+		for _, roomID := range c.allRoomIDs() {
+			eventID, err := master.SendMessageWithText(roomID, "PARTITION CHECK")
+			if err != nil {
+				return fmt.Errorf("%s is unavailable whilst partitioned, failed to send in %s: %s", master.GetUserID(), roomID, err)
+			}
+			if _, err := master.Event(roomID, eventID); err != nil {
+				return fmt.Errorf("%s is unavailable whilst partitioned, failed to read back %s in %s: %s", master.GetUserID(), eventID, roomID, err)
+			}
+		}
+		localRoomStates := make(map[string]map[string][]State)
+		for roomID, wantRoomState := range roomStates {
+			for userID, states := range wantRoomState {
+				actorID, ok := actors[roomID][userID]
+				if !ok || !isLocal(actorID) {
+					continue
+				}
+				if localRoomStates[roomID] == nil {
+					localRoomStates[roomID] = make(map[string][]State)
+				}
+				localRoomStates[roomID][userID] = states
+			}
+		}
+		localDisplayNames := make(map[string][]string)
+		for userID, names := range displayNames {
+			if isLocal(userID) {
+				localDisplayNames[userID] = names
+			}
+		}
+		if _, err := c.assertMemberships(master, localRoomStates, localDisplayNames); err != nil {
+			return err
+		}
+		localRoomState := make(map[string]map[StateKeyTuple][]map[string]any)
+		for roomID, events := range expectedRoomState {
+			for tuple, contents := range events {
+				senderID, ok := senders[roomID][tuple]
+				if !ok || !isLocal(senderID) {
+					continue
+				}
+				if localRoomState[roomID] == nil {
+					localRoomState[roomID] = make(map[StateKeyTuple][]map[string]any)
+				}
+				localRoomState[roomID][tuple] = contents
+			}
+		}
+		// other servers can't be compared with, so nothing needs to be agreed
+		if err := c.assertRoomState(master, localRoomState, make(map[string]map[StateKeyTuple]string)); err != nil {
+			return err
+		}
+		var localMessages []SentMessage
+		for _, msg := range sentMessages {
+			if isLocal(msg.SenderID) {
+				localMessages = append(localMessages, msg)
+			}
+		}
+		if err := c.assertMessageDelivery(master, localMessages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// domainOf returns the server name of the given user ID.
+func domainOf(userID string) string {
+	_, domain, _ := strings.Cut(userID, ":")
+	return domain
+}
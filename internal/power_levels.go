@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+)
+
+// PowerLevelPromoted is the power level given to promoted users, which lets them kick users and change the topic.
+const PowerLevelPromoted = 50
+
+// powerLevelState tracks the power level of a (user, room) pair. Users without one have a power level of 0.
+type powerLevelState struct {
+	possible []int // the possible power levels. There is more than one if changing the power level timed out.
+	tick     int   // the tick which caused the power level to become indeterminate
+	// the epoch in which the power level last changed. Promoted users only use their power once every server
+	// has seen the promotion, which is only guaranteed after a convergence check.
+	changedEpoch int
+	// when the user last used their power. Users are not demoted in the same epoch after using their power.
+	privilegedEpoch int
+	privilegedTick  int
+}
+
+// powerLevelTick tracks power level changes and privileged actions within a single tick.
+type powerLevelTick struct {
+	levels     map[UserRoom]int   // the new power level of users whose power level changes this tick
+	demoted    map[UserRoom]bool  // users who are demoted this tick
+	privileged map[UserRoom][]int // command indexes of privileged actions this tick
+}
+
+func newPowerLevelTick() *powerLevelTick {
+	return &powerLevelTick{
+		levels:     make(map[UserRoom]int),
+		demoted:    make(map[UserRoom]bool),
+		privileged: make(map[UserRoom][]int),
+	}
+}
+
+// markContested marks privileged actions by users who are demoted in the same tick as contested. The demotion
+// and the privileged action may be executed in any order, so the privileged action may or may not be accepted.
+func (plt *powerLevelTick) markContested(cmds []WorkerCommand) {
+	for ur := range plt.demoted {
+		for _, i := range plt.privileged[ur] {
+			cmds[i].Contested = true
+		}
+	}
+}
+
+// WithPowerLevelChurn makes the editor promote users to PowerLevelPromoted and demote them back to 0 at the given
+// probability (0-100). The editor must have enough power to change power levels in every room. At the same
+// probability, promoted users kick joined users or change the topic instead of sending a message, so rooms must
+// require PowerLevelPromoted to change the topic. Users are only promoted and demoted, and only use their power,
+// once every server has seen their last promotion or demotion, which is signalled via Synchronised.
+func WithPowerLevelChurn(editorID string, probability int) StateMachineOpt {
+	return func(s *StateMachine) {
+		if probability < 0 || probability > 100 {
+			panic("power level churn probability must be between 0-100")
+		}
+		s.powerLevelEditorID = editorID
+		s.powerLevelChurnProbability = probability
+	}
+}
+
+// Synchronised tells the state machine that every server has seen every command applied so far e.g because a
+// convergence check passed. Messages sent prior to this have been seen by every server, so are forgotten.
+func (s *StateMachine) Synchronised() {
+	s.epoch++
+	s.synchronisedTick = s.Index
+	s.sentMessages = nil
+}
+
+// GetExpectedPowerLevels returns the possible power levels of every user whose power level has been changed
+// by the state machine, as room ID => user ID => possible power levels.
+func (s *StateMachine) GetExpectedPowerLevels() map[string]map[string][]int {
+	result := make(map[string]map[string][]int)
+	for ur, pl := range s.powerLevels {
+		if result[ur.RoomID] == nil {
+			result[ur.RoomID] = make(map[string][]int)
+		}
+		result[ur.RoomID][ur.UserID] = slices.Clone(pl.possible)
+	}
+	return result
+}
+
+// hasStablePowerLevel returns true if the user definitely has the given power level on every server, and it
+// is not being changed this tick.
+func (s *StateMachine) hasStablePowerLevel(ur UserRoom, level int, plt *powerLevelTick) bool {
+	if _, changing := plt.levels[ur]; changing {
+		return false
+	}
+	pl := s.powerLevels[ur]
+	if pl == nil {
+		return level == 0
+	}
+	return len(pl.possible) == 1 && pl.possible[0] == level && pl.changedEpoch < s.epoch
+}
+
+// powerLevelChurn returns a command for the editor to promote or demote a random user, or nil if a user
+// should act instead.
+func (s *StateMachine) powerLevelChurn(touchedBy map[UserRoom]string, plt *powerLevelTick) *WorkerCommand {
+	if s.powerLevelChurnProbability == 0 || s.random(100) >= s.powerLevelChurnProbability {
+		return nil
+	}
+	userID := s.userIDs[s.random(len(s.userIDs))]
+	roomID := s.roomIDs[s.random(len(s.roomIDs))]
+	if s.roomLocked(roomID) {
+		return nil
+	}
+	ur := UserRoom{UserID: userID, RoomID: roomID}
+	// Power levels don't affect what users do to themselves, but do affect whether others can kick or ban them.
+	if actor := touchedBy[ur]; actor != "" && actor != userID && actor != s.powerLevelEditorID {
+		return nil
+	}
+	if _, changing := plt.levels[ur]; changing {
+		return nil
+	}
+	pl := s.powerLevels[ur]
+	level := PowerLevelPromoted
+	if pl != nil {
+		if len(pl.possible) != 1 || pl.changedEpoch == s.epoch {
+			// wait until every server has seen the last change
+			return nil
+		}
+		if pl.possible[0] == PowerLevelPromoted {
+			// If the user used their power earlier in this epoch, servers may not have seen the privileged
+			// action yet e.g due to a netsplit, in which case they could see the demotion first and reject it.
+			if pl.privilegedEpoch == s.epoch && pl.privilegedTick < s.Index {
+				return nil
+			}
+			level = 0
+			plt.demoted[ur] = true
+		}
+	}
+	plt.levels[ur] = level
+	return &WorkerCommand{
+		Action:     ActionSetPowerLevel,
+		UserID:     s.powerLevelEditorID,
+		RoomID:     roomID,
+		Target:     userID,
+		PowerLevel: level,
+	}
+}
+
+// privilegedAction returns a command for a promoted user to kick a random user or change the topic, or nil
+// if they should do something else.
+func (s *StateMachine) privilegedAction(
+	userID, roomID string, workingCopy map[string]map[string]State, touchedState map[string]map[StateKeyTuple]bool,
+	touchedBy map[UserRoom]string, plt *powerLevelTick,
+) *WorkerCommand {
+	if s.powerLevelChurnProbability == 0 {
+		return nil
+	}
+	pl := s.powerLevels[UserRoom{UserID: userID, RoomID: roomID}]
+	// We deliberately ignore changes this tick, as demoting a user at the same time as they use their power
+	// is what we want to test.
+	if pl == nil || len(pl.possible) != 1 || pl.possible[0] != PowerLevelPromoted || pl.changedEpoch == s.epoch {
+		return nil
+	}
+	if s.random(100) >= s.powerLevelChurnProbability {
+		return nil
+	}
+	var cmd *WorkerCommand
+	if s.random(2) == 0 {
+		target := s.userIDs[s.random(len(s.userIDs))]
+		targetUR := UserRoom{UserID: target, RoomID: roomID}
+		if actor := touchedBy[targetUR]; target == userID || (actor != "" && actor != userID) {
+			return nil
+		}
+		switch workingCopy[target][roomID] {
+		case StateJoined, StateSend:
+		default:
+			return nil
+		}
+		// we can only kick users with less power than us
+		if !s.hasStablePowerLevel(targetUR, 0, plt) {
+			return nil
+		}
+		touchedBy[targetUR] = userID
+		workingCopy[target][roomID] = StateLeft
+		cmd = &WorkerCommand{
+			Action: ActionKick,
+			UserID: userID,
+			RoomID: roomID,
+			Target: target,
+			// like moderators, the kick races the target's last membership change if servers may not have seen it
+			Contested: !s.hasStableMembership(targetUR),
+		}
+	} else {
+		tuple := StateKeyTuple{Type: "m.room.topic"}
+		if touchedState[roomID][tuple] {
+			return nil
+		}
+		if touchedState[roomID] == nil {
+			touchedState[roomID] = make(map[StateKeyTuple]bool)
+		}
+		touchedState[roomID][tuple] = true
+		cmd = &WorkerCommand{
+			Action:    ActionSetTopic,
+			UserID:    userID,
+			RoomID:    roomID,
+			EventType: tuple.Type,
+			Content:   map[string]any{"topic": fmt.Sprintf("%s %s", adjectives[s.random(len(adjectives))], nouns[s.random(len(nouns))])},
+		}
+	}
+	pl.privilegedEpoch = s.epoch
+	pl.privilegedTick = s.Index
+	return cmd
+}
+
+// applyPowerLevel updates the expected power level of the target of a power level change.
+func (s *StateMachine) applyPowerLevel(cmd WorkerCommand, outcome commandOutcome) {
+	if outcome == outcomeFailed {
+		return
+	}
+	ur := UserRoom{UserID: cmd.Target, RoomID: cmd.RoomID}
+	pl := s.powerLevels[ur]
+	if pl == nil {
+		pl = &powerLevelState{possible: []int{0}}
+		s.powerLevels[ur] = pl
+	}
+	pl.changedEpoch = s.epoch
+	if outcome == outcomeApplied {
+		pl.possible = []int{cmd.PowerLevel}
+	} else if !slices.Contains(pl.possible, cmd.PowerLevel) {
+		pl.possible = append(pl.possible, cmd.PowerLevel)
+		pl.tick = s.Index
+	}
+}
+
+// IndeterminatePowerLevels returns all (user, room) pairs whose power level became indeterminate before the
+// given tick. Pairs are returned in a deterministic order.
+func (s *StateMachine) IndeterminatePowerLevels(beforeTick int) []UserRoom {
+	var result []UserRoom
+	for _, userID := range s.userIDs {
+		for _, roomID := range s.roomIDs {
+			ur := UserRoom{UserID: userID, RoomID: roomID}
+			if pl := s.powerLevels[ur]; pl != nil && len(pl.possible) > 1 && pl.tick < beforeTick {
+				result = append(result, ur)
+			}
+		}
+	}
+	return result
+}
+
+// ResolvePowerLevel resolves an indeterminate power level to the provided level, which must be one of the
+// possible levels.
+func (s *StateMachine) ResolvePowerLevel(userID, roomID string, level int) error {
+	pl := s.powerLevels[UserRoom{UserID: userID, RoomID: roomID}]
+	if pl == nil || len(pl.possible) < 2 {
+		return fmt.Errorf("power level of %s in room %s is not indeterminate", userID, roomID)
+	}
+	if !slices.Contains(pl.possible, level) {
+		return fmt.Errorf("power level of %s in room %s resolved to %d but possible levels are %v", userID, roomID, level, pl.possible)
+	}
+	pl.possible = []int{level}
+	return nil
+}
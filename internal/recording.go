@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/element-hq/chaos/ws"
+)
+
+// RecordingHeader is the first line of a recording. It contains the users, moderators, masters and rooms which were
+// created by the Master, in creation order, so they can be mapped onto freshly created users and
+// rooms when the recording is replayed.
+type RecordingHeader struct {
+	Seed         int64
+	UserIDs      []string
+	ModeratorIDs []string `json:",omitempty"`
+	MasterIDs    []string `json:",omitempty"`
+	RoomIDs      []string
+}
+
+// RecordingEntry is a single line in a recording. Entries are written in the order they happened.
+// If none of Fault, Convergence or Upgrade are set, the entry is the commands for the tick.
+type RecordingEntry struct {
+	Tick        int
+	Commands    []WorkerCommand    `json:",omitempty"`
+	Fault       *ws.RequestPayload `json:",omitempty"` // a netsplit or restart which was injected during this tick
+	Convergence bool               `json:",omitempty"` // a convergence check was performed at the end of this tick
+	Upgrade     *RoomUpgrade       `json:",omitempty"` // a room was upgraded at the end of this tick
+	// the convergence check left the netsplit in place and checked each side of it, instead of healing it
+	PartitionCheck bool `json:",omitempty"`
+	// federation was blocked when the commands for this tick were generated, so users were only invited by
+	// someone on their own server
+	FederationBlocked bool `json:",omitempty"`
+}
+
+// RoomUpgrade records the replacement room created when upgrading a room, so commands in the replacement
+// room can be mapped onto the replacement room created when replaying.
+type RoomUpgrade struct {
+	RoomID            string
+	ReplacementRoomID string
+}
+
+// Recording is a complete recording of a run, which can be replayed by the Master.
+type Recording struct {
+	Header  RecordingHeader
+	Entries []RecordingEntry
+}
+
+// ReadRecording reads a JSONL recording written by a Recorder.
+func ReadRecording(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadRecording: %s", err)
+	}
+	defer f.Close()
+	var rec Recording
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024) // ticks can be large
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line == 1 {
+			if err := json.Unmarshal(scanner.Bytes(), &rec.Header); err != nil {
+				return nil, fmt.Errorf("ReadRecording: failed to decode header: %s", err)
+			}
+			continue
+		}
+		var entry RecordingEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("ReadRecording: failed to decode line %d: %s", line, err)
+		}
+		rec.Entries = append(rec.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReadRecording: %s", err)
+	}
+	if line == 0 {
+		return nil, fmt.Errorf("ReadRecording: %s is empty", path)
+	}
+	return &rec, nil
+}
+
+// Write the recording to the provided path as JSONL, overwriting any existing file.
+func (r *Recording) Write(path string) error {
+	rec, err := NewRecorder(path, r.Header)
+	if err != nil {
+		return err
+	}
+	defer rec.Close()
+	for _, entry := range r.Entries {
+		if err := rec.write(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recorder writes ticks, faults and convergence checks to a JSONL file as they happen.
+// Safe to use from multiple goroutines.
+type Recorder struct {
+	mu  *sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewRecorder creates a new recording file at path with the provided header.
+func NewRecorder(path string, header RecordingHeader) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("NewRecorder: %s", err)
+	}
+	r := &Recorder{
+		mu:  &sync.Mutex{},
+		f:   f,
+		enc: json.NewEncoder(f),
+	}
+	if err := r.enc.Encode(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("NewRecorder: failed to write header: %s", err)
+	}
+	return r, nil
+}
+
+// RecordTick records the commands generated for a tick, before they are executed, and whether federation was
+// blocked when they were generated.
+func (r *Recorder) RecordTick(tick int, cmds []WorkerCommand, federationBlocked bool) error {
+	return r.write(RecordingEntry{
+		Tick:              tick,
+		Commands:          cmds,
+		FederationBlocked: federationBlocked,
+	})
+}
+
+// RecordFault records a netsplit or restart request which was injected during the tick.
+func (r *Recorder) RecordFault(tick int, req ws.RequestPayload) error {
+	return r.write(RecordingEntry{
+		Tick:  tick,
+		Fault: &req,
+	})
+}
+
+// RecordConvergence records that a convergence check was performed at the end of the tick.
+func (r *Recorder) RecordConvergence(tick int) error {
+	return r.write(RecordingEntry{
+		Tick:        tick,
+		Convergence: true,
+	})
+}
+
+// RecordPartitionCheck records that a convergence check was performed at the end of the tick whilst leaving the
+// netsplit in place, so the replay checks each side of the netsplit too.
+func (r *Recorder) RecordPartitionCheck(tick int) error {
+	return r.write(RecordingEntry{
+		Tick:           tick,
+		Convergence:    true,
+		PartitionCheck: true,
+	})
+}
+
+// RecordUpgrade records that the room was upgraded at the end of the tick.
+func (r *Recorder) RecordUpgrade(tick int, roomID, replacementRoomID string) error {
+	return r.write(RecordingEntry{
+		Tick: tick,
+		Upgrade: &RoomUpgrade{
+			RoomID:            roomID,
+			ReplacementRoomID: replacementRoomID,
+		},
+	})
+}
+
+func (r *Recorder) Close() error {
+	return r.f.Close()
+}
+
+func (r *Recorder) write(entry RecordingEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(entry); err != nil {
+		return fmt.Errorf("Recorder: failed to write tick %d: %s", entry.Tick, err)
+	}
+	return nil
+}
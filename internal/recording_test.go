@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/element-hq/chaos/ws"
+)
+
+func TestRecordingRoundTrips(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	header := RecordingHeader{
+		Seed:    42,
+		UserIDs: []string{userA, userB},
+		RoomIDs: []string{"!foo", "!bar"},
+	}
+	recorder, err := NewRecorder(path, header)
+	if err != nil {
+		t.Fatalf("NewRecorder: %s", err)
+	}
+	yes := true
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(recorder.RecordFault(0, ws.RequestPayload{Netsplit: &yes}))
+	must(recorder.RecordTick(1, []WorkerCommand{
+		{Action: ActionJoin, UserID: userA, RoomID: "!foo"},
+		{Action: ActionSend, UserID: userA, RoomID: "!foo", Body: "happy goose"},
+	}, true))
+	must(recorder.RecordFault(1, ws.RequestPayload{RestartServers: []string{"hs1"}}))
+	must(recorder.RecordTick(2, nil, false))
+	must(recorder.RecordConvergence(2))
+	must(recorder.RecordPartitionCheck(3))
+	must(recorder.Close())
+
+	rec, err := ReadRecording(path)
+	if err != nil {
+		t.Fatalf("ReadRecording: %s", err)
+	}
+	want := &Recording{
+		Header: header,
+		Entries: []RecordingEntry{
+			{Tick: 0, Fault: &ws.RequestPayload{Netsplit: &yes}},
+			{Tick: 1, Commands: []WorkerCommand{
+				{Action: ActionJoin, UserID: userA, RoomID: "!foo"},
+				{Action: ActionSend, UserID: userA, RoomID: "!foo", Body: "happy goose"},
+			}, FederationBlocked: true},
+			{Tick: 1, Fault: &ws.RequestPayload{RestartServers: []string{"hs1"}}},
+			{Tick: 2},
+			{Tick: 2, Convergence: true},
+			{Tick: 3, Convergence: true, PartitionCheck: true},
+		},
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatalf("got %+v\nwant %+v", rec, want)
+	}
+
+	// writing it back out should produce the same recording
+	path2 := filepath.Join(t.TempDir(), "recording2.jsonl")
+	must(rec.Write(path2))
+	rec2, err := ReadRecording(path2)
+	if err != nil {
+		t.Fatalf("ReadRecording: %s", err)
+	}
+	if !reflect.DeepEqual(rec2, want) {
+		t.Fatalf("got %+v\nwant %+v", rec2, want)
+	}
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+)
+
+// maxRedactableEvents is the number of events each (user, room) pair remembers for redaction. Older events
+// are forgotten so the state machine doesn't grow without bound.
+const maxRedactableEvents = 10
+
+// sentEvent is an event sent by the state machine which its sender can redact.
+type sentEvent struct {
+	key        string         // the EventKey of the command which sent the event
+	eventID    string         // the event ID the server returned
+	stateTuple *StateKeyTuple // nil for messages
+}
+
+// redaction is an event which the state machine redacted.
+type redaction struct {
+	roomID   string
+	definite bool // false if redacting the event timed out, so it may or may not be redacted
+}
+
+// WithRedactions makes joined users redact one of the last few events they sent in the room at the given
+// probability (0-100) instead of sending a message. Users only redact messages unless redactStateEvents is set,
+// in which case they also redact state events sent via state churn. Redacting the current value of a state event
+// strips its content, so nobody else can send that state event in the same tick.
+func WithRedactions(probability int, redactStateEvents bool) StateMachineOpt {
+	return func(s *StateMachine) {
+		if probability < 0 || probability > 100 {
+			panic("redaction probability must be between 0-100")
+		}
+		s.redactionProbability = probability
+		s.redactStateEvents = redactStateEvents
+	}
+}
+
+// GetExpectedRedactions returns every event redacted by the state machine, as room ID => event ID => definite.
+// Events which are not definitely redacted may or may not have been redacted, as redacting them timed out.
+func (s *StateMachine) GetExpectedRedactions() map[string]map[string]bool {
+	result := make(map[string]map[string]bool)
+	for eventID, r := range s.redactions {
+		if result[r.roomID] == nil {
+			result[r.roomID] = make(map[string]bool)
+		}
+		result[r.roomID][eventID] = r.definite
+	}
+	return result
+}
+
+// RedactableEventID returns the event ID of the event sent by the command with the given EventKey, or the
+// empty string if the user cannot redact it e.g because sending it failed.
+func (s *StateMachine) RedactableEventID(userID, roomID, key string) string {
+	for _, ev := range s.redactable[UserRoom{UserID: userID, RoomID: roomID}] {
+		if ev.key == key {
+			return ev.eventID
+		}
+	}
+	return ""
+}
+
+// assignEventKeys gives every command which sends an event a key which is unique to this run, so redactions
+// can refer to the event. Event IDs can't be used as they are only known once the command has been executed,
+// and differ when replaying.
+func (s *StateMachine) assignEventKeys(cmds []WorkerCommand) {
+	if s.redactionProbability == 0 {
+		return
+	}
+	for i, cmd := range cmds {
+		if cmd.Action == ActionSend || isStateChurn(cmd.Action) {
+			cmds[i].EventKey = fmt.Sprintf("%d.%d", s.Index, i)
+		}
+	}
+}
+
+// redact returns a command for the user to redact one of their events in the room, or nil if they should
+// do something else.
+func (s *StateMachine) redact(userID, roomID string, touchedState map[string]map[StateKeyTuple]bool, redacting map[string]bool) *WorkerCommand {
+	if s.redactionProbability == 0 || s.random(100) >= s.redactionProbability {
+		return nil
+	}
+	events := s.redactable[UserRoom{UserID: userID, RoomID: roomID}]
+	if len(events) == 0 {
+		return nil
+	}
+	ev := events[s.random(len(events))]
+	if redacting[ev.key] {
+		return nil
+	}
+	if ev.stateTuple != nil {
+		tuple := *ev.stateTuple
+		if len(s.roomState[roomID][tuple]) != 1 {
+			// we don't know whether this is the current state, so we don't know if redacting it changes the state
+			return nil
+		}
+		if s.currentStateKeys[roomID][tuple] == ev.key {
+			// redacting the current state strips its content, which races with anyone else sending it
+			if touchedState[roomID][tuple] {
+				return nil
+			}
+			if touchedState[roomID] == nil {
+				touchedState[roomID] = make(map[StateKeyTuple]bool)
+			}
+			touchedState[roomID][tuple] = true
+		}
+	}
+	redacting[ev.key] = true
+	return &WorkerCommand{
+		Action:  ActionRedact,
+		UserID:  userID,
+		RoomID:  roomID,
+		Redacts: ev.key,
+		EventID: ev.eventID,
+	}
+}
+
+// trackEvent remembers events which were sent successfully so they can be redacted later.
+func (s *StateMachine) trackEvent(cmd WorkerCommand, result CommandResult, outcome commandOutcome) {
+	if cmd.EventKey == "" || outcome != outcomeApplied || result.EventID == "" {
+		return
+	}
+	ev := &sentEvent{
+		key:     cmd.EventKey,
+		eventID: result.EventID,
+	}
+	if isStateChurn(cmd.Action) {
+		if !s.redactStateEvents {
+			return
+		}
+		ev.stateTuple = &StateKeyTuple{Type: cmd.EventType, StateKey: cmd.StateKey}
+	}
+	ur := UserRoom{UserID: cmd.UserID, RoomID: cmd.RoomID}
+	s.redactable[ur] = append(s.redactable[ur], ev)
+}
+
+// forgetOldEvents forgets all but the last few events sent in each room. This is done after applying the whole
+// tick, as events sent earlier in the tick may be redacted later in the tick.
+func (s *StateMachine) forgetOldEvents() {
+	for ur, events := range s.redactable {
+		if len(events) > maxRedactableEvents {
+			s.redactable[ur] = slices.Clone(events[len(events)-maxRedactableEvents:])
+		}
+	}
+}
+
+// applyRedaction updates the state machine after a redaction. Redacted events can't be redacted again, and
+// redacting the current value of a state event strips its content.
+func (s *StateMachine) applyRedaction(cmd WorkerCommand, outcome commandOutcome) {
+	if outcome == outcomeFailed {
+		return
+	}
+	ur := UserRoom{UserID: cmd.UserID, RoomID: cmd.RoomID}
+	events := s.redactable[ur]
+	i := slices.IndexFunc(events, func(ev *sentEvent) bool {
+		return ev.key == cmd.Redacts
+	})
+	if i == -1 {
+		return
+	}
+	ev := events[i]
+	s.redactable[ur] = slices.Delete(events, i, i+1)
+	s.redactions[ev.eventID] = &redaction{
+		roomID:   cmd.RoomID,
+		definite: outcome == outcomeApplied,
+	}
+	if ev.stateTuple == nil || s.currentStateKeys[cmd.RoomID][*ev.stateTuple] != ev.key {
+		return
+	}
+	// m.room.name, m.room.topic and custom state events have all of their content stripped
+	redacted := map[string]any{}
+	if outcome == outcomeApplied {
+		s.roomState[cmd.RoomID][*ev.stateTuple] = []map[string]any{redacted}
+		return
+	}
+	s.roomState[cmd.RoomID][*ev.stateTuple] = append(s.roomState[cmd.RoomID][*ev.stateTuple], redacted)
+	delete(s.currentStateKeys[cmd.RoomID], *ev.stateTuple)
+}
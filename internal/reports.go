@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/element-hq/chaos/ws"
+)
+
+// MismatchError is returned when a server's view of the members of a room doesn't match the state machine, with
+// a structured description of every mismatching user.
+type MismatchError struct {
+	Mismatches []ws.MembershipMismatch
+	errs       []string
+}
+
+func (e *MismatchError) Error() string {
+	return strings.Join(e.errs, "\n")
+}
+
+func (e *MismatchError) add(errStr string, mismatch ws.MembershipMismatch) {
+	e.errs = append(e.errs, errStr)
+	e.Mismatches = append(e.Mismatches, mismatch)
+}
+
+// newMembershipMismatch describes a user whose membership in the room, as seen by the master's server, is got
+// rather than one of wantStates or wantDisplayNames.
+func newMembershipMismatch(
+	master CSAPIConvergence, roomID, userID string, wantStates []State, got memberState, wantDisplayNames []string,
+	memberEvents map[string]Event,
+) ws.MembershipMismatch {
+	mismatch := ws.MembershipMismatch{
+		RoomID:           roomID,
+		Server:           domainOf(master.GetUserID()),
+		UserID:           userID,
+		GotMembership:    string(got.Membership),
+		WantDisplayNames: wantDisplayNames,
+		GotDisplayName:   got.DisplayName,
+	}
+	for _, state := range wantStates {
+		mismatch.WantStates = append(mismatch.WantStates, string(state))
+	}
+	if ev, ok := memberEvents[userID]; ok {
+		mismatch.EventID = ev.ID
+		mismatch.OriginServer = domainOf(ev.Sender)
+		mismatch.OriginServerTS = ev.Timestamp
+		if age, ok := ev.Unsigned["age"].(float64); ok {
+			mismatch.AgeMs = int64(age)
+		}
+	}
+	return mismatch
+}
+
+// WithReports makes failed convergence checks send a report of every membership mismatch to sendFn. If dir is
+// set, the report is also written to a JSON file in dir, so it can be archived or rendered later.
+func WithReports(dir string, sendFn func(*ws.PayloadConvergenceReport)) ConvergenceOpt {
+	return func(c *Convergence) {
+		c.reportDir = dir
+		c.reportFn = sendFn
+	}
+}
+
+// report sends a report of the membership mismatches in errs, which are the errors from a failed check. The
+// report is written to disk first if there is a report directory.
+func (c *Convergence) report(errs []error) {
+	if c.reportFn == nil {
+		return
+	}
+	checkedAt := time.Now()
+	payload := &ws.PayloadConvergenceReport{
+		CheckedAtMs: checkedAt.UnixMilli(),
+	}
+	var errStrs []string
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		errStrs = append(errStrs, err.Error())
+		var mismatchErr *MismatchError
+		if errors.As(err, &mismatchErr) {
+			payload.Mismatches = append(payload.Mismatches, mismatchErr.Mismatches...)
+		}
+	}
+	payload.Error = strings.Join(errStrs, "\n")
+	if c.reportDir != "" {
+		path, err := writeReport(c.reportDir, checkedAt, payload)
+		if err != nil {
+			payload.Error += fmt.Sprintf("\nfailed to write report: %s", err)
+		}
+		payload.Path = path
+	}
+	c.reportFn(payload)
+}
+
+// writeReport writes the report to a new JSON file in dir, returning its path.
+func writeReport(dir string, checkedAt time.Time, payload *ws.PayloadConvergenceReport) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create report directory %s: %s", dir, err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("convergence-%d.json", checkedAt.UnixMilli()))
+	b, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal report: %s", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write report %s: %s", path, err)
+	}
+	return path, nil
+}
@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+)
+
+// Shrink repeatedly removes parts of a failing recording, keeping any reduction for which stillFails returns true.
+// The recording is reduced in the following order, until no further reductions can be made:
+//   - truncating the recording after the earliest failing convergence check,
+//   - removing ticks,
+//   - removing faults,
+//   - removing convergence checks other than the last one,
+//   - removing all commands which involve a user,
+//   - removing all commands in a room.
+//
+// Users and rooms stay in the header even if no commands involve them, as replays map them onto fresh users
+// and rooms by creation order.
+//
+// The provided recording must fail. stillFails is typically expensive as it replays the recording against
+// real servers, so this uses delta debugging to minimise the number of calls made.
+func Shrink(rec *Recording, stillFails func(rec *Recording) (bool, error)) (*Recording, error) {
+	attempts := 0
+	test := func(candidate *Recording) (bool, error) {
+		attempts++
+		log.Printf("Shrink attempt %d: %s", attempts, candidate.Summary())
+		failed, err := stillFails(candidate)
+		if err != nil {
+			return false, err
+		}
+		if failed {
+			log.Printf("Shrink attempt %d: still fails", attempts)
+		}
+		return failed, nil
+	}
+
+	rec, err := truncateRecording(rec, test)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		before := rec.Summary()
+		// remove ticks
+		ticks, err := ddmin(rec.ticks(), func(ticks []int) (bool, error) {
+			return test(rec.filter(func(_ int, e RecordingEntry) bool {
+				return !e.isTick() || slices.Contains(ticks, e.Tick)
+			}, nil))
+		})
+		if err != nil {
+			return nil, err
+		}
+		rec = rec.filter(func(_ int, e RecordingEntry) bool {
+			return !e.isTick() || slices.Contains(ticks, e.Tick)
+		}, nil)
+		// remove faults
+		faults, err := ddmin(rec.faultIndexes(), func(faults []int) (bool, error) {
+			return test(rec.filter(func(i int, e RecordingEntry) bool {
+				return e.Fault == nil || slices.Contains(faults, i)
+			}, nil))
+		})
+		if err != nil {
+			return nil, err
+		}
+		rec = rec.filter(func(i int, e RecordingEntry) bool {
+			return e.Fault == nil || slices.Contains(faults, i)
+		}, nil)
+		// remove earlier convergence checks, which heal netsplits
+		checks, err := ddmin(rec.earlierCheckIndexes(), func(checks []int) (bool, error) {
+			return test(rec.filter(func(i int, e RecordingEntry) bool {
+				return !e.Convergence || i == len(rec.Entries)-1 || slices.Contains(checks, i)
+			}, nil))
+		})
+		if err != nil {
+			return nil, err
+		}
+		rec = rec.filter(func(i int, e RecordingEntry) bool {
+			return !e.Convergence || i == len(rec.Entries)-1 || slices.Contains(checks, i)
+		}, nil)
+		// remove users
+		userIDs, err := ddmin(rec.userIDs(), func(userIDs []string) (bool, error) {
+			return test(rec.filter(nil, func(cmd WorkerCommand) bool {
+				return involvesOnly(cmd, userIDs)
+			}))
+		})
+		if err != nil {
+			return nil, err
+		}
+		rec = rec.filter(nil, func(cmd WorkerCommand) bool {
+			return involvesOnly(cmd, userIDs)
+		})
+		// remove rooms
+		roomIDs, err := ddmin(rec.roomIDs(), func(roomIDs []string) (bool, error) {
+			return test(rec.filter(nil, func(cmd WorkerCommand) bool {
+				return cmd.RoomID == "" || slices.Contains(roomIDs, cmd.RoomID)
+			}))
+		})
+		if err != nil {
+			return nil, err
+		}
+		rec = rec.filter(nil, func(cmd WorkerCommand) bool {
+			return cmd.RoomID == "" || slices.Contains(roomIDs, cmd.RoomID)
+		})
+		if rec.Summary() == before {
+			break
+		}
+	}
+	log.Printf("Shrink finished after %d attempts: %s", attempts, rec.Summary())
+	return rec, nil
+}
+
+// Summary returns a human readable summary of the size of the recording.
+func (r *Recording) Summary() string {
+	numCmds := 0
+	for _, e := range r.Entries {
+		numCmds += len(e.Commands)
+	}
+	return fmt.Sprintf(
+		"ticks=%d commands=%d users=%d rooms=%d faults=%d checks=%d",
+		len(r.ticks()), numCmds, len(r.userIDs()), len(r.roomIDs()), len(r.faultIndexes()), len(r.earlierCheckIndexes())+1,
+	)
+}
+
+// truncateRecording removes everything after the earliest convergence check which still fails.
+// Assumes that if a check fails, all subsequent checks also fail, which lets us binary search.
+func truncateRecording(rec *Recording, test func(*Recording) (bool, error)) (*Recording, error) {
+	var checks []int // entry indexes
+	for i, e := range rec.Entries {
+		if e.Convergence {
+			checks = append(checks, i)
+		}
+	}
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("recording has no convergence checks")
+	}
+	truncated := func(checkIndex int) *Recording {
+		return &Recording{
+			Header:  rec.Header,
+			Entries: slices.Clone(rec.Entries[:checks[checkIndex]+1]),
+		}
+	}
+	// the last check must fail, as the whole recording fails. Find the first one that fails.
+	var searchErr error
+	firstFailing := sort.Search(len(checks)-1, func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+		failed, err := test(truncated(i))
+		if err != nil {
+			searchErr = err
+		}
+		return failed
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	return truncated(firstFailing), nil
+}
+
+// ddmin returns a subset of items for which test returns true, using the delta debugging algorithm.
+// Assumes that test(items) is true.
+func ddmin[T any](items []T, test func([]T) (bool, error)) ([]T, error) {
+	if len(items) == 0 {
+		return items, nil
+	}
+	// the classic algorithm never tests the empty set, but it is common for e.g all earlier
+	// convergence checks to be unnecessary.
+	ok, err := test(nil)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, nil
+	}
+	n := 2
+	for len(items) >= 2 {
+		chunkSize := (len(items) + n - 1) / n
+		reduced := false
+		for start := 0; start < len(items); start += chunkSize {
+			end := min(start+chunkSize, len(items))
+			complement := append(slices.Clone(items[:start]), items[end:]...)
+			ok, err := test(complement)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				items = complement
+				n = max(n-1, 2)
+				reduced = true
+				break
+			}
+		}
+		if !reduced {
+			if n >= len(items) {
+				break
+			}
+			n = min(n*2, len(items))
+		}
+	}
+	return items, nil
+}
+
+// filter returns a copy of the recording, keeping entries for which keepEntry returns true and commands
+// for which keepCmd returns true. Either function can be nil to keep everything. Ticks with no commands
+// are removed.
+func (r *Recording) filter(keepEntry func(i int, e RecordingEntry) bool, keepCmd func(cmd WorkerCommand) bool) *Recording {
+	result := &Recording{
+		Header: r.Header,
+	}
+	for i, e := range r.Entries {
+		if keepEntry != nil && !keepEntry(i, e) {
+			continue
+		}
+		if e.isTick() {
+			var cmds []WorkerCommand
+			for _, cmd := range e.Commands {
+				if keepCmd == nil || keepCmd(cmd) {
+					cmds = append(cmds, cmd)
+				}
+			}
+			if len(cmds) == 0 {
+				continue
+			}
+			e.Commands = cmds
+		}
+		result.Entries = append(result.Entries, e)
+	}
+	return result
+}
+
+func (e RecordingEntry) isTick() bool {
+	return e.Fault == nil && !e.Convergence && e.Upgrade == nil
+}
+
+func (r *Recording) ticks() []int {
+	var ticks []int
+	for _, e := range r.Entries {
+		if e.isTick() && len(e.Commands) > 0 {
+			ticks = append(ticks, e.Tick)
+		}
+	}
+	return ticks
+}
+
+func (r *Recording) faultIndexes() []int {
+	var indexes []int
+	for i, e := range r.Entries {
+		if e.Fault != nil {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// earlierCheckIndexes returns the entry indexes of all convergence checks apart from the last entry,
+// which is always the failing convergence check after truncation.
+func (r *Recording) earlierCheckIndexes() []int {
+	var indexes []int
+	for i, e := range r.Entries {
+		if e.Convergence && i != len(r.Entries)-1 {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// involvesOnly returns true if the command only involves the provided users.
+func involvesOnly(cmd WorkerCommand, userIDs []string) bool {
+	return slices.Contains(userIDs, cmd.UserID) && (cmd.Target == "" || slices.Contains(userIDs, cmd.Target))
+}
+
+func (r *Recording) userIDs() []string {
+	var userIDs []string
+	for _, e := range r.Entries {
+		for _, cmd := range e.Commands {
+			for _, userID := range []string{cmd.UserID, cmd.Target} {
+				if userID != "" && !slices.Contains(userIDs, userID) {
+					userIDs = append(userIDs, userID)
+				}
+			}
+		}
+	}
+	slices.Sort(userIDs)
+	return userIDs
+}
+
+func (r *Recording) roomIDs() []string {
+	var roomIDs []string
+	for _, e := range r.Entries {
+		for _, cmd := range e.Commands {
+			// e.g display name changes aren't in a room
+			if cmd.RoomID != "" && !slices.Contains(roomIDs, cmd.RoomID) {
+				roomIDs = append(roomIDs, cmd.RoomID)
+			}
+		}
+	}
+	slices.Sort(roomIDs)
+	return roomIDs
+}
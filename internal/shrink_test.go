@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/element-hq/chaos/ws"
+)
+
+func TestShrinkFindsMinimalRecording(t *testing.T) {
+	yes := true
+	no := false
+	sm := NewStateMachine(42, 10, 20, []string{userA, userB, userC, userD}, []string{"!foo", "!bar", "!baz"})
+	rec := &Recording{
+		Header: RecordingHeader{
+			Seed:    42,
+			UserIDs: []string{userA, userB, userC, userD},
+			RoomIDs: []string{"!foo", "!bar", "!baz"},
+		},
+	}
+	for tick := 1; tick <= 20; tick++ {
+		cmds := sm.Tick()
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+		rec.Entries = append(rec.Entries, RecordingEntry{Tick: tick, Commands: cmds})
+		if tick%4 == 0 {
+			rec.Entries = append(rec.Entries, RecordingEntry{Tick: tick, Fault: &ws.RequestPayload{Netsplit: &yes}})
+		}
+		if tick%4 == 2 {
+			rec.Entries = append(rec.Entries, RecordingEntry{Tick: tick, Fault: &ws.RequestPayload{Netsplit: &no}})
+		}
+		if tick%5 == 0 {
+			rec.Entries = append(rec.Entries, RecordingEntry{Tick: tick, Convergence: true})
+		}
+	}
+	// pick a command during the second netsplit to be the "bug"
+	var bug WorkerCommand
+	bugTick := 0
+	for _, e := range rec.Entries {
+		if e.isTick() && e.Tick == 9 {
+			bug = e.Commands[0]
+			bugTick = e.Tick
+			break
+		}
+	}
+	// the recording fails if the bug command is run whilst netsplit, and there is a convergence check afterwards.
+	stillFails := func(candidate *Recording) (bool, error) {
+		netsplit := false
+		sawBug := false
+		for _, e := range candidate.Entries {
+			if e.Fault != nil && e.Fault.Netsplit != nil {
+				netsplit = *e.Fault.Netsplit
+			}
+			if netsplit && e.Tick == bugTick && slices.ContainsFunc(e.Commands, func(cmd WorkerCommand) bool { return reflect.DeepEqual(cmd, bug) }) {
+				sawBug = true
+			}
+			if e.Convergence && sawBug {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if failed, _ := stillFails(rec); !failed {
+		t.Fatalf("test setup: recording does not fail")
+	}
+	got, err := Shrink(rec, stillFails)
+	if err != nil {
+		t.Fatalf("Shrink: %s", err)
+	}
+	if failed, _ := stillFails(got); !failed {
+		t.Fatalf("shrunk recording does not fail: %+v", got.Entries)
+	}
+	// we should have 1 netsplit, 1 tick with the bug command, and 1 convergence check.
+	want := []RecordingEntry{
+		{Tick: 8, Fault: &ws.RequestPayload{Netsplit: &yes}},
+		{Tick: bugTick, Commands: []WorkerCommand{bug}},
+		{Tick: 10, Convergence: true},
+	}
+	if len(got.Entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(got.Entries), len(want), got.Entries)
+	}
+	for i := range want {
+		if got.Entries[i].Tick != want[i].Tick || got.Entries[i].Convergence != want[i].Convergence ||
+			!reflect.DeepEqual(got.Entries[i].Commands, want[i].Commands) || (got.Entries[i].Fault == nil) != (want[i].Fault == nil) {
+			t.Errorf("entry %d: got %+v want %+v", i, got.Entries[i], want[i])
+		}
+	}
+	if got.Summary() != "ticks=1 commands=1 users=1 rooms=1 faults=1 checks=1" {
+		t.Errorf("unexpected summary: %s", got.Summary())
+	}
+}
@@ -1,8 +1,11 @@
 package internal
 
 import (
+	"encoding/json"
+	"fmt"
 	"math/rand"
 	"slices"
+	"strings"
 )
 
 type State string
@@ -12,19 +15,215 @@ var (
 	StateJoined State = "joined"
 	StateSend   State = "send"
 	StateLeft   State = "left"
+	StateBanned State = "banned"
+	// Invited users can join or reject the invite. Rejecting an invite is the same as leaving the room,
+	// but is tracked separately so we know it was a rejection.
+	StateInvited  State = "invited"
+	StateRejected State = "rejected"
+	// Knocking users are waiting for someone else to invite them (accept the knock) or kick them (reject the knock).
+	StateKnocking State = "knocking"
+	// The outcome of a command is unknown e.g because it timed out, so the server may or may not have
+	// applied it. The possible states are tracked separately until the state is resolved.
+	StateIndeterminate State = "indeterminate"
 )
 
+// SentMessage is a message which the server accepted, so every server should eventually have it.
+type SentMessage struct {
+	RoomID   string
+	EventID  string
+	SenderID string
+	Tick     int // the tick the message was sent in
+}
+
+// UserRoom identifies a (user, room) pair in the state machine.
+type UserRoom struct {
+	UserID string
+	RoomID string
+}
+
+// JoinRule is the join rule of the rooms in the state machine.
+type JoinRule string
+
+const (
+	JoinRulePublic JoinRule = "public"
+	JoinRuleInvite JoinRule = "invite"
+	JoinRuleKnock  JoinRule = "knock"
+	// Users must be joined to the space before they can join restricted rooms. See WithSpace.
+	JoinRuleRestricted JoinRule = "restricted"
+)
+
+// StateKeyTuple identifies a state event in a room.
+type StateKeyTuple struct {
+	Type     string
+	StateKey string
+}
+
+type indeterminateState struct {
+	possible []State // the possible states, collapsed so each one is distinct
+	tick     int     // the tick which caused the state to become indeterminate
+	// Servers may accept a contested command then reject it once they see the command which contests it, so
+	// contested pairs are only resolved once a convergence check has confirmed every server agrees on the outcome,
+	// after the epoch they became contested in.
+	contested      bool
+	contestedEpoch int
+}
+
 type StateMachine struct {
-	Index                  int
-	source                 rand.Source
-	opsPerTick             int
-	userIDs                []string
-	roomIDs                []string
-	userToRoomStates       map[string]map[string]State // user id => room id => state
-	sendToleaveProbability int                         // 0-100 chance of leaving instead of sending a message
+	Index                      int
+	source                     rand.Source
+	opsPerTick                 int
+	userIDs                    []string
+	roomIDs                    []string
+	userToRoomStates           map[string]map[string]State // user id => room id => state
+	sendToleaveProbability     int                         // 0-100 chance of leaving instead of sending a message
+	indeterminate              map[UserRoom]*indeterminateState
+	stateChurnProbability      int // 0-100 chance of sending a state event instead of a message
+	customEventType            string
+	customStateKeys            []string
+	moderatorIDs               []string
+	moderationProbability      int // 0-100 chance of a moderator kicking/banning/unbanning instead of a user acting
+	joinRule                   JoinRule
+	inviterIDs                 []string
+	rejectProbability          int // 0-100 chance of rejecting an invite instead of joining
+	rejectKnockProbability     int // 0-100 chance of an inviter rejecting a knock instead of accepting it
+	spaceID                    string
+	powerLevelEditorID         string
+	powerLevelChurnProbability int // 0-100 chance of changing a power level, or of a promoted user using their power
+	powerLevels                map[UserRoom]*powerLevelState
+	epoch                      int // incremented every time all servers are synchronised
+	synchronisedTick           int // the tick at the end of which all servers were last synchronised
+	upgraderIDs                []string
+	upgradeRoomVersion         string
+	upgradeProbability         int               // 0-100 chance of upgrading a room in the first tick after synchronising
+	upgradingRoomID            string            // the room being upgraded this tick, if any
+	upgrades                   map[string]string // room ID => replacement room ID
+	pendingUpgrades            map[string]*pendingUpgrade
+	migrating                  map[UserRoom]bool // users who need to join replacement rooms
+	profileChurnProbability    int               // 0-100 chance of a user changing their display name
+	// user ID => possible display names. There is more than one possible display name if setting it timed out.
+	// Users who have never set their display name are not present.
+	displayNames         map[string][]string
+	redactionProbability int  // 0-100 chance of redacting an event instead of sending a message
+	redactStateEvents    bool // whether state events can be redacted as well as messages
+	redactable           map[UserRoom][]*sentEvent
+	redactions           map[string]*redaction // event ID => redaction
+	// room ID => state event => the EventKey of the command which sent the current state, if known
+	currentStateKeys map[string]map[StateKeyTuple]string
+	// messages sent since all servers were last synchronised
+	sentMessages []SentMessage
+	// the user who last changed the membership of each (user, room) pair, which is the user themselves unless a
+	// moderator changed it. Only commands which the server may have applied are counted.
+	membershipActors map[UserRoom]string
+	// the epoch in which the membership of each (user, room) pair last changed, if the server may have applied it
+	membershipEpochs map[UserRoom]int
+	// room ID => state event => the user who last sent it, if the server may have applied it
+	stateSenders map[string]map[StateKeyTuple]string
+	// whether servers couldn't federate at the start of this tick e.g during a netsplit. See SetFederationBlocked.
+	federationBlocked bool
+	// the server which nobody other than test users is joined to rooms on, if any
+	nonResidentDomain string
+	// room ID => state event => possible contents. There is more than one possible content if sending
+	// the state event timed out. A nil content means the state event does not exist.
+	roomState map[string]map[StateKeyTuple][]map[string]any
+}
+
+// StateMachineOpt is a functional option which configures optional behaviour in the StateMachine.
+type StateMachineOpt func(s *StateMachine)
+
+// WithStateChurn makes joined users send m.room.name, m.room.topic or custom state events instead of messages
+// at the given probability (0-100). Custom state events are only sent if customEventType is set, and use
+// one of the provided state keys, or the empty state key if none are provided.
+func WithStateChurn(probability int, customEventType string, customStateKeys []string) StateMachineOpt {
+	return func(s *StateMachine) {
+		if probability < 0 || probability > 100 {
+			panic("state churn probability must be between 0-100")
+		}
+		s.stateChurnProbability = probability
+		s.customEventType = customEventType
+		s.customStateKeys = customStateKeys
+		if len(s.customStateKeys) == 0 {
+			s.customStateKeys = []string{""}
+		}
+	}
+}
+
+// WithModeration makes the provided moderators kick, ban and unban users at the given probability (0-100).
+// Moderators must have sufficient power in every room to do so, and must always be joined to every room.
+func WithModeration(moderatorIDs []string, probability int) StateMachineOpt {
+	return func(s *StateMachine) {
+		if probability < 0 || probability > 100 {
+			panic("moderation probability must be between 0-100")
+		}
+		s.moderatorIDs = slices.Clone(moderatorIDs)
+		slices.Sort(s.moderatorIDs)
+		s.moderationProbability = probability
+	}
+}
+
+// WithJoinRule sets the join rule of all rooms. For invite-only rooms, users must be invited by one of the
+// inviters before they can join, and reject invites at the given probability (0-100). For knock rooms, users
+// knock and then one of the inviters accepts or rejects the knock. Inviters are picked from a different server
+// to the user where possible, must always be joined to every room, and need enough power to kick users.
+func WithJoinRule(joinRule JoinRule, inviterIDs []string, rejectProbability int) StateMachineOpt {
+	return func(s *StateMachine) {
+		if rejectProbability < 0 || rejectProbability > 100 {
+			panic("reject probability must be between 0-100")
+		}
+		s.joinRule = joinRule
+		s.inviterIDs = slices.Clone(inviterIDs)
+		slices.Sort(s.inviterIDs)
+		s.rejectProbability = rejectProbability
+	}
 }
 
-func NewStateMachine(seed int64, opsPerTick, sendToleaveProbability int, userIDs []string, roomIDs []string) *StateMachine {
+// WithKnockRejection makes inviters reject knocks at the given probability (0-100) instead of accepting them.
+func WithKnockRejection(probability int) StateMachineOpt {
+	return func(s *StateMachine) {
+		if probability < 0 || probability > 100 {
+			panic("knock rejection probability must be between 0-100")
+		}
+		s.rejectKnockProbability = probability
+	}
+}
+
+// WithNonResidentServer tells the state machine that nobody other than test users on the given server is joined to
+// the rooms, so its users knock, join and reject invites over federation. They don't do so whilst federation is
+// blocked, and there must be inviters on other servers to accept their knocks.
+func WithNonResidentServer(domain string) StateMachineOpt {
+	return func(s *StateMachine) {
+		s.nonResidentDomain = domain
+	}
+}
+
+// SetResident tells the state machine that someone other than test users on the non-resident server is now joined
+// to every room, so its users no longer need federation to change their membership. See WithNonResidentServer.
+func (s *StateMachine) SetResident(domain string) {
+	if s.nonResidentDomain == domain {
+		s.nonResidentDomain = ""
+	}
+}
+
+// WithProfileChurn makes users change their display name at the given probability (0-100) instead of doing
+// something in a room. Changing the display name updates the user's member event in every room they are joined to,
+// so nobody else can affect the user in any room in the same tick.
+func WithProfileChurn(probability int) StateMachineOpt {
+	return func(s *StateMachine) {
+		if probability < 0 || probability > 100 {
+			panic("profile churn probability must be between 0-100")
+		}
+		s.profileChurnProbability = probability
+	}
+}
+
+// WithSpace sets the space for restricted rooms. The space must be one of the rooms, and is public regardless
+// of the join rule. Users join and leave the space like any other room, including whilst joined to rooms in it.
+func WithSpace(spaceID string) StateMachineOpt {
+	return func(s *StateMachine) {
+		s.spaceID = spaceID
+	}
+}
+
+func NewStateMachine(seed int64, opsPerTick, sendToleaveProbability int, userIDs []string, roomIDs []string, opts ...StateMachineOpt) *StateMachine {
 	userToRoomStates := make(map[string]map[string]State)
 	for _, u := range userIDs {
 		userToRoomStates[u] = make(map[string]State)
@@ -39,14 +238,32 @@ func NewStateMachine(seed int64, opsPerTick, sendToleaveProbability int, userIDs
 	// ensure we get deterministic execution orders, we'll index into these arrays
 	slices.Sort(userIDs)
 	slices.Sort(roomIDs)
-	return &StateMachine{
+	sm := &StateMachine{
 		source:                 rand.NewSource(seed),
 		opsPerTick:             opsPerTick,
 		userToRoomStates:       userToRoomStates,
 		userIDs:                userIDs,
 		roomIDs:                roomIDs,
 		sendToleaveProbability: sendToleaveProbability,
+		indeterminate:          make(map[UserRoom]*indeterminateState),
+		roomState:              make(map[string]map[StateKeyTuple][]map[string]any),
+		joinRule:               JoinRulePublic,
+		powerLevels:            make(map[UserRoom]*powerLevelState),
+		upgrades:               make(map[string]string),
+		pendingUpgrades:        make(map[string]*pendingUpgrade),
+		migrating:              make(map[UserRoom]bool),
+		displayNames:           make(map[string][]string),
+		redactable:             make(map[UserRoom][]*sentEvent),
+		redactions:             make(map[string]*redaction),
+		currentStateKeys:       make(map[string]map[StateKeyTuple]string),
+		membershipActors:       make(map[UserRoom]string),
+		membershipEpochs:       make(map[UserRoom]int),
+		stateSenders:           make(map[string]map[StateKeyTuple]string),
+	}
+	for _, opt := range opts {
+		opt(sm)
 	}
+	return sm
 }
 
 func (s *StateMachine) Tick() []WorkerCommand {
@@ -56,17 +273,103 @@ func (s *StateMachine) Tick() []WorkerCommand {
 	// copy the current state so we can mutate it as we make commands.
 	// This allows us to queue up commands for the same (user, room) sensibly.
 	workingCopy := s.copyInternalState()
+	// State events sent in the same tick may be sent concurrently by different workers, so we wouldn't know
+	// which one is the latest. Only allow each state event to be sent once per tick.
+	touchedState := make(map[string]map[StateKeyTuple]bool) // room ID => state event
+	// Likewise, commands from different users which affect the same (user, room) may be executed concurrently
+	// e.g a moderator bans a user whilst they join. Only one user can affect each (user, room) per tick.
+	touchedBy := make(map[UserRoom]string)
+	plt := newPowerLevelTick()
+	redacting := make(map[string]bool) // event keys being redacted this tick
 
+	if cmd := s.upgrade(workingCopy); cmd != nil {
+		cmds = append(cmds, *cmd)
+	}
+	cmds = append(cmds, s.migrate(workingCopy, touchedBy)...)
 	for i := 0; i < s.opsPerTick; i++ {
+		if cmd := s.moderate(workingCopy, touchedBy, plt); cmd != nil {
+			cmds = append(cmds, *cmd)
+			continue
+		}
+		if cmd := s.powerLevelChurn(touchedBy, plt); cmd != nil {
+			cmds = append(cmds, *cmd)
+			continue
+		}
 		// pick a random user
 		userID := s.userIDs[s.random(len(s.userIDs))]
 		// pick a random room
 		roomID := s.roomIDs[s.random(len(s.roomIDs))]
+		if s.roomLocked(roomID) {
+			continue
+		}
+		ur := UserRoom{UserID: userID, RoomID: roomID}
+		actor := touchedBy[ur]
+		if actor != "" && actor != userID {
+			continue
+		}
+		if cmd := s.profileChurn(userID, workingCopy, touchedBy); cmd != nil {
+			cmds = append(cmds, *cmd)
+			continue
+		}
+		touchedBy[ur] = userID
 		// modify the state
 		switch workingCopy[userID][roomID] {
-		case StateStart:
-			fallthrough
-		case StateLeft:
+		case StateStart, StateLeft, StateRejected:
+			joinRule := s.joinRuleFor(roomID)
+			if joinRule == JoinRuleInvite {
+				// someone else needs to invite us, which they can't do if we've already done something this tick
+				if actor != "" {
+					continue
+				}
+				inviterID := s.inviterFor(userID)
+				if inviterID == "" {
+					continue
+				}
+				touchedBy[ur] = inviterID
+				cmds = append(cmds, WorkerCommand{
+					Action: ActionInvite,
+					UserID: inviterID,
+					RoomID: roomID,
+					Target: userID,
+				})
+				workingCopy[userID][roomID] = StateInvited
+				continue
+			}
+			if joinRule == JoinRuleKnock {
+				if s.needsFederation(userID) {
+					continue
+				}
+				cmds = append(cmds, WorkerCommand{
+					Action: ActionKnock,
+					UserID: userID,
+					RoomID: roomID,
+				})
+				workingCopy[userID][roomID] = StateKnocking
+				continue
+			}
+			if joinRule == JoinRuleRestricted {
+				spaceUR := UserRoom{UserID: userID, RoomID: s.spaceID}
+				if spaceActor := touchedBy[spaceUR]; spaceActor != "" && spaceActor != userID {
+					continue
+				}
+				// The server checks our space membership when we join, so nobody else can change it this tick.
+				touchedBy[spaceUR] = userID
+				switch workingCopy[userID][s.spaceID] {
+				case StateJoined, StateSend:
+				case StateStart, StateLeft, StateRejected:
+					// we need to be in the space first, so join that instead
+					cmds = append(cmds, WorkerCommand{
+						Action: ActionJoin,
+						UserID: userID,
+						RoomID: s.spaceID,
+					})
+					workingCopy[userID][s.spaceID] = StateJoined
+					continue
+				default:
+					// e.g banned from the space, so we can't join
+					continue
+				}
+			}
 			// the only valid state transition is to join, so do it
 			cmds = append(cmds, WorkerCommand{
 				Action: ActionJoin,
@@ -74,6 +377,54 @@ func (s *StateMachine) Tick() []WorkerCommand {
 				RoomID: roomID,
 			})
 			workingCopy[userID][roomID] = StateJoined
+		case StateKnocking:
+			// someone else needs to accept or reject the knock, which they can't do if we've knocked this tick
+			if actor != "" {
+				continue
+			}
+			inviterID := s.inviterFor(userID)
+			if inviterID == "" {
+				continue
+			}
+			touchedBy[ur] = inviterID
+			// moderators can't kick promoted users, so accept their knock instead
+			if s.random(100) < s.rejectKnockProbability && s.hasStablePowerLevel(ur, 0, plt) {
+				cmds = append(cmds, WorkerCommand{
+					Action: ActionKick,
+					UserID: inviterID,
+					RoomID: roomID,
+					Target: userID,
+				})
+				workingCopy[userID][roomID] = StateLeft
+			} else {
+				cmds = append(cmds, WorkerCommand{
+					Action: ActionInvite,
+					UserID: inviterID,
+					RoomID: roomID,
+					Target: userID,
+				})
+				workingCopy[userID][roomID] = StateInvited
+			}
+		case StateInvited:
+			if s.needsFederation(userID) {
+				continue
+			}
+			// either accept or reject the invite
+			if s.random(100) < s.rejectProbability {
+				cmds = append(cmds, WorkerCommand{
+					Action: ActionReject,
+					UserID: userID,
+					RoomID: roomID,
+				})
+				workingCopy[userID][roomID] = StateRejected
+			} else {
+				cmds = append(cmds, WorkerCommand{
+					Action: ActionJoin,
+					UserID: userID,
+					RoomID: roomID,
+				})
+				workingCopy[userID][roomID] = StateJoined
+			}
 		case StateJoined:
 			fallthrough
 		case StateSend:
@@ -86,23 +437,440 @@ func (s *StateMachine) Tick() []WorkerCommand {
 					RoomID: roomID,
 				})
 				workingCopy[userID][roomID] = StateLeft
+			} else if cmd := s.privilegedAction(userID, roomID, workingCopy, touchedState, touchedBy, plt); cmd != nil {
+				plt.privileged[ur] = append(plt.privileged[ur], len(cmds))
+				cmds = append(cmds, *cmd)
+			} else if cmd := s.redact(userID, roomID, touchedState, redacting); cmd != nil {
+				cmds = append(cmds, *cmd)
+			} else if cmd := s.stateChurn(userID, roomID, touchedState); cmd != nil {
+				// sending state doesn't change our membership
+				cmds = append(cmds, *cmd)
 			} else {
+				// pick the message body here rather than in the worker so it is deterministic
 				cmds = append(cmds, WorkerCommand{
 					Action: ActionSend,
 					UserID: userID,
 					RoomID: roomID,
+					Body:   fmt.Sprintf("%s %s", adjectives[s.random(len(adjectives))], nouns[s.random(len(nouns))]),
 				})
 				workingCopy[userID][roomID] = StateSend
 			}
+		case StateBanned:
+			// we can't do anything until a moderator unbans us.
+		case StateIndeterminate:
+			// we don't know what state we're in, so we can't do anything until it is resolved.
 		}
 	}
+	plt.markContested(cmds)
+	s.assignEventKeys(cmds)
 	return cmds
 }
 
-func (s *StateMachine) Apply(cmds []WorkerCommand) {
-	for _, cmd := range cmds {
-		s.userToRoomStates[cmd.UserID][cmd.RoomID] = actionToState(cmd.Action)
+// joinRuleFor returns the join rule for the provided room.
+func (s *StateMachine) joinRuleFor(roomID string) JoinRule {
+	if roomID == s.spaceID {
+		return JoinRulePublic
+	}
+	return s.joinRule
+}
+
+// inviterFor returns a random inviter on a different server to the provided user, so invites go over federation.
+// If all inviters are on the same server as the user, returns any inviter. Whilst federation is blocked, only
+// returns inviters on the same server as the user, or "" if there are none.
+func (s *StateMachine) inviterFor(userID string) string {
+	_, domain, _ := strings.Cut(userID, ":")
+	var remote, local []string
+	for _, inviterID := range s.inviterIDs {
+		if _, inviterDomain, _ := strings.Cut(inviterID, ":"); inviterDomain != domain {
+			remote = append(remote, inviterID)
+		} else {
+			local = append(local, inviterID)
+		}
+	}
+	candidates := remote
+	if len(candidates) == 0 || s.federationBlocked {
+		candidates = local
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[s.random(len(candidates))]
+}
+
+// SetFederationBlocked tells the state machine whether servers can federate e.g during a netsplit, so it avoids
+// commands which need federation as they would fail. Invites and knocks are then only accepted or rejected by
+// inviters on the same server as the user. This must only be called between ticks, so the commands for a tick
+// are decided by the state at the start of it rather than by when a netsplit happens to start mid-tick.
+func (s *StateMachine) SetFederationBlocked(blocked bool) {
+	s.federationBlocked = blocked
+}
+
+// needsFederation returns true if the user's own server isn't in the room, so changing their membership would fail
+// whilst federation is blocked.
+func (s *StateMachine) needsFederation(userID string) bool {
+	return s.nonResidentDomain != "" && domainOf(userID) == s.nonResidentDomain && s.federationBlocked
+}
+
+// moderate returns a command for a random moderator to kick, ban or unban a random user, or nil if a user
+// should act instead.
+func (s *StateMachine) moderate(workingCopy map[string]map[string]State, touchedBy map[UserRoom]string, plt *powerLevelTick) *WorkerCommand {
+	if len(s.moderatorIDs) == 0 || s.random(100) >= s.moderationProbability {
+		return nil
+	}
+	moderatorID := s.moderatorIDs[s.random(len(s.moderatorIDs))]
+	target := s.userIDs[s.random(len(s.userIDs))]
+	roomID := s.roomIDs[s.random(len(s.roomIDs))]
+	if s.roomLocked(roomID) {
+		return nil
+	}
+	ur := UserRoom{UserID: target, RoomID: roomID}
+	if actor := touchedBy[ur]; actor != "" && actor != moderatorID {
+		return nil
+	}
+	// we can only moderate users with less power than us
+	if !s.hasStablePowerLevel(ur, 0, plt) {
+		return nil
+	}
+	var action Action
+	switch workingCopy[target][roomID] {
+	case StateJoined, StateSend, StateInvited, StateKnocking:
+		// kicking an invited user revokes the invite, kicking a knocking user rejects the knock
+		action = ActionKick
+		if s.random(2) == 0 {
+			action = ActionBan
+		}
+	case StateStart, StateLeft, StateRejected:
+		action = ActionBan
+	case StateBanned:
+		action = ActionUnban
+	default:
+		return nil
+	}
+	touchedBy[ur] = moderatorID
+	workingCopy[target][roomID] = actionToState(action)
+	return &WorkerCommand{
+		Action: action,
+		UserID: moderatorID,
+		RoomID: roomID,
+		Target: target,
+		// Kicks and bans are power events, so state resolution applies them before any membership change they are
+		// concurrent with e.g a join on the other side of a netsplit, which is then re-authorised on top of them.
+		// If servers may not have seen the target's last membership change, either outcome is possible.
+		Contested: !s.hasStableMembership(ur),
+	}
+}
+
+// hasStableMembership returns true if every server has seen the last change to the membership of the (user, room)
+// pair, as it changed before the servers were last synchronised.
+func (s *StateMachine) hasStableMembership(ur UserRoom) bool {
+	epoch, changed := s.membershipEpochs[ur]
+	return !changed || epoch < s.epoch
+}
+
+// Apply the commands from the last Tick to the internal state. results[i] is the outcome of cmds[i].
+// Commands which failed are dropped, leaving the state as it was prior to the command. Commands which
+// timed out may or may not have been applied by the server, so the state becomes indeterminate. Likewise
+// contested commands may or may not have been accepted, even if the request succeeded.
+func (s *StateMachine) Apply(cmds []WorkerCommand, results []CommandResult) {
+	for i, cmd := range cmds {
+		outcome := outcomeOf(cmd, results[i].Err)
+		s.trackEvent(cmd, results[i], outcome)
+		if isStateChurn(cmd.Action) {
+			s.applyStateChurn(cmd, outcome)
+			continue
+		}
+		if cmd.Action == ActionSetPowerLevel {
+			s.applyPowerLevel(cmd, outcome)
+			continue
+		}
+		if cmd.Action == ActionUpgrade {
+			s.applyUpgrade(cmd, results[i], outcome)
+			continue
+		}
+		if cmd.Action == ActionSetDisplayName {
+			s.applyDisplayName(cmd, outcome)
+			continue
+		}
+		if cmd.Action == ActionRedact {
+			s.applyRedaction(cmd, outcome)
+			continue
+		}
+		// moderators change the state of the target user, not themselves
+		userID := cmd.UserID
+		if cmd.Target != "" {
+			userID = cmd.Target
+		}
+		if cmd.Action == ActionSend && outcome == outcomeApplied {
+			s.sentMessages = append(s.sentMessages, SentMessage{
+				RoomID:   cmd.RoomID,
+				EventID:  results[i].EventID,
+				SenderID: cmd.UserID,
+				Tick:     s.Index,
+			})
+		}
+		switch outcome {
+		case outcomeApplied:
+			s.setState(userID, cmd.RoomID, actionToState(cmd.Action))
+		case outcomeIndeterminate:
+			s.addPossibleState(userID, cmd.RoomID, actionToState(cmd.Action), cmd.Contested)
+		}
+		if outcome != outcomeFailed {
+			ur := UserRoom{UserID: userID, RoomID: cmd.RoomID}
+			s.membershipActors[ur] = cmd.UserID
+			if cmd.Action != ActionSend {
+				s.membershipEpochs[ur] = s.epoch
+			}
+		}
+	}
+	s.forgetOldEvents()
+}
+
+// Indeterminate returns all (user, room) pairs which became indeterminate before the given tick.
+// Pairs are returned in a deterministic order.
+func (s *StateMachine) Indeterminate(beforeTick int) []UserRoom {
+	var result []UserRoom
+	for _, userID := range s.userIDs {
+		for _, roomID := range s.roomIDs {
+			ur := UserRoom{UserID: userID, RoomID: roomID}
+			if is := s.indeterminate[ur]; is != nil && is.tick < beforeTick && (!is.contested || is.contestedEpoch < s.epoch) {
+				result = append(result, ur)
+			}
+		}
+	}
+	return result
+}
+
+// Resolve an indeterminate (user, room) pair to the provided state, which must be one of the possible states.
+func (s *StateMachine) Resolve(userID, roomID string, state State) error {
+	is := s.indeterminate[UserRoom{UserID: userID, RoomID: roomID}]
+	if is == nil {
+		return fmt.Errorf("user %s in room %s is not indeterminate", userID, roomID)
+	}
+	for _, possible := range is.possible {
+		if collapseState(possible) == collapseState(state) {
+			s.setState(userID, roomID, possible)
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s in room %s resolved to '%s' but possible states are %v", userID, roomID, state, is.possible)
+}
+
+// GetIndeterminateStates returns the possible states for all indeterminate (user, room) pairs.
+func (s *StateMachine) GetIndeterminateStates() map[string]map[string][]State {
+	result := make(map[string]map[string][]State)
+	for ur, is := range s.indeterminate {
+		if result[ur.UserID] == nil {
+			result[ur.UserID] = make(map[string][]State)
+		}
+		result[ur.UserID][ur.RoomID] = slices.Clone(is.possible)
 	}
+	return result
+}
+
+// GetExpectedRoomState returns the possible contents for every state event sent by the state machine.
+func (s *StateMachine) GetExpectedRoomState() map[string]map[StateKeyTuple][]map[string]any {
+	result := make(map[string]map[StateKeyTuple][]map[string]any)
+	for roomID, events := range s.roomState {
+		result[roomID] = make(map[StateKeyTuple][]map[string]any)
+		for tuple, possible := range events {
+			result[roomID][tuple] = slices.Clone(possible)
+		}
+	}
+	return result
+}
+
+// stateChurn returns a command to send a random state event, or nil if we should send a message instead.
+func (s *StateMachine) stateChurn(userID, roomID string, touchedState map[string]map[StateKeyTuple]bool) *WorkerCommand {
+	if s.stateChurnProbability == 0 || s.random(100) >= s.stateChurnProbability {
+		return nil
+	}
+	value := fmt.Sprintf("%s %s", adjectives[s.random(len(adjectives))], nouns[s.random(len(nouns))])
+	actions := []Action{ActionSetName}
+	if s.powerLevelChurnProbability == 0 {
+		// otherwise only promoted users can change the topic
+		actions = append(actions, ActionSetTopic)
+	}
+	if s.customEventType != "" {
+		actions = append(actions, ActionSetState)
+	}
+	var cmd WorkerCommand
+	switch actions[s.random(len(actions))] {
+	case ActionSetName:
+		cmd = WorkerCommand{
+			Action:    ActionSetName,
+			EventType: "m.room.name",
+			Content:   map[string]any{"name": value},
+		}
+	case ActionSetTopic:
+		cmd = WorkerCommand{
+			Action:    ActionSetTopic,
+			EventType: "m.room.topic",
+			Content:   map[string]any{"topic": value},
+		}
+	case ActionSetState:
+		cmd = WorkerCommand{
+			Action:    ActionSetState,
+			EventType: s.customEventType,
+			StateKey:  s.customStateKeys[s.random(len(s.customStateKeys))],
+			Content:   map[string]any{"value": value},
+		}
+	}
+	tuple := StateKeyTuple{Type: cmd.EventType, StateKey: cmd.StateKey}
+	if touchedState[roomID][tuple] {
+		return nil
+	}
+	if touchedState[roomID] == nil {
+		touchedState[roomID] = make(map[StateKeyTuple]bool)
+	}
+	touchedState[roomID][tuple] = true
+	cmd.UserID = userID
+	cmd.RoomID = roomID
+	return &cmd
+}
+
+// profileChurn returns a command for the user to change their display name, or nil if they should do something
+// in a room instead.
+func (s *StateMachine) profileChurn(userID string, workingCopy map[string]map[string]State, touchedBy map[UserRoom]string) *WorkerCommand {
+	if s.profileChurnProbability == 0 || s.random(100) >= s.profileChurnProbability {
+		return nil
+	}
+	displayName := fmt.Sprintf("%s %s", adjectives[s.random(len(adjectives))], nouns[s.random(len(nouns))])
+	for _, roomID := range s.roomIDs {
+		ur := UserRoom{UserID: userID, RoomID: roomID}
+		if actor := touchedBy[ur]; actor != "" && actor != userID {
+			return nil
+		}
+		// if we don't know whether we're joined, we don't know whether the member event will be updated
+		if workingCopy[userID][roomID] == StateIndeterminate {
+			return nil
+		}
+	}
+	for _, roomID := range s.roomIDs {
+		touchedBy[UserRoom{UserID: userID, RoomID: roomID}] = userID
+	}
+	return &WorkerCommand{
+		Action:      ActionSetDisplayName,
+		UserID:      userID,
+		DisplayName: displayName,
+	}
+}
+
+// applyDisplayName updates the expected display name of the user. If we don't know the display name prior to a
+// display name change which timed out, we stop checking it until it is set successfully.
+func (s *StateMachine) applyDisplayName(cmd WorkerCommand, outcome commandOutcome) {
+	switch outcome {
+	case outcomeApplied:
+		s.displayNames[cmd.UserID] = []string{cmd.DisplayName}
+	case outcomeIndeterminate:
+		if possible, ok := s.displayNames[cmd.UserID]; ok && !slices.Contains(possible, cmd.DisplayName) {
+			s.displayNames[cmd.UserID] = append(possible, cmd.DisplayName)
+		}
+	}
+}
+
+// GetSentMessages returns the messages sent since all servers were last synchronised, in the order they were sent.
+func (s *StateMachine) GetSentMessages() []SentMessage {
+	return slices.Clone(s.sentMessages)
+}
+
+// GetExpectedDisplayNames returns the possible display names of every user who has set their display name.
+func (s *StateMachine) GetExpectedDisplayNames() map[string][]string {
+	result := make(map[string][]string, len(s.displayNames))
+	for userID, possible := range s.displayNames {
+		result[userID] = slices.Clone(possible)
+	}
+	return result
+}
+
+// applyStateChurn updates the expected room state for a state event which was sent. Failed state events
+// are dropped. State events with indeterminate outcomes may or may not have been applied, so both are possible.
+func (s *StateMachine) applyStateChurn(cmd WorkerCommand, outcome commandOutcome) {
+	tuple := StateKeyTuple{Type: cmd.EventType, StateKey: cmd.StateKey}
+	if s.roomState[cmd.RoomID] == nil {
+		s.roomState[cmd.RoomID] = make(map[StateKeyTuple][]map[string]any)
+	}
+	possible, exists := s.roomState[cmd.RoomID][tuple]
+	if !exists {
+		possible = []map[string]any{nil}
+	}
+	if outcome != outcomeFailed {
+		if s.stateSenders[cmd.RoomID] == nil {
+			s.stateSenders[cmd.RoomID] = make(map[StateKeyTuple]string)
+		}
+		s.stateSenders[cmd.RoomID][tuple] = cmd.UserID
+	}
+	switch outcome {
+	case outcomeApplied:
+		s.roomState[cmd.RoomID][tuple] = []map[string]any{cmd.Content}
+		if s.currentStateKeys[cmd.RoomID] == nil {
+			s.currentStateKeys[cmd.RoomID] = make(map[StateKeyTuple]string)
+		}
+		s.currentStateKeys[cmd.RoomID][tuple] = cmd.EventKey
+		return
+	case outcomeFailed:
+		return
+	}
+	delete(s.currentStateKeys[cmd.RoomID], tuple)
+	for _, content := range possible {
+		if normaliseContent(content) == normaliseContent(cmd.Content) {
+			return
+		}
+	}
+	s.roomState[cmd.RoomID][tuple] = append(possible, cmd.Content)
+}
+
+type commandOutcome int
+
+const (
+	outcomeFailed        commandOutcome = iota // the server did not apply the command
+	outcomeApplied                             // the server applied the command
+	outcomeIndeterminate                       // the server may or may not have applied the command
+)
+
+// outcomeOf returns the outcome of a command given the error from executing it. Contested commands which
+// succeed may still be rejected when servers see the command which contests them, whereas failing is
+// always a possibility for them, so rejecting them is not indeterminate.
+func outcomeOf(cmd WorkerCommand, err error) commandOutcome {
+	switch {
+	case err == nil && cmd.Contested:
+		return outcomeIndeterminate
+	case err == nil:
+		return outcomeApplied
+	case ClassifyError(err) == ErrorClassTimeout:
+		return outcomeIndeterminate
+	}
+	return outcomeFailed
+}
+
+func (s *StateMachine) setState(userID, roomID string, state State) {
+	s.userToRoomStates[userID][roomID] = state
+	delete(s.indeterminate, UserRoom{UserID: userID, RoomID: roomID})
+}
+
+// addPossibleState records that the (user, room) pair may be in the provided state, or may be in the
+// state it was already in. Contested pairs are not resolved until servers have synchronised.
+func (s *StateMachine) addPossibleState(userID, roomID string, state State, contested bool) {
+	ur := UserRoom{UserID: userID, RoomID: roomID}
+	is := s.indeterminate[ur]
+	if is == nil {
+		is = &indeterminateState{
+			possible: []State{s.userToRoomStates[userID][roomID]},
+		}
+	}
+	is.tick = s.Index
+	if contested {
+		is.contested = true
+		is.contestedEpoch = s.epoch
+	}
+	for _, possible := range is.possible {
+		if collapseState(possible) == collapseState(state) {
+			// e.g sending a message timed out, which doesn't change the membership
+			return
+		}
+	}
+	is.possible = append(is.possible, state)
+	s.indeterminate[ur] = is
+	s.userToRoomStates[userID][roomID] = StateIndeterminate
 }
 
 func (s *StateMachine) GetInternalState() map[string]map[string]State {
@@ -130,10 +898,43 @@ func actionToState(a Action) State {
 	switch a {
 	case ActionJoin:
 		return StateJoined
-	case ActionLeave:
+	case ActionLeave, ActionKick, ActionUnban:
 		return StateLeft
 	case ActionSend:
 		return StateSend
+	case ActionBan:
+		return StateBanned
+	case ActionInvite:
+		return StateInvited
+	case ActionReject:
+		return StateRejected
+	case ActionKnock:
+		return StateKnocking
 	}
 	panic("unreachable")
 }
+
+func isStateChurn(a Action) bool {
+	return a == ActionSetName || a == ActionSetTopic || a == ActionSetState
+}
+
+// normaliseContent returns a canonical form of event content so it can be compared.
+// A nil content is used to represent a state event which does not exist.
+func normaliseContent(content map[string]any) string {
+	b, err := json.Marshal(content) // map keys are sorted
+	if err != nil {
+		panic("normaliseContent: " + err.Error())
+	}
+	return string(b)
+}
+
+// collapseState collapses states to those which can be seen on the server.
+func collapseState(s State) State {
+	switch s {
+	case StateSend:
+		return StateJoined
+	case StateStart, StateRejected:
+		return StateLeft
+	}
+	return s
+}
@@ -1,8 +1,11 @@
 package internal
 
 import (
+	"fmt"
+	"net/http"
 	"reflect"
 	"slices"
+	"strings"
 	"testing"
 )
 
@@ -26,21 +29,797 @@ func TestStateMachineOnlyDoesValidTransitions(t *testing.T) {
 			}
 			workingCopy[cmd.UserID][cmd.RoomID] = actionToState(cmd.Action)
 		}
-		sm.Apply(cmds)
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
 	}
 }
 
 func TestStateMachineIsDeterministic(t *testing.T) {
 	sm := NewStateMachine(42, 4, 10, []string{"alice", "bob"}, []string{"!foo", "!bar", "!baz"})
 	cmds := sm.Tick()
-	sm.Apply(cmds)
+	sm.Apply(cmds, make([]CommandResult, len(cmds)))
 	want := sm.userToRoomStates
 	for i := 0; i < 100; i++ {
 		sm := NewStateMachine(42, 4, 10, []string{"bob", "alice"}, []string{"!foo", "!baz", "!bar"})
 		cmds := sm.Tick()
-		sm.Apply(cmds)
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
 		if !reflect.DeepEqual(sm.userToRoomStates, want) {
 			t.Errorf("iteration %d: got %+v want %+v", i, sm.userToRoomStates, want)
 		}
 	}
 }
+
+func TestStateMachineRollsBackFailedCommands(t *testing.T) {
+	sm := NewStateMachine(42, 10, 0, []string{"alice", "bob"}, []string{"!foo", "!bar", "!baz"})
+	cmds := sm.Tick()
+	results := make([]CommandResult, len(cmds))
+	// fail every command for alice
+	for i, cmd := range cmds {
+		if cmd.UserID == "alice" {
+			results[i].Err = fmt.Errorf("oh no")
+		}
+	}
+	sm.Apply(cmds, results)
+	for roomID, state := range sm.userToRoomStates["alice"] {
+		if state != StateStart {
+			t.Errorf("alice: room %s got state %v want %v", roomID, state, StateStart)
+		}
+	}
+	for _, cmd := range cmds {
+		if cmd.UserID == "bob" && sm.userToRoomStates["bob"][cmd.RoomID] == StateStart {
+			t.Errorf("bob: room %s was not applied", cmd.RoomID)
+		}
+	}
+}
+
+func TestStateMachineTimeoutsAreIndeterminate(t *testing.T) {
+	sm := NewStateMachine(42, 10, 0, []string{"alice"}, []string{"!foo"})
+	cmds := sm.Tick()
+	if len(cmds) == 0 || cmds[0].Action != ActionJoin {
+		t.Fatalf("expected first command to be a join, got %+v", cmds)
+	}
+	// the join times out, so everything after it fails
+	results := make([]CommandResult, len(cmds))
+	results[0].Err = &HTTPError{StatusCode: http.StatusGatewayTimeout}
+	for i := 1; i < len(results); i++ {
+		results[i].Err = &HTTPError{StatusCode: http.StatusForbidden}
+	}
+	sm.Apply(cmds, results)
+	if got := sm.userToRoomStates["alice"]["!foo"]; got != StateIndeterminate {
+		t.Fatalf("got state %v want %v", got, StateIndeterminate)
+	}
+	possible := sm.GetIndeterminateStates()["alice"]["!foo"]
+	if !reflect.DeepEqual(possible, []State{StateStart, StateJoined}) {
+		t.Fatalf("got possible states %v", possible)
+	}
+	// we don't resolve pairs from the current tick
+	if got := sm.Indeterminate(sm.Index); len(got) != 0 {
+		t.Fatalf("Indeterminate returned pairs from the current tick: %v", got)
+	}
+	// no commands are issued for indeterminate pairs
+	if cmds := sm.Tick(); len(cmds) != 0 {
+		t.Fatalf("Tick returned commands for an indeterminate pair: %v", cmds)
+	}
+	sm.Apply(nil, nil)
+	if got := sm.Indeterminate(sm.Index); !reflect.DeepEqual(got, []UserRoom{{UserID: "alice", RoomID: "!foo"}}) {
+		t.Fatalf("Indeterminate got %v", got)
+	}
+	if err := sm.Resolve("alice", "!foo", StateJoined); err != nil {
+		t.Fatalf("Resolve: %s", err)
+	}
+	if got := sm.userToRoomStates["alice"]["!foo"]; got != StateJoined {
+		t.Fatalf("got state %v want %v", got, StateJoined)
+	}
+	if got := sm.Indeterminate(sm.Index); len(got) != 0 {
+		t.Fatalf("Indeterminate returned resolved pairs: %v", got)
+	}
+}
+
+func TestStateMachineStateChurn(t *testing.T) {
+	sm := NewStateMachine(42, 10, 0, []string{"alice", "bob"}, []string{"!foo", "!bar"}, WithStateChurn(50, "org.example.custom", []string{"a", "b"}))
+	want := make(map[string]map[StateKeyTuple][]map[string]any)
+	sawStateEvent := false
+	for i := 0; i < 50; i++ {
+		membershipsBefore := sm.GetInternalState()
+		cmds := sm.Tick()
+		touched := make(map[string]map[StateKeyTuple]bool)
+		for _, cmd := range cmds {
+			if !isStateChurn(cmd.Action) {
+				continue
+			}
+			sawStateEvent = true
+			tuple := StateKeyTuple{Type: cmd.EventType, StateKey: cmd.StateKey}
+			if touched[cmd.RoomID][tuple] {
+				t.Fatalf("tick %d: state event %+v sent twice in room %s", sm.Index, tuple, cmd.RoomID)
+			}
+			if touched[cmd.RoomID] == nil {
+				touched[cmd.RoomID] = make(map[StateKeyTuple]bool)
+			}
+			touched[cmd.RoomID][tuple] = true
+			if want[cmd.RoomID] == nil {
+				want[cmd.RoomID] = make(map[StateKeyTuple][]map[string]any)
+			}
+			want[cmd.RoomID][tuple] = []map[string]any{cmd.Content}
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+		// state events never change membership
+		for _, cmd := range cmds {
+			if isStateChurn(cmd.Action) && collapseState(membershipsBefore[cmd.UserID][cmd.RoomID]) == StateLeft {
+				// the user must have joined earlier in this tick
+				if !slices.ContainsFunc(cmds, func(c WorkerCommand) bool {
+					return c.Action == ActionJoin && c.UserID == cmd.UserID && c.RoomID == cmd.RoomID
+				}) {
+					t.Fatalf("tick %d: %s sent state in %s without being joined", sm.Index, cmd.UserID, cmd.RoomID)
+				}
+			}
+		}
+	}
+	if !sawStateEvent {
+		t.Fatalf("state machine never sent a state event")
+	}
+	if !reflect.DeepEqual(sm.GetExpectedRoomState(), want) {
+		t.Errorf("got expected room state %+v want %+v", sm.GetExpectedRoomState(), want)
+	}
+	// a timed out state event can have either content
+	cmd := WorkerCommand{Action: ActionSetName, UserID: "alice", RoomID: "!baz", EventType: "m.room.name", Content: map[string]any{"name": "x"}}
+	sm.Apply([]WorkerCommand{cmd}, []CommandResult{{Err: &HTTPError{StatusCode: http.StatusGatewayTimeout}}})
+	got := sm.GetExpectedRoomState()["!baz"][StateKeyTuple{Type: "m.room.name"}]
+	if !reflect.DeepEqual(got, []map[string]any{nil, {"name": "x"}}) {
+		t.Errorf("timed out state event: got %+v", got)
+	}
+}
+
+func TestStateMachineModeration(t *testing.T) {
+	validStateTransitions := map[State][]State{
+		StateJoined: {StateLeft, StateSend, StateBanned},
+		StateLeft:   {StateJoined, StateBanned},
+		StateSend:   {StateSend, StateLeft, StateBanned},
+		StateStart:  {StateJoined, StateBanned},
+		StateBanned: {StateLeft},
+	}
+	moderators := []string{"mod1", "mod2"}
+	sm := NewStateMachine(42, 10, 10, []string{"alice", "bob"}, []string{"!foo", "!bar"}, WithModeration(moderators, 30))
+	sawModeration := map[Action]bool{}
+	sawRace := false
+	epoch := 0
+	changedEpoch := make(map[UserRoom]int) // the epoch each pair's membership last changed in, before this tick
+	for i := 0; i < 100; i++ {
+		cmds := sm.Tick()
+		workingCopy := sm.copyInternalState()
+		touchedBy := make(map[UserRoom]string)
+		var raced []WorkerCommand
+		for _, cmd := range cmds {
+			userID := cmd.UserID
+			if cmd.Target != "" {
+				if !slices.Contains(moderators, cmd.UserID) {
+					t.Fatalf("%s is not a moderator but sent %s", cmd.UserID, cmd.Action)
+				}
+				sawModeration[cmd.Action] = true
+				userID = cmd.Target
+				// servers may not have seen the last change yet, in which case either it or the moderation can win
+				e, ok := changedEpoch[UserRoom{UserID: userID, RoomID: cmd.RoomID}]
+				if racing := ok && e == epoch; racing != cmd.Contested {
+					t.Fatalf("tick %d: %s %s %s in %s has contested=%v but racing=%v", sm.Index, cmd.UserID, cmd.Action, userID, cmd.RoomID, cmd.Contested, racing)
+				}
+				if cmd.Contested {
+					raced = append(raced, cmd)
+				}
+			}
+			ur := UserRoom{UserID: userID, RoomID: cmd.RoomID}
+			if actor, ok := touchedBy[ur]; ok && actor != cmd.UserID {
+				t.Fatalf("tick %d: %+v is affected by both %s and %s", sm.Index, ur, actor, cmd.UserID)
+			}
+			touchedBy[ur] = cmd.UserID
+			prevState := workingCopy[userID][cmd.RoomID]
+			if !slices.Contains(validStateTransitions[prevState], actionToState(cmd.Action)) {
+				t.Fatalf("invalid state transition %v => %v", prevState, cmd.Action)
+			}
+			workingCopy[userID][cmd.RoomID] = actionToState(cmd.Action)
+		}
+		before := sm.copyInternalState()
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+		for _, cmd := range cmds {
+			if cmd.Target != "" {
+				changedEpoch[UserRoom{UserID: cmd.Target, RoomID: cmd.RoomID}] = epoch
+			} else if cmd.Action != ActionSend {
+				changedEpoch[UserRoom{UserID: cmd.UserID, RoomID: cmd.RoomID}] = epoch
+			}
+		}
+		// the target may end up in the state they were in or the state the moderator put them in
+		for _, cmd := range raced {
+			prev, want := collapseState(before[cmd.Target][cmd.RoomID]), collapseState(actionToState(cmd.Action))
+			if prev == want {
+				continue
+			}
+			sawRace = true
+			possible := sm.GetIndeterminateStates()[cmd.Target][cmd.RoomID]
+			if !slices.Contains(possible, before[cmd.Target][cmd.RoomID]) || !slices.Contains(possible, actionToState(cmd.Action)) {
+				t.Fatalf("tick %d: %s %s %s in %s raced a membership change but possible states are %v", sm.Index, cmd.UserID, cmd.Action, cmd.Target, cmd.RoomID, possible)
+			}
+			if slices.Contains(sm.Indeterminate(sm.Index+1), UserRoom{UserID: cmd.Target, RoomID: cmd.RoomID}) {
+				t.Fatalf("tick %d: contested %s in %s can be resolved before servers have synchronised", sm.Index, cmd.Target, cmd.RoomID)
+			}
+		}
+		if i%5 == 0 {
+			sm.Synchronised()
+			epoch++
+			// pick the moderator's outcome, as servers would tell us after the convergence check
+			for _, ur := range sm.Indeterminate(sm.Index + 1) {
+				possible := sm.GetIndeterminateStates()[ur.UserID][ur.RoomID]
+				if err := sm.Resolve(ur.UserID, ur.RoomID, possible[len(possible)-1]); err != nil {
+					t.Fatalf("Resolve: %s", err)
+				}
+			}
+		}
+	}
+	for _, action := range []Action{ActionKick, ActionBan, ActionUnban} {
+		if !sawModeration[action] {
+			t.Errorf("moderators never sent %s", action)
+		}
+	}
+	if !sawRace {
+		t.Errorf("moderators never raced a membership change")
+	}
+}
+
+func TestStateMachineInviteOnly(t *testing.T) {
+	validStateTransitions := map[State][]State{
+		StateStart:    {StateInvited},
+		StateLeft:     {StateInvited},
+		StateRejected: {StateInvited},
+		StateInvited:  {StateJoined, StateRejected},
+		StateJoined:   {StateLeft, StateSend},
+		StateSend:     {StateSend, StateLeft},
+	}
+	inviters := []string{"@master:hs1", "@master:hs2"}
+	sm := NewStateMachine(42, 10, 10, []string{"@alice:hs1", "@bob:hs2"}, []string{"!foo", "!bar"}, WithJoinRule(JoinRuleInvite, inviters, 30))
+	sawRejection := false
+	for i := 0; i < 100; i++ {
+		cmds := sm.Tick()
+		workingCopy := sm.copyInternalState()
+		for _, cmd := range cmds {
+			userID := cmd.UserID
+			if cmd.Action == ActionInvite {
+				userID = cmd.Target
+				// invites should go over federation
+				_, inviterDomain, _ := strings.Cut(cmd.UserID, ":")
+				_, inviteeDomain, _ := strings.Cut(userID, ":")
+				if inviterDomain == inviteeDomain {
+					t.Fatalf("%s invited %s on the same server", cmd.UserID, userID)
+				}
+			}
+			if cmd.Action == ActionReject {
+				sawRejection = true
+			}
+			prevState := workingCopy[userID][cmd.RoomID]
+			if !slices.Contains(validStateTransitions[prevState], actionToState(cmd.Action)) {
+				t.Fatalf("invalid state transition %v => %v", prevState, cmd.Action)
+			}
+			workingCopy[userID][cmd.RoomID] = actionToState(cmd.Action)
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	}
+	if !sawRejection {
+		t.Errorf("never rejected an invite")
+	}
+}
+
+func TestStateMachineOnlyInvitesLocallyWhilstFederationIsBlocked(t *testing.T) {
+	inviters := []string{"@master:hs1", "@master:hs2"}
+	for _, joinRule := range []JoinRule{JoinRuleInvite, JoinRuleKnock} {
+		sm := NewStateMachine(
+			42, 10, 10, []string{"@alice:hs1", "@bob:hs2", "@charlie:hs3"}, []string{"!foo", "!bar"},
+			WithJoinRule(joinRule, inviters, 10), WithKnockRejection(30),
+		)
+		sawLocal := false
+		for i := 0; i < 100; i++ {
+			// netsplit every other 10 ticks
+			blocked := (i/10)%2 == 1
+			sm.SetFederationBlocked(blocked)
+			cmds := sm.Tick()
+			for _, cmd := range cmds {
+				if cmd.Target == "" {
+					continue
+				}
+				_, inviterDomain, _ := strings.Cut(cmd.UserID, ":")
+				_, targetDomain, _ := strings.Cut(cmd.Target, ":")
+				if blocked && inviterDomain != targetDomain {
+					t.Fatalf("%s: %s sent %s to %s whilst federation was blocked", joinRule, cmd.UserID, cmd.Action, cmd.Target)
+				}
+				if blocked {
+					sawLocal = true
+				}
+			}
+			sm.Apply(cmds, make([]CommandResult, len(cmds)))
+		}
+		if !sawLocal {
+			t.Errorf("%s: never invited anyone whilst federation was blocked", joinRule)
+		}
+	}
+}
+
+func TestStateMachineKnocking(t *testing.T) {
+	validStateTransitions := map[State][]State{
+		StateStart:    {StateKnocking},
+		StateLeft:     {StateKnocking},
+		StateRejected: {StateKnocking},
+		StateKnocking: {StateInvited, StateLeft},
+		StateInvited:  {StateJoined, StateRejected},
+		StateJoined:   {StateLeft, StateSend},
+		StateSend:     {StateSend, StateLeft},
+	}
+	inviters := []string{"@master:hs1", "@master:hs2"}
+	sm := NewStateMachine(
+		42, 10, 10, []string{"@alice:hs1", "@bob:hs2"}, []string{"!foo", "!bar"},
+		WithJoinRule(JoinRuleKnock, inviters, 10), WithKnockRejection(30),
+	)
+	sawKnockRejection := false
+	for i := 0; i < 100; i++ {
+		cmds := sm.Tick()
+		workingCopy := sm.copyInternalState()
+		for _, cmd := range cmds {
+			userID := cmd.UserID
+			if cmd.Target != "" {
+				if !slices.Contains(inviters, cmd.UserID) {
+					t.Fatalf("%s is not an inviter but sent %s", cmd.UserID, cmd.Action)
+				}
+				userID = cmd.Target
+			}
+			prevState := workingCopy[userID][cmd.RoomID]
+			if prevState == StateKnocking && cmd.Action == ActionKick {
+				sawKnockRejection = true
+			}
+			if !slices.Contains(validStateTransitions[prevState], actionToState(cmd.Action)) {
+				t.Fatalf("invalid state transition %v => %v", prevState, cmd.Action)
+			}
+			workingCopy[userID][cmd.RoomID] = actionToState(cmd.Action)
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	}
+	if !sawKnockRejection {
+		t.Errorf("never rejected a knock")
+	}
+}
+
+func TestStateMachineRestricted(t *testing.T) {
+	space := "!space"
+	sm := NewStateMachine(
+		42, 10, 20, []string{"alice", "bob"}, []string{"!foo", "!bar", space},
+		WithJoinRule(JoinRuleRestricted, nil, 0), WithSpace(space),
+	)
+	sawLeaveSpaceWhilstJoined := false
+	for i := 0; i < 100; i++ {
+		cmds := sm.Tick()
+		workingCopy := sm.copyInternalState()
+		for _, cmd := range cmds {
+			if cmd.Action == ActionJoin && cmd.RoomID != space && collapseState(workingCopy[cmd.UserID][space]) != StateJoined {
+				t.Fatalf("tick %d: %s joined %s without being in the space", sm.Index, cmd.UserID, cmd.RoomID)
+			}
+			if cmd.Action == ActionLeave && cmd.RoomID == space {
+				for roomID, state := range workingCopy[cmd.UserID] {
+					if roomID != space && collapseState(state) == StateJoined {
+						sawLeaveSpaceWhilstJoined = true
+					}
+				}
+			}
+			workingCopy[cmd.UserID][cmd.RoomID] = actionToState(cmd.Action)
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	}
+	if !sawLeaveSpaceWhilstJoined {
+		t.Errorf("never left the space whilst joined to a restricted room")
+	}
+}
+
+func TestStateMachinePowerLevelChurn(t *testing.T) {
+	users := []string{"alice", "bob", "charlie"}
+	sm := NewStateMachine(42, 10, 10, slices.Clone(users), []string{"!foo", "!bar"}, WithPowerLevelChurn("editor", 30), WithStateChurn(30, "", nil))
+	levels := make(map[UserRoom]int) // the power levels the server accepted
+	saw := map[string]bool{}
+	changedTick := make(map[UserRoom]int) // the tick each pair's membership last changed in
+	synchronisedTick := 0
+	for i := 0; i < 300; i++ {
+		cmds := sm.Tick()
+		demoted := make(map[UserRoom]bool)
+		for _, cmd := range cmds {
+			if cmd.Action == ActionSetPowerLevel && cmd.PowerLevel == 0 {
+				demoted[UserRoom{UserID: cmd.Target, RoomID: cmd.RoomID}] = true
+			}
+		}
+		results := make([]CommandResult, len(cmds))
+		for i, cmd := range cmds {
+			ur := UserRoom{UserID: cmd.UserID, RoomID: cmd.RoomID}
+			switch cmd.Action {
+			case ActionSetPowerLevel:
+				if cmd.UserID != "editor" {
+					t.Fatalf("%s changed a power level", cmd.UserID)
+				}
+				if cmd.PowerLevel == levels[UserRoom{UserID: cmd.Target, RoomID: cmd.RoomID}] {
+					t.Fatalf("tick %d: set power level of %s in %s to its current level", sm.Index, cmd.Target, cmd.RoomID)
+				}
+				saw[fmt.Sprintf("power level %d", cmd.PowerLevel)] = true
+			case ActionKick, ActionSetTopic:
+				if levels[ur] != PowerLevelPromoted {
+					t.Fatalf("tick %d: %s sent %s in %s without being promoted", sm.Index, cmd.UserID, cmd.Action, cmd.RoomID)
+				}
+				saw[string(cmd.Action)] = true
+			}
+			// kicks also race the target's membership changes which servers may not have seen yet
+			racing := false
+			if cmd.Action == ActionKick {
+				changed, ok := changedTick[UserRoom{UserID: cmd.Target, RoomID: cmd.RoomID}]
+				racing = ok && changed > synchronisedTick
+			}
+			if privileged := cmd.Action == ActionKick || cmd.Action == ActionSetTopic; cmd.Contested != (privileged && (demoted[ur] || racing)) {
+				t.Fatalf("tick %d: %s %s in %s contested=%v but demoted=%v racing=%v", sm.Index, cmd.UserID, cmd.Action, cmd.RoomID, cmd.Contested, demoted[ur], racing)
+			}
+			if cmd.Contested {
+				saw["contested"] = true
+				// the server saw the demotion or the target's membership change first
+				results[i].Err = &HTTPError{StatusCode: http.StatusForbidden}
+			}
+		}
+		sm.Apply(cmds, results)
+		for i, cmd := range cmds {
+			if cmd.Action == ActionSetPowerLevel {
+				levels[UserRoom{UserID: cmd.Target, RoomID: cmd.RoomID}] = cmd.PowerLevel
+			}
+			if results[i].Err != nil || isStateChurn(cmd.Action) || cmd.Action == ActionSend || cmd.Action == ActionSetPowerLevel {
+				continue
+			}
+			target := cmd.UserID
+			if cmd.Target != "" {
+				target = cmd.Target
+			}
+			changedTick[UserRoom{UserID: target, RoomID: cmd.RoomID}] = sm.Index
+		}
+		if i%5 == 0 {
+			sm.Synchronised()
+			synchronisedTick = sm.Index
+		}
+	}
+	for _, want := range []string{"power level 50", "power level 0", string(ActionKick), string(ActionSetTopic), "contested"} {
+		if !saw[want] {
+			t.Errorf("never saw %s", want)
+		}
+	}
+	// rejected contested commands are rolled back, so the expected power levels are what the server accepted
+	for roomID, userLevels := range sm.GetExpectedPowerLevels() {
+		for userID, possible := range userLevels {
+			if want := levels[UserRoom{UserID: userID, RoomID: roomID}]; !reflect.DeepEqual(possible, []int{want}) {
+				t.Errorf("%s in %s: got power levels %v want %d", userID, roomID, possible, want)
+			}
+		}
+	}
+}
+
+func TestStateMachinePrivilegedKicksRaceMembershipChanges(t *testing.T) {
+	sm := NewStateMachine(42, 1, 0, []string{"alice", "bob"}, []string{"!foo"}, WithPowerLevelChurn("editor", 100))
+	sm.setState("alice", "!foo", StateJoined)
+	sm.setState("bob", "!foo", StateJoined)
+	sm.powerLevels[UserRoom{UserID: "alice", RoomID: "!foo"}] = &powerLevelState{possible: []int{PowerLevelPromoted}}
+	sm.Synchronised()
+	kick := func() *WorkerCommand {
+		for i := 0; i < 100; i++ {
+			cmd := sm.privilegedAction("alice", "!foo", sm.copyInternalState(), make(map[string]map[StateKeyTuple]bool), make(map[UserRoom]string), newPowerLevelTick())
+			if cmd != nil && cmd.Action == ActionKick {
+				return cmd
+			}
+		}
+		t.Fatalf("alice never kicked bob")
+		return nil
+	}
+	// bob joined after servers last synchronised, so some servers may not have seen it yet
+	sm.membershipEpochs[UserRoom{UserID: "bob", RoomID: "!foo"}] = sm.epoch
+	cmd := kick()
+	if !cmd.Contested {
+		t.Fatalf("kick racing bob's join is not contested: %+v", cmd)
+	}
+	sm.Apply([]WorkerCommand{*cmd}, make([]CommandResult, 1))
+	if possible := sm.GetIndeterminateStates()["bob"]["!foo"]; !reflect.DeepEqual(possible, []State{StateJoined, StateLeft}) {
+		t.Fatalf("got possible states %v", possible)
+	}
+	if got := sm.Indeterminate(sm.Index + 1); len(got) != 0 {
+		t.Fatalf("Indeterminate returned a contested pair before servers synchronised: %v", got)
+	}
+	// once every server has seen bob's membership, kicking him no longer races anything
+	if err := sm.Resolve("bob", "!foo", StateJoined); err != nil {
+		t.Fatalf("Resolve: %s", err)
+	}
+	sm.Synchronised()
+	if cmd := kick(); cmd.Contested {
+		t.Fatalf("kick is contested after servers synchronised: %+v", cmd)
+	}
+}
+
+func TestStateMachineContestedCommandsAreIndeterminate(t *testing.T) {
+	sm := NewStateMachine(42, 1, 0, []string{"alice", "bob"}, []string{"!foo"})
+	sm.setState("bob", "!foo", StateJoined)
+	// the kick succeeded, but alice was demoted in the same tick
+	cmds := []WorkerCommand{{Action: ActionKick, UserID: "alice", RoomID: "!foo", Target: "bob", Contested: true}}
+	sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	possible := sm.GetIndeterminateStates()["bob"]["!foo"]
+	if !reflect.DeepEqual(possible, []State{StateJoined, StateLeft}) {
+		t.Fatalf("got possible states %v", possible)
+	}
+	// servers may disagree about the outcome until they have all seen the demotion
+	sm.Index++
+	if got := sm.Indeterminate(sm.Index + 1); len(got) != 0 {
+		t.Fatalf("Indeterminate returned a contested pair before servers synchronised: %v", got)
+	}
+	sm.Synchronised()
+	if got := sm.Indeterminate(sm.Index + 1); !reflect.DeepEqual(got, []UserRoom{{UserID: "bob", RoomID: "!foo"}}) {
+		t.Fatalf("Indeterminate got %v", got)
+	}
+}
+
+func TestStateMachineRoomUpgrades(t *testing.T) {
+	sm := NewStateMachine(42, 20, 0, []string{"alice", "bob"}, []string{"!foo"}, WithRoomUpgrades([]string{"master"}, "11", 100))
+	// rooms are only upgraded in the first tick after synchronising
+	cmds := sm.Tick()
+	if len(cmds) == 0 || cmds[0].Action != ActionUpgrade {
+		t.Fatalf("expected an upgrade, got %+v", cmds)
+	}
+	if len(cmds) != 1 {
+		t.Fatalf("commands were sent in the room being upgraded: %+v", cmds[1:])
+	}
+	sm.Apply(cmds, []CommandResult{{Err: &HTTPError{StatusCode: http.StatusForbidden}}})
+	for i := 0; i < 5; i++ {
+		cmds = sm.Tick()
+		for _, cmd := range cmds {
+			if cmd.Action == ActionUpgrade {
+				t.Fatalf("tick %d: upgraded a room without synchronising", sm.Index)
+			}
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	}
+	joined := []string{}
+	for userID, rooms := range sm.GetInternalState() {
+		if rooms["!foo"] == StateJoined || rooms["!foo"] == StateSend {
+			joined = append(joined, userID)
+		}
+	}
+	slices.Sort(joined)
+	if len(joined) == 0 {
+		t.Fatalf("nobody joined the room")
+	}
+	sm.Synchronised()
+	cmds = sm.Tick()
+	if len(cmds) != 1 || cmds[0].Action != ActionUpgrade || cmds[0].RoomVersion != "11" {
+		t.Fatalf("expected only an upgrade, got %+v", cmds)
+	}
+	sm.Apply(cmds, []CommandResult{{ReplacementRoomID: "!new"}})
+	if !reflect.DeepEqual(sm.GetRoomUpgrades(), map[string]string{"!foo": "!new"}) {
+		t.Fatalf("got upgrades %v", sm.GetRoomUpgrades())
+	}
+	if !reflect.DeepEqual(sm.roomIDs, []string{"!new"}) {
+		t.Fatalf("got rooms %v", sm.roomIDs)
+	}
+	// joined users migrate to the replacement room
+	cmds = sm.Tick()
+	var migrated []string
+	for _, cmd := range cmds {
+		if cmd.RoomID != "!new" {
+			t.Fatalf("command sent in the upgraded room: %+v", cmd)
+		}
+		if cmd.Action == ActionJoin && !slices.Contains(migrated, cmd.UserID) {
+			migrated = append(migrated, cmd.UserID)
+		}
+	}
+	slices.Sort(migrated)
+	if !reflect.DeepEqual(migrated, joined) {
+		t.Fatalf("migrated %v want %v", migrated, joined)
+	}
+}
+
+func TestStateMachineMigrationsAreCapped(t *testing.T) {
+	users := []string{"alice", "bob", "charlie", "doris", "eve", "frank"}
+	sm := NewStateMachine(42, 2, 0, slices.Clone(users), []string{"!foo"}, WithRoomUpgrades([]string{"master"}, "11", 100))
+	for _, userID := range users {
+		sm.setState(userID, "!foo", StateJoined)
+	}
+	sm.Synchronised()
+	cmds := sm.Tick()
+	if len(cmds) != 1 || cmds[0].Action != ActionUpgrade {
+		t.Fatalf("expected only an upgrade, got %+v", cmds)
+	}
+	sm.Apply(cmds, []CommandResult{{ReplacementRoomID: "!new"}})
+	// workers only buffer 2*opsPerTick+1 commands per tick, so users are migrated over several ticks
+	joined := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		cmds = sm.Tick()
+		if len(cmds) > 2*2+1 {
+			t.Fatalf("tick %d has %d commands: %+v", sm.Index, len(cmds), cmds)
+		}
+		for _, cmd := range cmds {
+			if cmd.Action == ActionJoin {
+				if joined[cmd.UserID] {
+					t.Fatalf("tick %d: %s joined the replacement room twice", sm.Index, cmd.UserID)
+				}
+				joined[cmd.UserID] = true
+			}
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	}
+	for _, userID := range users {
+		if !joined[userID] {
+			t.Errorf("%s was never migrated", userID)
+		}
+	}
+}
+
+func TestStateMachineTimedOutUpgradesLockTheRoom(t *testing.T) {
+	sm := NewStateMachine(42, 20, 0, []string{"alice", "bob"}, []string{"!foo"}, WithRoomUpgrades([]string{"master"}, "11", 100))
+	cmds := sm.Tick()
+	sm.Apply(cmds, []CommandResult{{Err: &HTTPError{StatusCode: http.StatusGatewayTimeout}}})
+	if cmds := sm.Tick(); len(cmds) != 0 {
+		t.Fatalf("commands were sent in a room which may have been upgraded: %+v", cmds)
+	}
+	sm.Apply(nil, nil)
+	roomIDs, upgraderIDs := sm.IndeterminateUpgrades(sm.Index)
+	if !reflect.DeepEqual(roomIDs, []string{"!foo"}) || !reflect.DeepEqual(upgraderIDs, []string{"master"}) {
+		t.Fatalf("IndeterminateUpgrades got %v %v", roomIDs, upgraderIDs)
+	}
+	if err := sm.ResolveUpgrade("!foo", "!new"); err != nil {
+		t.Fatalf("ResolveUpgrade: %s", err)
+	}
+	if !reflect.DeepEqual(sm.roomIDs, []string{"!new"}) {
+		t.Fatalf("got rooms %v", sm.roomIDs)
+	}
+	if cmds := sm.Tick(); len(cmds) == 0 {
+		t.Fatalf("no commands were sent in the replacement room")
+	}
+}
+
+func TestStateMachineProfileChurn(t *testing.T) {
+	moderators := []string{"mod"}
+	sm := NewStateMachine(42, 10, 10, []string{"alice", "bob"}, []string{"!foo", "!bar"}, WithProfileChurn(20), WithModeration(moderators, 20))
+	sawDisplayName := false
+	for i := 0; i < 100; i++ {
+		cmds := sm.Tick()
+		setDisplayName := make(map[string]bool)
+		for _, cmd := range cmds {
+			if cmd.Action == ActionSetDisplayName {
+				if cmd.RoomID != "" || cmd.DisplayName == "" {
+					t.Fatalf("bad display name command %+v", cmd)
+				}
+				setDisplayName[cmd.UserID] = true
+				sawDisplayName = true
+			}
+		}
+		// nobody else can change the membership of a user changing their display name
+		for _, cmd := range cmds {
+			if cmd.Target != "" && setDisplayName[cmd.Target] {
+				t.Fatalf("tick %d: %s %s %s whilst they changed their display name", sm.Index, cmd.UserID, cmd.Action, cmd.Target)
+			}
+		}
+		sm.Apply(cmds, make([]CommandResult, len(cmds)))
+		// users execute their commands in order, so the last display name wins
+		latest := make(map[string]string)
+		for _, cmd := range cmds {
+			if cmd.Action == ActionSetDisplayName {
+				latest[cmd.UserID] = cmd.DisplayName
+			}
+		}
+		for userID, displayName := range latest {
+			if got := sm.GetExpectedDisplayNames()[userID]; !reflect.DeepEqual(got, []string{displayName}) {
+				t.Fatalf("got display names %v want %s", got, displayName)
+			}
+		}
+	}
+	if !sawDisplayName {
+		t.Fatalf("never changed a display name")
+	}
+}
+
+func TestStateMachineRedactions(t *testing.T) {
+	sm := NewStateMachine(42, 10, 10, []string{"alice", "bob"}, []string{"!foo", "!bar"}, WithStateChurn(30, "custom", nil), WithRedactions(30, true))
+	eventIDs := make(map[string]string) // event key => event ID
+	var redacted []string
+	sawStateRedaction := false
+	for i := 0; i < 100; i++ {
+		cmds := sm.Tick()
+		results := make([]CommandResult, len(cmds))
+		for j, cmd := range cmds {
+			switch {
+			case cmd.Action == ActionSend || isStateChurn(cmd.Action):
+				if cmd.EventKey == "" {
+					t.Fatalf("%s has no event key", cmd.Action)
+				}
+				results[j].EventID = "$" + cmd.EventKey
+				eventIDs[cmd.EventKey] = results[j].EventID
+			case cmd.Action == ActionRedact:
+				if cmd.EventID != eventIDs[cmd.Redacts] {
+					t.Fatalf("redaction of %s has event ID %s want %s", cmd.Redacts, cmd.EventID, eventIDs[cmd.Redacts])
+				}
+				if slices.Contains(redacted, cmd.EventID) {
+					t.Fatalf("redacted %s twice", cmd.EventID)
+				}
+				redacted = append(redacted, cmd.EventID)
+			}
+		}
+		sm.Apply(cmds, results)
+		// redacting the current value of a state event strips its content
+		for roomID, events := range sm.GetExpectedRoomState() {
+			for tuple, possible := range events {
+				if len(possible) == 1 && len(possible[0]) == 0 {
+					sawStateRedaction = true
+					if eventID := "$" + sm.currentStateKeys[roomID][tuple]; !slices.Contains(redacted, eventID) {
+						t.Fatalf("(%s, '%s') in %s has no content but %s was not redacted", tuple.Type, tuple.StateKey, roomID, eventID)
+					}
+				}
+			}
+		}
+	}
+	if len(redacted) == 0 {
+		t.Fatalf("never redacted an event")
+	}
+	if !sawStateRedaction {
+		t.Fatalf("never redacted the current state")
+	}
+	for _, eventID := range redacted {
+		found := false
+		for _, events := range sm.GetExpectedRedactions() {
+			found = found || events[eventID]
+		}
+		if !found {
+			t.Fatalf("%s is not expected to be redacted", eventID)
+		}
+	}
+}
+
+func TestStateMachineSentMessagesAreForgottenWhenSynchronised(t *testing.T) {
+	sm := NewStateMachine(42, 10, 10, []string{"alice", "bob"}, []string{"!foo", "!bar"})
+	var want []SentMessage
+	for i := 0; i < 10; i++ {
+		cmds := sm.Tick()
+		results := make([]CommandResult, len(cmds))
+		for j, cmd := range cmds {
+			if cmd.Action != ActionSend {
+				continue
+			}
+			results[j].EventID = fmt.Sprintf("$%d.%d", sm.Index, j)
+			if j%2 == 0 {
+				// failed messages were never sent
+				results[j].Err = &HTTPError{StatusCode: http.StatusForbidden}
+				continue
+			}
+			want = append(want, SentMessage{RoomID: cmd.RoomID, EventID: results[j].EventID, SenderID: cmd.UserID, Tick: sm.Index})
+		}
+		sm.Apply(cmds, results)
+	}
+	if len(want) == 0 {
+		t.Fatalf("never sent a message")
+	}
+	if got := sm.GetSentMessages(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got sent messages %+v want %+v", got, want)
+	}
+	sm.Synchronised()
+	if got := sm.GetSentMessages(); len(got) != 0 {
+		t.Fatalf("got sent messages %+v after synchronising", got)
+	}
+}
+
+func TestStateMachineTracksWhoLastChangedEachPair(t *testing.T) {
+	sm := NewStateMachine(42, 1, 0, []string{"alice", "bob"}, []string{"!foo"})
+	topic := StateKeyTuple{Type: "m.room.topic"}
+	cmds := []WorkerCommand{
+		{Action: ActionJoin, UserID: "alice", RoomID: "!foo"},
+		{Action: ActionJoin, UserID: "bob", RoomID: "!foo"},
+		{Action: ActionSetTopic, UserID: "alice", RoomID: "!foo", EventType: topic.Type, Content: map[string]any{"topic": "a"}},
+	}
+	sm.Apply(cmds, make([]CommandResult, len(cmds)))
+	cmds = []WorkerCommand{
+		{Action: ActionKick, UserID: "alice", RoomID: "!foo", Target: "bob"},
+		// failed commands don't change anything, so don't count
+		{Action: ActionSetTopic, UserID: "bob", RoomID: "!foo", EventType: topic.Type, Content: map[string]any{"topic": "b"}},
+	}
+	sm.Apply(cmds, []CommandResult{{}, {Err: &HTTPError{StatusCode: http.StatusForbidden}}})
+	wantActors := map[string]map[string]string{"!foo": {"alice": "alice", "bob": "alice"}}
+	if got := sm.GetMembershipActors(); !reflect.DeepEqual(got, wantActors) {
+		t.Fatalf("got membership actors %v want %v", got, wantActors)
+	}
+	wantSenders := map[string]map[StateKeyTuple]string{"!foo": {topic: "alice"}}
+	if got := sm.GetStateSenders(); !reflect.DeepEqual(got, wantSenders) {
+		t.Fatalf("got state senders %v want %v", got, wantSenders)
+	}
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+)
+
+// pendingUpgrade is an upgrade which timed out, so the room may or may not have been upgraded.
+type pendingUpgrade struct {
+	upgraderID string
+	tick       int // the tick which upgraded the room
+}
+
+// WithRoomUpgrades makes one of the upgraders upgrade a random room to the given room version at the given
+// probability (0-100). Upgraders must have enough power to upgrade every room, and must always be joined to
+// every room, including replacement rooms. Rooms are only upgraded in the first tick after Synchronised, as
+// the upgrader's server copies its view of the room state into the replacement room, and rooms which have
+// banned, invited, knocking or indeterminate users are never upgraded, as servers don't agree on how these
+// memberships are copied, if at all.
+func WithRoomUpgrades(upgraderIDs []string, roomVersion string, probability int) StateMachineOpt {
+	return func(s *StateMachine) {
+		if probability < 0 || probability > 100 {
+			panic("room upgrade probability must be between 0-100")
+		}
+		s.upgraderIDs = slices.Clone(upgraderIDs)
+		slices.Sort(s.upgraderIDs)
+		s.upgradeRoomVersion = roomVersion
+		s.upgradeProbability = probability
+	}
+}
+
+// GetRoomUpgrades returns the replacement room ID for every room which has been upgraded.
+func (s *StateMachine) GetRoomUpgrades() map[string]string {
+	result := make(map[string]string, len(s.upgrades))
+	for roomID, replacementRoomID := range s.upgrades {
+		result[roomID] = replacementRoomID
+	}
+	return result
+}
+
+// roomLocked returns true if no commands can be sent in the room this tick as it is being upgraded.
+func (s *StateMachine) roomLocked(roomID string) bool {
+	return roomID == s.upgradingRoomID || s.pendingUpgrades[roomID] != nil
+}
+
+// upgrade returns a command for an upgrader to upgrade a random room, or nil if no room should be upgraded.
+// Nobody else can send commands in the room this tick, as they would race with the tombstone.
+func (s *StateMachine) upgrade(workingCopy map[string]map[string]State) *WorkerCommand {
+	s.upgradingRoomID = ""
+	if s.upgradeProbability == 0 || s.Index != s.synchronisedTick+1 || s.random(100) >= s.upgradeProbability {
+		return nil
+	}
+	roomID := s.roomIDs[s.random(len(s.roomIDs))]
+	if s.roomLocked(roomID) {
+		return nil
+	}
+	for _, userID := range s.userIDs {
+		switch workingCopy[userID][roomID] {
+		case StateBanned, StateInvited, StateKnocking, StateIndeterminate:
+			return nil
+		}
+	}
+	s.upgradingRoomID = roomID
+	return &WorkerCommand{
+		Action:      ActionUpgrade,
+		UserID:      s.upgraderIDs[s.random(len(s.upgraderIDs))],
+		RoomID:      roomID,
+		RoomVersion: s.upgradeRoomVersion,
+	}
+}
+
+// migrate returns join commands for users who were joined to rooms which have since been upgraded.
+// Users are only migrated once: if the join fails, they join the replacement room like any other room.
+// At most opsPerTick users are migrated per tick, so a tick never has more than 2*opsPerTick+1 commands
+// (including an upgrade). The rest are migrated in later ticks, unless they joined by themselves first.
+func (s *StateMachine) migrate(workingCopy map[string]map[string]State, touchedBy map[UserRoom]string) []WorkerCommand {
+	var cmds []WorkerCommand
+	for _, userID := range s.userIDs {
+		for _, roomID := range s.roomIDs {
+			ur := UserRoom{UserID: userID, RoomID: roomID}
+			if !s.migrating[ur] || s.roomLocked(roomID) {
+				continue
+			}
+			if workingCopy[userID][roomID] != StateStart {
+				// e.g they picked the replacement room at random whilst waiting to be migrated
+				delete(s.migrating, ur)
+				continue
+			}
+			if len(cmds) == s.opsPerTick {
+				return cmds
+			}
+			delete(s.migrating, ur)
+			touchedBy[ur] = userID
+			cmds = append(cmds, WorkerCommand{
+				Action: ActionJoin,
+				UserID: userID,
+				RoomID: roomID,
+			})
+			workingCopy[userID][roomID] = StateJoined
+		}
+	}
+	return cmds
+}
+
+// applyUpgrade updates the state machine after a room upgrade.
+func (s *StateMachine) applyUpgrade(cmd WorkerCommand, result CommandResult, outcome commandOutcome) {
+	switch outcome {
+	case outcomeApplied:
+		s.replaceRoom(cmd.RoomID, result.ReplacementRoomID)
+	case outcomeIndeterminate:
+		s.pendingUpgrades[cmd.RoomID] = &pendingUpgrade{
+			upgraderID: cmd.UserID,
+			tick:       s.Index,
+		}
+	}
+}
+
+// replaceRoom swaps the room for its replacement. Joined users are migrated to the replacement room, and
+// state which is copied to the replacement room is expected to be the same as it was in the old room.
+func (s *StateMachine) replaceRoom(roomID, replacementRoomID string) {
+	i := slices.Index(s.roomIDs, roomID)
+	if i == -1 {
+		panic(fmt.Sprintf("replaceRoom: unknown room %s", roomID))
+	}
+	// keep the same index so we pick rooms deterministically
+	s.roomIDs[i] = replacementRoomID
+	s.upgrades[roomID] = replacementRoomID
+	for _, userID := range s.userIDs {
+		state := s.userToRoomStates[userID][roomID]
+		delete(s.userToRoomStates[userID], roomID)
+		s.userToRoomStates[userID][replacementRoomID] = StateStart
+		if state == StateJoined || state == StateSend {
+			s.migrating[UserRoom{UserID: userID, RoomID: replacementRoomID}] = true
+		}
+	}
+	for tuple, possible := range s.roomState[roomID] {
+		// custom state events are not copied
+		if tuple.Type == "m.room.name" || tuple.Type == "m.room.topic" {
+			if s.roomState[replacementRoomID] == nil {
+				s.roomState[replacementRoomID] = make(map[StateKeyTuple][]map[string]any)
+			}
+			s.roomState[replacementRoomID][tuple] = possible
+		}
+	}
+	delete(s.roomState, roomID)
+	delete(s.currentStateKeys, roomID)
+	delete(s.stateSenders, roomID)
+	for ur := range s.membershipActors {
+		if ur.RoomID == roomID {
+			delete(s.membershipActors, ur)
+			delete(s.membershipEpochs, ur)
+		}
+	}
+	for ur := range s.redactable {
+		// redactions already sent in the old room are still checked
+		if ur.RoomID == roomID {
+			delete(s.redactable, ur)
+		}
+	}
+	for ur, pl := range s.powerLevels {
+		if ur.RoomID == roomID {
+			delete(s.powerLevels, ur)
+			s.powerLevels[UserRoom{UserID: ur.UserID, RoomID: replacementRoomID}] = pl
+		}
+	}
+}
+
+// IndeterminateUpgrades returns the rooms which may or may not have been upgraded before the given tick,
+// along with the user who upgraded them. Rooms are returned in a deterministic order.
+func (s *StateMachine) IndeterminateUpgrades(beforeTick int) (roomIDs, upgraderIDs []string) {
+	for _, roomID := range s.roomIDs {
+		if pu := s.pendingUpgrades[roomID]; pu != nil && pu.tick < beforeTick {
+			roomIDs = append(roomIDs, roomID)
+			upgraderIDs = append(upgraderIDs, pu.upgraderID)
+		}
+	}
+	return
+}
+
+// ResolveUpgrade resolves a room which may or may not have been upgraded. If replacementRoomID is empty, the
+// room was not upgraded.
+func (s *StateMachine) ResolveUpgrade(roomID, replacementRoomID string) error {
+	if s.pendingUpgrades[roomID] == nil {
+		return fmt.Errorf("room %s is not being upgraded", roomID)
+	}
+	delete(s.pendingUpgrades, roomID)
+	if replacementRoomID != "" {
+		s.replaceRoom(roomID, replacementRoomID)
+	}
+	return nil
+}
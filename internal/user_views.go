@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// userSyncView is a test user's view of their own memberships, built up from incremental /syncs since the start
+// of the run.
+type userSyncView struct {
+	client      CSAPIConvergence
+	since       string
+	memberships map[string]Membership // room ID => membership, by which section of /sync the room was last in
+}
+
+// WithUserSyncViews makes convergence checks also check each test user's view of their own memberships, according
+// to the rooms.join, rooms.invite, rooms.knock and rooms.leave sections of their incremental /sync. This can
+// disagree with /members, e.g when a leave over federation doesn't reach the user's own server. StartUserSyncViews
+// must be called before any of the users do anything.
+func WithUserSyncViews(users []CSAPIConvergence) ConvergenceOpt {
+	return func(c *Convergence) {
+		for _, user := range users {
+			c.userViews = append(c.userViews, &userSyncView{
+				client:      user,
+				memberships: make(map[string]Membership),
+			})
+		}
+	}
+}
+
+// StartUserSyncViews does an initial /sync for each test user, so later checks see every change to their
+// memberships since now.
+func (c *Convergence) StartUserSyncViews() error {
+	for _, view := range c.userViews {
+		if err := view.catchUp(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userSyncFilter only includes the rooms each user is in, not what is in them.
+var userSyncFilter = func() string {
+	none := map[string]any{"types": []string{}}
+	b, _ := json.Marshal(map[string]any{
+		"account_data": none,
+		"presence":     none,
+		"room": map[string]any{
+			"account_data": none,
+			"ephemeral":    none,
+			"state":        none,
+			"timeline":     map[string]any{"limit": 1},
+		},
+	})
+	return string(b)
+}()
+
+// catchUp applies everything which happened to the user's memberships since the last /sync.
+func (v *userSyncView) catchUp() error {
+	res, err := v.client.Sync(SyncReq{
+		Since:         v.since,
+		Filter:        userSyncFilter,
+		TimeoutMillis: "0",
+	})
+	if err != nil {
+		return fmt.Errorf("/sync for %s failed: %s", v.client.GetUserID(), err)
+	}
+	// A room can be in rooms.leave as well as another section e.g if the user was kicked then invited again
+	// since the last /sync, in which case the other section is their current membership.
+	for roomID := range res.Rooms.Leave {
+		v.memberships[roomID] = MembershipLeave
+	}
+	for roomID := range res.Rooms.Join {
+		v.memberships[roomID] = MembershipJoin
+	}
+	for roomID := range res.Rooms.Invite {
+		v.memberships[roomID] = MembershipInvite
+	}
+	for roomID := range res.Rooms.Knock {
+		v.memberships[roomID] = MembershipKnock
+	}
+	v.since = res.NextBatch
+	return nil
+}
+
+// assertUserSyncViews catches up each test user's /sync, and checks that their view of their own memberships
+// matches roomStates.
+func (c *Convergence) assertUserSyncViews(roomStates map[string]map[string][]State) error {
+	for _, view := range c.userViews {
+		if err := view.catchUp(); err != nil {
+			return err
+		}
+		userID := view.client.GetUserID()
+		var errs []string
+		for _, roomID := range c.allRoomIDs() {
+			wantStates, ok := roomStates[roomID][userID]
+			if !ok {
+				continue
+			}
+			got, ok := view.memberships[roomID]
+			if !ok {
+				got = MembershipLeave
+			}
+			// bans and leaves are both in rooms.leave
+			var want []State
+			for _, state := range wantStates {
+				if state == StateBanned {
+					state = StateLeft
+				}
+				want = append(want, state)
+			}
+			if !slices.Contains(want, membershipToState(got)) {
+				errs = append(errs, fmt.Sprintf("room %s is in rooms.%s. Want one of %v", roomID, got, wantStates))
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%s's own /sync disagrees with the state machine: %s", userID, strings.Join(errs, "\n"))
+		}
+	}
+	return nil
+}
@@ -2,9 +2,7 @@ package internal
 
 import (
 	"errors"
-	"fmt"
 	"log"
-	"math/rand"
 	"time"
 
 	"github.com/element-hq/chaos/ws"
@@ -13,10 +11,24 @@ import (
 type Action string
 
 const (
-	ActionJoin    Action = "join"
-	ActionSend    Action = "send"
-	ActionLeave   Action = "leave"
-	ActionTickEOF Action = "tick_eof"
+	ActionJoin          Action = "join"
+	ActionSend          Action = "send"
+	ActionLeave         Action = "leave"
+	ActionSetName       Action = "set_name"
+	ActionSetTopic      Action = "set_topic"
+	ActionSetState      Action = "set_state" // custom state events
+	ActionKick          Action = "kick"
+	ActionBan           Action = "ban"
+	ActionUnban         Action = "unban"
+	ActionInvite        Action = "invite"
+	ActionReject        Action = "reject" // reject an invite
+	ActionKnock         Action = "knock"
+	ActionSetPowerLevel Action = "set_power_level" // set the power level of the target user
+	ActionUpgrade       Action = "upgrade"         // upgrade the room to RoomVersion
+	// change the display name of the user, which updates their member event in every room they are joined to
+	ActionSetDisplayName Action = "set_displayname"
+	ActionRedact         Action = "redact" // redact the event sent by the command with the EventKey in Redacts
+	ActionTickEOF        Action = "tick_eof"
 )
 
 // Sentinel error indicating the end of the tick. Used as a synchronisation mechanism
@@ -28,60 +40,108 @@ type WorkerCommand struct {
 	UserID      string
 	RoomID      string
 	ServerNames []string
+	Body        string // the message body for ActionSend
+	Target      string // the user being kicked, banned, unbanned, invited or given a power level by UserID
+	PowerLevel  int    // the new power level of Target for ActionSetPowerLevel
+	RoomVersion string // the room version to upgrade to for ActionUpgrade
+	DisplayName string // the new display name for ActionSetDisplayName, which has no RoomID
+	// Identifies the event sent by ActionSend and state events, so it can be redacted later. Empty if
+	// redactions are disabled.
+	EventKey string
+	Redacts  string // the EventKey of the event to redact for ActionRedact
+	EventID  string // the event ID of Redacts, which is only valid for this run
+	// Contested commands need power which is being taken away from UserID in the same tick, or race a membership
+	// change which servers may not have seen yet, so the server may or may not accept them. See StateMachine.Tick.
+	Contested bool
+	// The state event to send for ActionSetName, ActionSetTopic and ActionSetState
+	EventType string
+	StateKey  string
+	Content   map[string]any
+}
+
+// CommandResult is the outcome of executing a single WorkerCommand.
+type CommandResult struct {
+	Err               error  // nil if the command succeeded
+	ReplacementRoomID string // the room created by ActionUpgrade
+	EventID           string // the event sent by ActionSend and state events
 }
 
 type Worker struct {
-	Users      map[string]*CSAPI
-	Chan       chan WorkerCommand
-	SignalChan chan error
+	Users map[string]*CSAPI
+	Chan  chan WorkerCommand
+	// A CommandResult is sent for every command in the order they were received, followed by
+	// a CommandResult with ErrTickEOF when the tick EOF command is seen.
+	SignalChan chan CommandResult
 	wsServer   *ws.Server
 }
 
-func NewWorker(users []CSAPI, wsServer *ws.Server, recv chan WorkerCommand, err chan error) *Worker {
+// NewWorker creates a worker for the provided users. The users may be shared with the Master e.g masters,
+// so they must not be used elsewhere whilst a tick is executing.
+func NewWorker(users []*CSAPI, wsServer *ws.Server, recv chan WorkerCommand, results chan CommandResult) *Worker {
 	w := &Worker{
 		Users:      make(map[string]*CSAPI),
 		Chan:       recv,
-		SignalChan: err,
+		SignalChan: results,
 		wsServer:   wsServer,
 	}
-	for i := range users {
-		w.Users[users[i].UserID] = &users[i]
+	for _, u := range users {
+		w.Users[u.UserID] = u
 	}
 	return w
 }
 
+// Run executes commands sent to this worker until the channel is closed. Commands are executed
+// sequentially in the order they are received, so the order of commands for each user in a tick
+// is preserved even when many users share a worker.
 func (w *Worker) Run() {
 	for cmd := range w.Chan {
 		time.Sleep(time.Millisecond) // ensure a maximum frequency of 1000/second
 		if cmd.Action == ActionTickEOF {
-			w.SignalChan <- ErrTickEOF
+			w.SignalChan <- CommandResult{Err: ErrTickEOF}
 			continue
 		}
 		user := w.Users[cmd.UserID]
 		if user == nil {
 			log.Fatalf("Worker received instruction for unknown user '%s' known users = %d", cmd.UserID, len(w.Users))
 		}
-		var body string
-		if cmd.Action == ActionSend {
-			body = fmt.Sprintf("%s %s", adjectives[rand.Intn(len(adjectives))], nouns[rand.Intn(len(nouns))])
-		}
 		w.wsServer.Send(&ws.PayloadWorkerAction{
 			Action: string(cmd.Action),
 			UserID: cmd.UserID,
 			RoomID: cmd.RoomID,
-			Body:   body,
+			Body:   cmd.Body,
+			Target: cmd.Target,
 		})
 		var err error
+		var result CommandResult
 		switch cmd.Action {
 		case ActionJoin:
 			err = user.JoinRoom(cmd.RoomID, cmd.ServerNames)
-		case ActionLeave:
+		case ActionLeave, ActionReject:
 			err = user.LeaveRoom(cmd.RoomID)
 		case ActionSend:
-			_, err = user.SendMessageWithText(cmd.RoomID, body)
-		}
-		if err != nil {
-			w.SignalChan <- err
+			result.EventID, err = user.SendMessageWithText(cmd.RoomID, cmd.Body)
+		case ActionSetName, ActionSetTopic, ActionSetState:
+			result.EventID, err = user.SendState(cmd.RoomID, cmd.EventType, cmd.StateKey, cmd.Content)
+		case ActionKick:
+			err = user.Kick(cmd.RoomID, cmd.Target)
+		case ActionBan:
+			err = user.Ban(cmd.RoomID, cmd.Target)
+		case ActionUnban:
+			err = user.Unban(cmd.RoomID, cmd.Target)
+		case ActionInvite:
+			err = user.Invite(cmd.RoomID, cmd.Target)
+		case ActionKnock:
+			err = user.Knock(cmd.RoomID, cmd.ServerNames)
+		case ActionSetPowerLevel:
+			err = user.SetPowerLevel(cmd.RoomID, cmd.Target, cmd.PowerLevel)
+		case ActionUpgrade:
+			result.ReplacementRoomID, err = user.UpgradeRoom(cmd.RoomID, cmd.RoomVersion)
+		case ActionSetDisplayName:
+			err = user.SetDisplayName(cmd.DisplayName)
+		case ActionRedact:
+			_, err = user.Redact(cmd.RoomID, cmd.EventID)
 		}
+		result.Err = err
+		w.SignalChan <- result
 	}
 }
@@ -30,6 +30,14 @@ func (ps ProcessSnapshot) String() string {
 	return fmt.Sprintf("%s (%s) CPU=%vm Mem=%dMB", ps.Homeserver, ps.ProcessName, ps.MilliCPUs, (ps.MemoryBytes/1024)/1024)
 }
 
+// ConvergenceTime is how long a homeserver took to converge after a netsplit healed.
+type ConvergenceTime struct {
+	RunID          string `db:"run_id"` // identifies the run, so times from different runs can be told apart
+	Tick           int    `db:"tick"`   // the tick after which convergence was checked
+	Homeserver     string `db:"homeserver"`
+	ConvergeMillis int64  `db:"converge_millis"`
+}
+
 // Snapshotter is the interface required to perform metric snapshots on homeservers
 type Snapshotter interface {
 	Snapshot() (*Snapshot, error)
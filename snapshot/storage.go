@@ -22,7 +22,17 @@ func NewStorage(filePath string) (*Storage, error) {
 		process TEXT NOT NULL,
 		memory_bytes BIGINT NOT NULL,
 		cpu_millis BIGINT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS convergence_times(
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		run_id TEXT NOT NULL DEFAULT '',
+		tick BIGINT NOT NULL DEFAULT 0,
+		homeserver TEXT NOT NULL,
+		converge_millis BIGINT NOT NULL
 	);`)
+	// databases created before runs and ticks were stored lack these columns. This fails if they already exist.
+	db.Exec(`ALTER TABLE convergence_times ADD COLUMN run_id TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE convergence_times ADD COLUMN tick BIGINT NOT NULL DEFAULT 0`)
 	return &Storage{
 		db: db,
 	}, nil
@@ -41,3 +51,19 @@ func (s *Storage) WriteSnapshot(snap Snapshot) error {
 	}
 	return nil
 }
+
+// WriteConvergenceTimes stores how long each homeserver took to converge after a netsplit healed, along with
+// the run and tick of the convergence check.
+func (s *Storage) WriteConvergenceTimes(times []ConvergenceTime) error {
+	if len(times) == 0 {
+		return nil
+	}
+	_, err := s.db.NamedExec(
+		`INSERT INTO convergence_times(run_id,tick,homeserver,converge_millis) VALUES(:run_id, :tick, :homeserver, :converge_millis)`,
+		times,
+	)
+	if err != nil {
+		return fmt.Errorf("WriteConvergenceTimes: %s", err)
+	}
+	return nil
+}
@@ -1,11 +1,13 @@
 import { create } from 'zustand';
 import { type AppNode } from "./Nodes";
-import { ChaosWebsocket, PayloadConfig, PayloadConvergence, PayloadFederationRequest, PayloadNetsplit, PayloadRestart, PayloadTickGeneration, PayloadWorkerAction } from './WebSockets';
+import { ChaosWebsocket, PayloadConfig, PayloadConvergence, PayloadConvergenceReport, PayloadFederationRequest, PayloadNetsplit, PayloadRestart, PayloadTickGeneration, PayloadWorkerAction } from './WebSockets';
 import { addEdge, applyEdgeChanges, applyNodeChanges, Connection, Edge, EdgeChange, NodeChange, Position } from '@xyflow/react';
 import { AppEdge, ClientServerEdgeLabel } from './Edges';
 
 export type ChaosStore = {
     convergenceState: string
+    // the report from the last failed convergence check, if any
+    convergenceReport: PayloadConvergenceReport | null
     isNetsplit: boolean
     started: boolean
     fedLatencyMs: number
@@ -30,6 +32,7 @@ export type ChaosStore = {
     onWorkerAction: (payload: PayloadWorkerAction) => void
     onTickGeneration: (payload: PayloadTickGeneration) => void
     onConvergenceUpdate: (payload: PayloadConvergence) => void
+    onConvergenceReport: (payload: PayloadConvergenceReport) => void
     onNetsplit: (payload: PayloadNetsplit) => void
     onFederationRequest: (payload: PayloadFederationRequest) => void
     onServerRestart: (payload: PayloadRestart) => void
@@ -59,6 +62,7 @@ let addedListeners = false;
 
 export const useStore = create<ChaosStore>()((set, get) => ({
     convergenceState: "-",
+    convergenceReport: null,
     started: false,
     isNetsplit: false,
     connectedToRemoteServer: false,
@@ -170,6 +174,11 @@ export const useStore = create<ChaosStore>()((set, get) => ({
             });
         }
     },
+    onConvergenceReport: (payload: PayloadConvergenceReport) => {
+        set({
+            convergenceReport: payload,
+        });
+    },
     onNetsplit: (payload: PayloadNetsplit) => {
         set({
             isNetsplit: payload.Started,
@@ -235,6 +244,9 @@ export const useStore = create<ChaosStore>()((set, get) => ({
             ws.addEventListener("PayloadConvergence", (ev: unknown) => {
                 get().onConvergenceUpdate((ev as CustomEvent).detail);
             });
+            ws.addEventListener("PayloadConvergenceReport", (ev: unknown) => {
+                get().onConvergenceReport((ev as CustomEvent).detail);
+            });
             ws.addEventListener("PayloadNetsplit", (ev: unknown) => {
                 get().onNetsplit((ev as CustomEvent).detail);
             });
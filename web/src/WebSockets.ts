@@ -56,6 +56,9 @@ export class ChaosWebsocket extends EventTarget {
             case "PayloadRestart":
                 this.dispatchEvent(new CustomEvent("PayloadRestart", {detail: msg.Payload}));
                 break;
+            case "PayloadConvergenceReport":
+                this.dispatchEvent(new CustomEvent("PayloadConvergenceReport", {detail: msg.Payload}));
+                break;
         }
     }
 
@@ -87,6 +90,32 @@ export type PayloadNetsplit = {
 export type PayloadConvergence = {
     State: string
     Error: string
+    TimeToConvergeMs?: Record<string, number>
+    Invariants?: Array<InvariantResult>
+}
+export type InvariantResult = {
+    Name: string,
+    Result: "pass" | "fail" | "error",
+    Detail?: string,
+}
+export type MembershipMismatch = {
+    RoomID: string,
+    Server: string,
+    UserID: string,
+    WantStates: Array<string>,
+    GotMembership: string,
+    WantDisplayNames?: Array<string>,
+    GotDisplayName?: string,
+    EventID?: string,
+    OriginServer?: string,
+    OriginServerTS?: number,
+    AgeMs?: number,
+}
+export type PayloadConvergenceReport = {
+    CheckedAtMs: number,
+    Error: string,
+    Mismatches: Array<MembershipMismatch> | null,
+    Path?: string,
 }
 export type PayloadTickGeneration = {
     Number: number,
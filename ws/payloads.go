@@ -3,6 +3,7 @@ package ws
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/element-hq/chaos/config"
 )
@@ -50,6 +51,8 @@ func (w *WSMessage) DecodePayload() (WSPayload, error) {
 		return decodeAs[*PayloadConvergence](w)
 	case "PayloadRestart":
 		return decodeAs[*PayloadRestart](w)
+	case "PayloadConvergenceReport":
+		return decodeAs[*PayloadConvergenceReport](w)
 	default:
 		return nil, fmt.Errorf("unknown type: %s", w.Type)
 	}
@@ -74,9 +77,13 @@ type PayloadWorkerAction struct {
 	RoomID string
 	Action string
 	Body   string
+	Target string `json:",omitempty"` // the user being kicked, banned, unbanned or invited
 }
 
 func (w *PayloadWorkerAction) String() string {
+	if w.Target != "" {
+		return fmt.Sprintf("WorkerAction: %s %s %s in %s", w.UserID, w.Action, w.Target, w.RoomID)
+	}
 	return fmt.Sprintf("WorkerAction: %s %s %s %s", w.UserID, w.Action, w.RoomID, w.Body)
 }
 
@@ -135,9 +142,35 @@ func (w *PayloadNetsplit) Type() string {
 type PayloadConvergence struct {
 	State string
 	Error string
+	// how long each server took to converge after the netsplit healed, keyed by server domain. Only set when
+	// polling for convergence.
+	TimeToConvergeMs map[string]int64 `json:",omitempty"`
+	// the result of every registered invariant, in the order they were registered
+	Invariants []InvariantResult `json:",omitempty"`
+}
+
+// InvariantResult is the result of checking a registered invariant.
+type InvariantResult struct {
+	Name   string
+	Result string // one of "pass", "fail" or "error"
+	Detail string `json:",omitempty"` // why the invariant failed or could not be checked
 }
 
 func (w *PayloadConvergence) String() string {
+	if len(w.Invariants) > 0 {
+		var results []string
+		for _, inv := range w.Invariants {
+			if inv.Detail == "" {
+				results = append(results, fmt.Sprintf("%s=%s", inv.Name, inv.Result))
+			} else {
+				results = append(results, fmt.Sprintf("%s=%s (%s)", inv.Name, inv.Result, inv.Detail))
+			}
+		}
+		return fmt.Sprintf("Convergence[%s]: %s", w.State, strings.Join(results, ", "))
+	}
+	if len(w.TimeToConvergeMs) > 0 {
+		return fmt.Sprintf("Convergence[%s]: time to converge %v", w.State, w.TimeToConvergeMs)
+	}
 	if w.Error == "" {
 		return fmt.Sprintf("Convergence[%s]", w.State)
 	}
@@ -148,6 +181,42 @@ func (w *PayloadConvergence) Type() string {
 	return "PayloadConvergence"
 }
 
+// MembershipMismatch is a user whose membership or display name in a room, as seen by a server, is not what
+// the state machine expects.
+type MembershipMismatch struct {
+	RoomID           string
+	Server           string // the domain of the server which disagrees with the state machine
+	UserID           string
+	WantStates       []string
+	GotMembership    string
+	WantDisplayNames []string `json:",omitempty"`
+	GotDisplayName   string   `json:",omitempty"`
+	// the member event which gave the user GotMembership, if the server returned one
+	EventID        string `json:",omitempty"`
+	OriginServer   string `json:",omitempty"` // the domain of the sender of the member event
+	OriginServerTS int64  `json:",omitempty"`
+	AgeMs          int64  `json:",omitempty"` // how long ago the server received the member event, when checked
+}
+
+// PayloadConvergenceReport is sent when a convergence check fails, with every mismatch found by the last check.
+type PayloadConvergenceReport struct {
+	CheckedAtMs int64
+	Error       string
+	Mismatches  []MembershipMismatch
+	Path        string `json:",omitempty"` // where the report was written, if anywhere
+}
+
+func (w *PayloadConvergenceReport) String() string {
+	if w.Path != "" {
+		return fmt.Sprintf("%sConvergenceReport: %d mismatches, written to %s%s", colorRed, len(w.Mismatches), w.Path, colorNone)
+	}
+	return fmt.Sprintf("%sConvergenceReport: %d mismatches%s", colorRed, len(w.Mismatches), colorNone)
+}
+
+func (w *PayloadConvergenceReport) Type() string {
+	return "PayloadConvergenceReport"
+}
+
 type PayloadRestart struct {
 	Domain   string
 	Finished bool